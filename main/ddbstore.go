@@ -1,35 +1,83 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	_ "expvar"
 	"flag"
 	. "github.com/Cyberax/argus-vision/visibility/logging"
 	"github.com/SimplestCloud/jaeger-ddb-spanstore/spanstore"
 	"github.com/SimplestCloud/jaeger-ddb-spanstore/utils"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
+	spanstore_api "github.com/jaegertracing/jaeger/storage/spanstore"
 	"go.uber.org/zap/zapcore"
 	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"net"
+	"net/http"
+	"os"
 )
 
 func main() {
-	var awsProfile, dbSuffix, listenAddress string
-	var debug, create bool
+	var awsProfile, dbSuffix, listenAddress, metricsAddress string
+	var tagIndexingFile, redactionFile, filterFile, pageTokenKeyFile string
+	var debug, create, legacyTraceIds, dedupProcesses bool
 	var ttlDays, archiveTtlDays int64
+	var readCapacityBudget, traceLoadRate float64
+	var parallelTraceLoads int
+	var filterReload, activityFlush, recentSpansWindow, indexRefresh time.Duration
+	var traceCacheSettle, traceCacheNegativeTtl time.Duration
+	var traceCacheBytes int64
+	var schemaOpts spanstore.SchemaOptions
 	flag.StringVar(&awsProfile, "aws-profile", "", "AWS profile to use")
 	flag.StringVar(&dbSuffix, "db-suffix", "-dev", "DB tables suffix")
 	flag.StringVar(&listenAddress, "listen", "[::]:4500", "The network address to listen on")
+	flag.StringVar(&metricsAddress, "metrics-listen", "",
+		"The network address to serve the metrics (at /debug/vars) on, disabled if empty")
+	flag.StringVar(&tagIndexingFile, "tag-indexing-config", "",
+		"JSON file with the rules for the tags to make searchable, all tags are indexed if empty")
+	flag.StringVar(&redactionFile, "redaction-config", "",
+		"JSON file with the rules to scrub the sensitive data, nothing is scrubbed if empty")
+	flag.StringVar(&filterFile, "span-filter-config", "",
+		"JSON file with the rules to drop or downsample spans, nothing is dropped if empty")
+	flag.StringVar(&pageTokenKeyFile, "page-token-key-file", "",
+		"File with the key to sign the search page tokens, it must be the same for all the replicas, "+
+			"a random key is used if empty")
+	flag.DurationVar(&filterReload, "span-filter-reload", 30*time.Second,
+		"How often to check the span filter rules for changes")
+	flag.BoolVar(&legacyTraceIds, "legacy-trace-ids", false,
+		"Also look the traces up by the legacy unpadded IDs, only needed until the IDs are migrated")
+	flag.BoolVar(&dedupProcesses, "dedup-processes", false,
+		"Store each distinct process once per trace instead of embedding it into every span")
+	flag.DurationVar(&activityFlush, "activity-flush", time.Minute,
+		"How often to save the per-service span counts used to skip the empty search buckets")
+	flag.Float64Var(&readCapacityBudget, "search-rcu-budget", 0,
+		"The read capacity units a trace search may consume before returning partial results, "+
+			"unlimited if zero")
+	flag.DurationVar(&recentSpansWindow, "recent-spans-window", 30*time.Second,
+		"How long the written spans are served from memory while the indexes catch up, disabled if zero")
+	flag.Int64Var(&traceCacheBytes, "trace-cache-bytes", 64<<20,
+		"The approximate memory limit of the cache of the traces that don't change anymore, disabled if zero")
+	flag.DurationVar(&traceCacheSettle, "trace-cache-settle", 5*time.Minute,
+		"Only the traces without new spans for this long are cached")
+	flag.DurationVar(&traceCacheNegativeTtl, "trace-cache-negative-ttl", 5*time.Second,
+		"How long the traces that were not found are remembered, disabled if zero")
+	flag.IntVar(&parallelTraceLoads, "parallel-trace-loads", 8,
+		"How many traces are loaded in parallel when a search returns many of them")
+	flag.Float64Var(&traceLoadRate, "trace-load-rate", 0,
+		"How many traces per second the searches may load in total, unlimited if zero")
+	flag.DurationVar(&indexRefresh, "index-refresh", time.Minute,
+		"How often to check for the replaced GSIs that are ready to be used, disabled if zero")
 	flag.BoolVar(&debug, "debug", false, "Debug mode")
-	flag.BoolVar(&create, "create-tables", true, "Create missing DynamoDB tables")
+	flag.BoolVar(&create, "create-tables", true,
+		"Create missing DynamoDB tables, the changes of the existing ones are applied by the schema tool")
+	schemaOpts.RegisterFlags(flag.CommandLine)
 	flag.Int64Var(&ttlDays, "ttl-days", 60, "TTL for traces (in days)")
 	flag.Int64Var(&archiveTtlDays, "archive-ttl-days", 180, "TTL for archived traces (in days)")
 	flag.Parse()
@@ -43,27 +91,118 @@ func main() {
 		ctx = ImbueContext(context.Background(), logger)
 	}
 
-	awsConfig := prepareAws(ctx, awsProfile)
+	// The counts of the buckets younger than the grace period are not trusted, so they
+	// have to be flushed within it
+	if activityFlush <= 0 || activityFlush >= spanstore.ActivityGracePeriod {
+		L(ctx).Fatal("The activity flush interval must be shorter than the grace period",
+			zap.Duration("activity-flush", activityFlush),
+			zap.Duration("grace-period", spanstore.ActivityGracePeriod))
+	}
+
+	awsConfig, err := utils.LoadAwsConfig(ctx, awsProfile)
+	if err != nil {
+		L(ctx).Fatal("Failed to load AWS config", zap.Error(err))
+	}
 
 	if create {
-		err := spanstore.EnsureTablesAreReady(ctx, dbSuffix, awsConfig)
+		err = spanstore.EnsureTablesAreReady(ctx, dbSuffix, awsConfig, schemaOpts)
 		if err != nil {
 			L(ctx).Fatal("Failed to create tables", zap.Error(err))
 		}
 	}
 
+	metricsFactory := utils.NewExpvarFactory("jaeger_ddb")
+	if metricsAddress != "" {
+		go serveMetrics(ctx, metricsAddress)
+	}
+
+	writerOpts := spanstore.WriterOptions{DedupProcesses: dedupProcesses, Metrics: metricsFactory}
+	if tagIndexingFile != "" {
+		tagConfig, err := spanstore.LoadTagIndexingConfig(tagIndexingFile)
+		if err != nil {
+			L(ctx).Fatal("Failed to load the tag indexing config", zap.Error(err))
+		}
+		writerOpts.TagIndexer, err = spanstore.NewTagIndexer(tagConfig, metricsFactory)
+		if err != nil {
+			L(ctx).Fatal("Failed to create the tag indexer", zap.Error(err))
+		}
+	}
+	if redactionFile != "" {
+		redactionConfig, err := spanstore.LoadRedactionConfig(redactionFile)
+		if err != nil {
+			L(ctx).Fatal("Failed to load the redaction config", zap.Error(err))
+		}
+		writerOpts.Redactor, err = spanstore.NewRedactor(redactionConfig)
+		if err != nil {
+			L(ctx).Fatal("Failed to create the redactor", zap.Error(err))
+		}
+	}
+
 	dbClient := dynamodb.NewFromConfig(awsConfig)
 
 	depManager := spanstore.NewDependencyManager(dbClient, dbSuffix, archiveTtlDays*86400)
 	depManager.Start()
 	defer depManager.Stop()
 
-	reader := &spanstore.DdbReader{}
+	activity := spanstore.NewActivityTracker(dbClient, dbSuffix, archiveTtlDays*86400, metricsFactory)
+	activity.Start(ctx, activityFlush)
+	defer activity.Stop()
+	writerOpts.Activity = activity
+
+	var recentSpans *spanstore.RecentSpanCache
+	if recentSpansWindow != 0 {
+		recentSpans = spanstore.NewRecentSpanCache(recentSpansWindow)
+		recentSpans.Start()
+		defer recentSpans.Stop()
+		writerOpts.RecentSpans = recentSpans
+	}
 
-	writer := spanstore.NewDdbWriter(dbClient, dbSuffix, ttlDays*86400, depManager)
-	archiveWriter := spanstore.NewDdbWriter(dbClient, dbSuffix, archiveTtlDays*86400, depManager)
+	indexes := spanstore.NewIndexResolver(dbClient, dbSuffix)
+	err = indexes.Refresh(ctx)
+	if err != nil {
+		L(ctx).Error("Failed to resolve the GSI versions", zap.Error(err))
+	}
+	indexes.Start(ctx, indexRefresh)
+	defer indexes.Stop()
+
+	readerOpts := spanstore.ReaderOptions{
+		Metrics:            metricsFactory,
+		ReadCapacityBudget: readCapacityBudget,
+		RecentSpans:        recentSpans,
+
+		MaxParallelTraceLoads: parallelTraceLoads,
+		TraceLoadRate:         traceLoadRate,
+		Indexes:               indexes,
+		LegacyTraceIds:        legacyTraceIds,
+	}
+	if pageTokenKeyFile != "" {
+		key, err := os.ReadFile(pageTokenKeyFile)
+		if err != nil {
+			L(ctx).Fatal("Failed to read the page token key", zap.Error(err))
+		}
+		readerOpts.PageTokenKey = bytes.TrimSpace(key)
+	}
+	if traceCacheBytes != 0 {
+		readerOpts.TraceCache = spanstore.NewTraceCache(traceCacheBytes, traceCacheSettle,
+			traceCacheNegativeTtl, metricsFactory)
+		writerOpts.TraceCache = readerOpts.TraceCache
+	}
+	reader := spanstore.NewDdbReader(dbClient, dbSuffix, readerOpts)
 
-	plug := spanstore.NewPlugin(reader, writer, archiveWriter)
+	var writer spanstore_api.Writer = spanstore.NewDdbWriter(dbClient, dbSuffix, ttlDays*86400,
+		depManager, writerOpts)
+	if filterFile != "" {
+		filter, err := spanstore.NewSpanFilter(filterFile, metricsFactory)
+		if err != nil {
+			L(ctx).Fatal("Failed to load the span filter", zap.Error(err))
+		}
+		filter.Start(ctx, filterReload)
+		defer filter.Stop()
+		writer = spanstore.NewFilteringWriter(filter, writer)
+	}
+
+	archive := spanstore.NewDdbArchive(dbClient, dbSuffix, archiveTtlDays*86400)
+	plug := spanstore.NewPlugin(reader, writer, archive)
 
 	L(ctx).Info("Opening listener", zap.String("listen-address", listenAddress))
 
@@ -102,17 +241,11 @@ func main() {
 	_ = server.Serve(listener)
 }
 
-func prepareAws(ctx context.Context, profile string) aws.Config {
-	var options []func(options *config.LoadOptions) error
-
-	if profile != "" {
-		options = append(options, config.WithSharedConfigProfile(profile))
-	}
-
-	cfg, err := config.LoadDefaultConfig(ctx, options...)
+// serveMetrics exposes the expvar metrics over HTTP
+func serveMetrics(ctx context.Context, address string) {
+	L(ctx).Info("Serving metrics", zap.String("metrics-address", address))
+	err := http.ListenAndServe(address, nil)
 	if err != nil {
-		L(ctx).Fatal("Failed to load AWS config", zap.Error(err))
+		L(ctx).Error("Failed to serve metrics", zap.Error(err))
 	}
-
-	return cfg
 }
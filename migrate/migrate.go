@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	. "github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/SimplestCloud/jaeger-ddb-spanstore/spanstore"
+	"github.com/SimplestCloud/jaeger-ddb-spanstore/utils"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"go.uber.org/zap"
+)
+
+// Rewrites the spans and the trace summaries stored with the legacy (unpadded)
+// trace and span IDs into the canonical fixed-width encoding, and then backfills
+// the trace summaries and the operation and error buckets of the spans written
+// before they were introduced, so the searches find them.
+func main() {
+	var awsProfile, dbSuffix string
+	var debug, dryRun bool
+	flag.StringVar(&awsProfile, "aws-profile", "", "AWS profile to use")
+	flag.StringVar(&dbSuffix, "db-suffix", "-dev", "DB tables suffix")
+	flag.BoolVar(&debug, "debug", false, "Debug mode")
+	flag.BoolVar(&dryRun, "dry-run", false, "Only count the items that need to be migrated")
+	flag.Parse()
+
+	var ctx context.Context
+	if debug {
+		ctx = ImbueContext(context.Background(), ConfigureDevLogger())
+	} else {
+		ctx = ImbueContext(context.Background(), ConfigureProdLogger())
+	}
+
+	awsConfig, err := utils.LoadAwsConfig(ctx, awsProfile)
+	if err != nil {
+		L(ctx).Fatal("Failed to load AWS config", zap.Error(err))
+	}
+
+	migrator := spanstore.NewIdMigrator(dynamodb.NewFromConfig(awsConfig), dbSuffix, dryRun)
+	stats, err := migrator.Migrate(ctx)
+	if err != nil {
+		L(ctx).Fatal("Failed to migrate the IDs", zap.Error(err))
+	}
+
+	L(ctx).Info("ID migration is complete", zap.Bool("dry-run", dryRun),
+		zap.Int64("spans-scanned", stats.SpansScanned),
+		zap.Int64("spans-migrated", stats.SpansMigrated),
+		zap.Int64("summaries-scanned", stats.SummariesScanned),
+		zap.Int64("summaries-migrated", stats.SummariesMigrated))
+
+	backfiller := spanstore.NewSummaryBackfiller(dynamodb.NewFromConfig(awsConfig), dbSuffix, dryRun)
+	backfillStats, err := backfiller.Backfill(ctx)
+	if err != nil {
+		L(ctx).Fatal("Failed to backfill the trace summaries", zap.Error(err))
+	}
+
+	L(ctx).Info("Backfill is complete", zap.Bool("dry-run", dryRun),
+		zap.Int64("spans-scanned", backfillStats.SpansScanned),
+		zap.Int64("spans-backfilled", backfillStats.SpansBackfilled))
+}
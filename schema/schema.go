@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	. "github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/SimplestCloud/jaeger-ddb-spanstore/schemer"
+	"github.com/SimplestCloud/jaeger-ddb-spanstore/spanstore"
+	"github.com/SimplestCloud/jaeger-ddb-spanstore/utils"
+	"go.uber.org/zap"
+	"os"
+	"time"
+)
+
+// Compares the schema of the DynamoDB tables with the expected one, and optionally
+// applies the changes.
+func main() {
+	var awsProfile, dbSuffix, format string
+	var debug, apply, allowDestructive bool
+	var gsiWaitTimeout time.Duration
+	var schemaOpts spanstore.SchemaOptions
+	flag.StringVar(&awsProfile, "aws-profile", "", "AWS profile to use")
+	flag.StringVar(&dbSuffix, "db-suffix", "-dev", "DB tables suffix")
+	flag.BoolVar(&debug, "debug", false, "Debug mode")
+	flag.StringVar(&format, "format", "text", "The plan output format: text or json")
+	flag.BoolVar(&apply, "apply", false, "Apply the plan")
+	flag.BoolVar(&allowDestructive, "allow-destructive", false,
+		"Apply the destructive changes, e.g. deleting or recreating the GSIs")
+	flag.DurationVar(&gsiWaitTimeout, "gsi-wait-timeout", 15*time.Minute,
+		"How long to wait for each created GSI to be backfilled, the large tables can take hours")
+	schemaOpts.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	var ctx context.Context
+	if debug {
+		ctx = ImbueContext(context.Background(), ConfigureDevLogger())
+	} else {
+		ctx = ImbueContext(context.Background(), ConfigureProdLogger())
+	}
+
+	if format != "text" && format != "json" {
+		L(ctx).Fatal("Unknown output format", zap.String("format", format))
+	}
+
+	awsConfig, err := utils.LoadAwsConfig(ctx, awsProfile)
+	if err != nil {
+		L(ctx).Fatal("Failed to load AWS config", zap.Error(err))
+	}
+
+	initializer := schemer.NewDynamoDbInitializer("", dbSuffix, awsConfig)
+	initializer.GsiWaitTimeout = gsiWaitTimeout
+	plan, err := initializer.Plan(ctx, spanstore.Tables(schemaOpts))
+	if err != nil {
+		L(ctx).Fatal("Failed to plan the schema changes", zap.Error(err))
+	}
+
+	if format == "json" {
+		out, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			L(ctx).Fatal("Failed to marshal the plan", zap.Error(err))
+		}
+		fmt.Println(string(out))
+	} else {
+		fmt.Print(plan.String())
+	}
+
+	if !apply {
+		return
+	}
+
+	err = initializer.Apply(ctx, plan, allowDestructive)
+	if errors.Is(err, schemer.ErrManualChanges) {
+		L(ctx).Warn("Some changes have to be made manually")
+		os.Exit(1)
+	}
+	if err != nil {
+		L(ctx).Fatal("Failed to apply the schema changes", zap.Error(err))
+	}
+	L(ctx).Info("The schema is up-to-date")
+}
@@ -0,0 +1,282 @@
+package schemer
+
+import (
+	"context"
+	"fmt"
+	. "github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/applicationautoscaling"
+	astypes "github.com/aws/aws-sdk-go-v2/service/applicationautoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Capacity is the provisioned throughput of a table or a GSI, it's only used with
+// the provisioned billing mode
+type Capacity struct {
+	// The units default to the auto-scaling minimum, or to 1
+	ReadUnits  int64
+	WriteUnits int64
+
+	// The units are adjusted by the Application Auto Scaling if set, the units above
+	// are only used when the table or the GSI is created
+	ReadScaling  *AutoScaling
+	WriteScaling *AutoScaling
+}
+
+// AutoScaling keeps the consumed capacity around the target utilization
+type AutoScaling struct {
+	MinUnits int32
+	MaxUnits int32
+	// The consumed to provisioned capacity ratio, in percents
+	TargetUtilization float64
+}
+
+// AutoScaler is the part of the Application Auto Scaling API that manages the
+// capacity of the tables, the tests replace it with a fake
+type AutoScaler interface {
+	RegisterScalableTarget(ctx context.Context, params *applicationautoscaling.RegisterScalableTargetInput,
+		optFns ...func(*applicationautoscaling.Options)) (*applicationautoscaling.RegisterScalableTargetOutput, error)
+	PutScalingPolicy(ctx context.Context, params *applicationautoscaling.PutScalingPolicyInput,
+		optFns ...func(*applicationautoscaling.Options)) (*applicationautoscaling.PutScalingPolicyOutput, error)
+}
+
+func (t *Table) billingMode() ddbtypes.BillingMode {
+	if t.BillingMode == "" {
+		return ddbtypes.BillingModePayPerRequest
+	}
+	return t.BillingMode
+}
+
+func (t *Table) provisioned() bool {
+	return t.billingMode() == ddbtypes.BillingModeProvisioned
+}
+
+func initialUnits(units int64, scaling *AutoScaling) int64 {
+	if units > 0 {
+		return units
+	}
+	if scaling != nil && scaling.MinUnits > 0 {
+		return int64(scaling.MinUnits)
+	}
+	return 1
+}
+
+// throughput is the capacity of the new table or GSI
+func (c Capacity) throughput() *ddbtypes.ProvisionedThroughput {
+	return &ddbtypes.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(initialUnits(c.ReadUnits, c.ReadScaling)),
+		WriteCapacityUnits: aws.Int64(initialUnits(c.WriteUnits, c.WriteScaling)),
+	}
+}
+
+// update returns the capacity of the existing table or GSI, if it needs to be
+// changed. The auto-scaled units are left as they are.
+func (c Capacity) update(current *ddbtypes.ProvisionedThroughputDescription) (*ddbtypes.ProvisionedThroughput, bool) {
+	desired := c.throughput()
+	if current == nil {
+		return desired, true
+	}
+
+	curRead, curWrite := aws.ToInt64(current.ReadCapacityUnits), aws.ToInt64(current.WriteCapacityUnits)
+	if c.ReadScaling != nil && curRead > 0 {
+		desired.ReadCapacityUnits = aws.Int64(curRead)
+	}
+	if c.WriteScaling != nil && curWrite > 0 {
+		desired.WriteCapacityUnits = aws.Int64(curWrite)
+	}
+	changed := *desired.ReadCapacityUnits != curRead || *desired.WriteCapacityUnits != curWrite
+	return desired, changed
+}
+
+func currentBillingMode(desc *ddbtypes.TableDescription) ddbtypes.BillingMode {
+	// The tables created before the on-demand billing have no summary
+	if desc.BillingModeSummary == nil || desc.BillingModeSummary.BillingMode == "" {
+		return ddbtypes.BillingModeProvisioned
+	}
+	return desc.BillingModeSummary.BillingMode
+}
+
+// capacityUpdate builds the update of the table's billing mode and capacity, it
+// returns nil if the table is up-to-date
+func capacityUpdate(tableName string, t Table, desc *ddbtypes.TableDescription) *dynamodb.UpdateTableInput {
+	res := &dynamodb.UpdateTableInput{TableName: aws.String(tableName)}
+	switchMode := currentBillingMode(desc) != t.billingMode()
+	if switchMode {
+		res.BillingMode = t.billingMode()
+	}
+	if !t.provisioned() {
+		if switchMode {
+			return res
+		}
+		return nil
+	}
+
+	changed := switchMode
+	var current *ddbtypes.ProvisionedThroughputDescription
+	if !switchMode {
+		current = desc.ProvisionedThroughput
+	}
+	if throughput, ok := t.Capacity.update(current); ok {
+		res.ProvisionedThroughput = throughput
+		changed = true
+	}
+
+	gsis := map[string]GSI{}
+	for _, gsi := range t.GSIs {
+		gsis[gsi.IndexName()] = gsi
+	}
+	for _, i := range desc.GlobalSecondaryIndexes {
+		name := aws.ToString(i.IndexName)
+		// Switching to the provisioned mode needs the capacity of every GSI, the
+		// unknown ones get the table's capacity
+		capacity := t.Capacity
+		if gsi, ok := gsis[name]; ok {
+			capacity = gsi.Capacity
+		} else if !switchMode {
+			continue
+		}
+
+		var currentGsi *ddbtypes.ProvisionedThroughputDescription
+		if !switchMode {
+			currentGsi = i.ProvisionedThroughput
+		}
+		throughput, ok := capacity.update(currentGsi)
+		if !ok {
+			continue
+		}
+		res.GlobalSecondaryIndexUpdates = append(res.GlobalSecondaryIndexUpdates,
+			ddbtypes.GlobalSecondaryIndexUpdate{Update: &ddbtypes.UpdateGlobalSecondaryIndexAction{
+				IndexName:             aws.String(name),
+				ProvisionedThroughput: throughput,
+			}})
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return res
+}
+
+func (db *DynamoDBInitializer) ensureCapacity(ctx context.Context, client *dynamodb.Client,
+	tableName string, t Table) error {
+
+	ctx = WithFields(ctx, zap.String("table-name", tableName))
+
+	response, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return err
+	}
+
+	update := capacityUpdate(tableName, t, response.Table)
+	if update == nil {
+		L(ctx).Info("Table capacity is up-to-date")
+		return nil
+	}
+
+	L(ctx).Info("Updating the table capacity", zap.String("billing-mode", string(t.billingMode())))
+	_, err = client.UpdateTable(ctx, update)
+	if err != nil {
+		return err
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	params := &dynamodb.DescribeTableInput{TableName: aws.String(tableName)}
+	err = waiter.Wait(ctx, params, 15*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	L(ctx).Info("Finished updating the table capacity")
+	return nil
+}
+
+type scalingTarget struct {
+	resourceId string
+	dimension  astypes.ScalableDimension
+	metric     astypes.MetricType
+	scaling    *AutoScaling
+}
+
+// scalingTargets lists the auto-scaled capacities of the table and its GSIs
+func scalingTargets(tableName string, t Table) []scalingTarget {
+	if !t.provisioned() {
+		return nil
+	}
+
+	var res []scalingTarget
+	add := func(resourceId string, c Capacity, read, write astypes.ScalableDimension) {
+		if c.ReadScaling != nil {
+			res = append(res, scalingTarget{resourceId: resourceId, dimension: read,
+				metric: astypes.MetricTypeDynamoDBReadCapacityUtilization, scaling: c.ReadScaling})
+		}
+		if c.WriteScaling != nil {
+			res = append(res, scalingTarget{resourceId: resourceId, dimension: write,
+				metric: astypes.MetricTypeDynamoDBWriteCapacityUtilization, scaling: c.WriteScaling})
+		}
+	}
+
+	tableResource := "table/" + tableName
+	add(tableResource, t.Capacity, astypes.ScalableDimensionDynamoDBTableReadCapacityUnits,
+		astypes.ScalableDimensionDynamoDBTableWriteCapacityUnits)
+	for _, gsi := range t.GSIs {
+		add(tableResource+"/index/"+gsi.IndexName(), gsi.Capacity,
+			astypes.ScalableDimensionDynamoDBIndexReadCapacityUnits,
+			astypes.ScalableDimensionDynamoDBIndexWriteCapacityUnits)
+	}
+	return res
+}
+
+// ensureAutoScaling registers the scalable targets and their target tracking
+// policies, both calls update the existing ones
+func (db *DynamoDBInitializer) ensureAutoScaling(ctx context.Context, tableName string, t Table) error {
+	targets := scalingTargets(tableName, t)
+	if len(targets) == 0 {
+		return nil
+	}
+	if db.AutoScaler == nil {
+		return fmt.Errorf("the auto-scaling of %s is configured, but there is no auto-scaler", tableName)
+	}
+
+	for _, target := range targets {
+		ctx := WithFields(ctx, zap.String("resource-id", target.resourceId),
+			zap.String("dimension", string(target.dimension)))
+		L(ctx).Info("Setting up the auto-scaling")
+
+		_, err := db.AutoScaler.RegisterScalableTarget(ctx, &applicationautoscaling.RegisterScalableTargetInput{
+			ServiceNamespace:  astypes.ServiceNamespaceDynamodb,
+			ResourceId:        aws.String(target.resourceId),
+			ScalableDimension: target.dimension,
+			MinCapacity:       aws.Int32(target.scaling.MinUnits),
+			MaxCapacity:       aws.Int32(target.scaling.MaxUnits),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to register the scalable target: %w", err)
+		}
+
+		_, err = db.AutoScaler.PutScalingPolicy(ctx, &applicationautoscaling.PutScalingPolicyInput{
+			PolicyName:        aws.String(target.resourceId + "-" + string(target.metric)),
+			ServiceNamespace:  astypes.ServiceNamespaceDynamodb,
+			ResourceId:        aws.String(target.resourceId),
+			ScalableDimension: target.dimension,
+			PolicyType:        astypes.PolicyTypeTargetTrackingScaling,
+			TargetTrackingScalingPolicyConfiguration: &astypes.TargetTrackingScalingPolicyConfiguration{
+				TargetValue: aws.Float64(target.scaling.TargetUtilization),
+				PredefinedMetricSpecification: &astypes.PredefinedMetricSpecification{
+					PredefinedMetricType: target.metric,
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to put the scaling policy: %w", err)
+		}
+	}
+
+	L(ctx).Info("Auto-scaling is up-to-date", zap.String("table-name", tableName))
+	return nil
+}
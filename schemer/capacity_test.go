@@ -0,0 +1,141 @@
+package schemer
+
+import (
+	"context"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/applicationautoscaling"
+	astypes "github.com/aws/aws-sdk-go-v2/service/applicationautoscaling/types"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+)
+
+type fakeAutoScaler struct {
+	targets  []*applicationautoscaling.RegisterScalableTargetInput
+	policies []*applicationautoscaling.PutScalingPolicyInput
+}
+
+func (f *fakeAutoScaler) RegisterScalableTarget(_ context.Context,
+	params *applicationautoscaling.RegisterScalableTargetInput,
+	_ ...func(*applicationautoscaling.Options)) (*applicationautoscaling.RegisterScalableTargetOutput, error) {
+
+	f.targets = append(f.targets, params)
+	return &applicationautoscaling.RegisterScalableTargetOutput{}, nil
+}
+
+func (f *fakeAutoScaler) PutScalingPolicy(_ context.Context, params *applicationautoscaling.PutScalingPolicyInput,
+	_ ...func(*applicationautoscaling.Options)) (*applicationautoscaling.PutScalingPolicyOutput, error) {
+
+	f.policies = append(f.policies, params)
+	return &applicationautoscaling.PutScalingPolicyOutput{}, nil
+}
+
+func provisionedTable() Table {
+	return Table{
+		Name:        "spans",
+		HashKeyName: "id",
+		BillingMode: ddbtypes.BillingModeProvisioned,
+		Capacity: Capacity{
+			ReadUnits:    10,
+			WriteUnits:   20,
+			WriteScaling: &AutoScaling{MinUnits: 5, MaxUnits: 100, TargetUtilization: 70},
+		},
+		GSIs: []GSI{{
+			Name:            "by-value",
+			ProjectionField: "value",
+			Capacity: Capacity{
+				ReadScaling: &AutoScaling{MinUnits: 2, MaxUnits: 50, TargetUtilization: 60},
+				WriteUnits:  3,
+			},
+		}},
+	}
+}
+
+func throughputDesc(read, write int64) *ddbtypes.ProvisionedThroughputDescription {
+	return &ddbtypes.ProvisionedThroughputDescription{
+		ReadCapacityUnits:  aws.Int64(read),
+		WriteCapacityUnits: aws.Int64(write),
+	}
+}
+
+func TestCapacityUpdate(t *testing.T) {
+	table := provisionedTable()
+
+	// Switching from the on-demand billing sets the capacity of every GSI
+	desc := &ddbtypes.TableDescription{
+		BillingModeSummary: &ddbtypes.BillingModeSummary{BillingMode: ddbtypes.BillingModePayPerRequest},
+		GlobalSecondaryIndexes: []ddbtypes.GlobalSecondaryIndexDescription{
+			{IndexName: aws.String("by-value")},
+			{IndexName: aws.String("unknown")},
+		},
+	}
+	update := capacityUpdate("spans-test", table, desc)
+	require.NotNil(t, update)
+	assert.Equal(t, ddbtypes.BillingModeProvisioned, update.BillingMode)
+	assert.Equal(t, int64(10), *update.ProvisionedThroughput.ReadCapacityUnits)
+	assert.Equal(t, int64(20), *update.ProvisionedThroughput.WriteCapacityUnits)
+	require.Equal(t, 2, len(update.GlobalSecondaryIndexUpdates))
+	gsi := update.GlobalSecondaryIndexUpdates[0].Update
+	assert.Equal(t, int64(2), *gsi.ProvisionedThroughput.ReadCapacityUnits)
+	assert.Equal(t, int64(3), *gsi.ProvisionedThroughput.WriteCapacityUnits)
+	assert.Equal(t, int64(10), *update.GlobalSecondaryIndexUpdates[1].Update.ProvisionedThroughput.ReadCapacityUnits)
+
+	// The auto-scaled units are left alone
+	desc = &ddbtypes.TableDescription{
+		ProvisionedThroughput: throughputDesc(10, 42),
+		GlobalSecondaryIndexes: []ddbtypes.GlobalSecondaryIndexDescription{
+			{IndexName: aws.String("by-value"), ProvisionedThroughput: throughputDesc(17, 3)},
+			{IndexName: aws.String("unknown"), ProvisionedThroughput: throughputDesc(1, 1)},
+		},
+	}
+	assert.Nil(t, capacityUpdate("spans-test", table, desc))
+
+	desc.GlobalSecondaryIndexes[0].ProvisionedThroughput = throughputDesc(17, 4)
+	update = capacityUpdate("spans-test", table, desc)
+	require.NotNil(t, update)
+	assert.Empty(t, update.BillingMode)
+	assert.Nil(t, update.ProvisionedThroughput)
+	require.Equal(t, 1, len(update.GlobalSecondaryIndexUpdates))
+	gsi = update.GlobalSecondaryIndexUpdates[0].Update
+	assert.Equal(t, int64(17), *gsi.ProvisionedThroughput.ReadCapacityUnits)
+	assert.Equal(t, int64(3), *gsi.ProvisionedThroughput.WriteCapacityUnits)
+
+	// Back to the on-demand billing
+	table.BillingMode = ""
+	update = capacityUpdate("spans-test", table, desc)
+	require.NotNil(t, update)
+	assert.Equal(t, ddbtypes.BillingModePayPerRequest, update.BillingMode)
+	assert.Nil(t, update.ProvisionedThroughput)
+	assert.Empty(t, update.GlobalSecondaryIndexUpdates)
+}
+
+func TestAutoScaling(t *testing.T) {
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	scaler := &fakeAutoScaler{}
+	db := &DynamoDBInitializer{AutoScaler: scaler}
+
+	require.NoError(t, db.ensureAutoScaling(ctx, "spans-test", provisionedTable()))
+	require.Equal(t, 2, len(scaler.targets))
+	assert.Equal(t, "table/spans-test", *scaler.targets[0].ResourceId)
+	assert.Equal(t, astypes.ScalableDimensionDynamoDBTableWriteCapacityUnits, scaler.targets[0].ScalableDimension)
+	assert.Equal(t, int32(5), *scaler.targets[0].MinCapacity)
+	assert.Equal(t, int32(100), *scaler.targets[0].MaxCapacity)
+	assert.Equal(t, "table/spans-test/index/by-value", *scaler.targets[1].ResourceId)
+	assert.Equal(t, astypes.ScalableDimensionDynamoDBIndexReadCapacityUnits, scaler.targets[1].ScalableDimension)
+
+	require.Equal(t, 2, len(scaler.policies))
+	policy := scaler.policies[1].TargetTrackingScalingPolicyConfiguration
+	assert.Equal(t, 60.0, *policy.TargetValue)
+	assert.Equal(t, astypes.MetricTypeDynamoDBReadCapacityUtilization,
+		policy.PredefinedMetricSpecification.PredefinedMetricType)
+
+	// The on-demand tables are not scaled
+	table := provisionedTable()
+	table.BillingMode = ddbtypes.BillingModePayPerRequest
+	scaler.targets = nil
+	require.NoError(t, db.ensureAutoScaling(ctx, "spans-test", table))
+	assert.Empty(t, scaler.targets)
+}
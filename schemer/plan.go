@@ -0,0 +1,432 @@
+package schemer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+var ErrDestructiveChanges = errors.New("the plan has destructive changes")
+var ErrManualChanges = errors.New("the plan has changes that can't be applied automatically")
+
+type ChangeKind string
+
+const (
+	ChangeCreateTable    ChangeKind = "create_table"
+	ChangeKeySchema      ChangeKind = "key_schema"
+	ChangeLsi            ChangeKind = "lsi"
+	ChangeCreateGsi      ChangeKind = "create_gsi"
+	ChangeRecreateGsi    ChangeKind = "recreate_gsi"
+	ChangeReplaceGsi     ChangeKind = "replace_gsi"
+	ChangeDeleteGsi      ChangeKind = "delete_gsi"
+	ChangeUpdateCapacity ChangeKind = "update_capacity"
+	ChangeEnableTtl      ChangeKind = "enable_ttl"
+	ChangeDisableTtl     ChangeKind = "disable_ttl"
+	ChangeTtlAttribute   ChangeKind = "ttl_attribute"
+	ChangeSecurity       ChangeKind = "security"
+	ChangeTableClass     ChangeKind = "table_class"
+)
+
+// Change is a difference between the desired and the actual schema of a table
+type Change struct {
+	Kind  ChangeKind `json:"kind"`
+	Table string     `json:"table"`
+	Index string     `json:"index,omitempty"`
+	// The human-readable details
+	Details string `json:"details,omitempty"`
+	// The change loses data or makes an index unavailable for a while
+	Destructive bool `json:"destructive"`
+	// The change can't be applied automatically, e.g. the table's key schema
+	Manual bool `json:"manual"`
+
+	table *Table
+	gsi   *GSI
+	// The currently enabled TTL attribute
+	ttlField string
+}
+
+func (c *Change) String() string {
+	name := c.Table
+	if c.Index != "" {
+		name += "/" + c.Index
+	}
+	res := string(c.Kind) + " " + name
+	if c.Details != "" {
+		res += ": " + c.Details
+	}
+	if c.Destructive {
+		res += " (destructive)"
+	}
+	if c.Manual {
+		res += " (manual)"
+	}
+	return res
+}
+
+// Plan is the list of the changes that bring the tables to the desired schema
+type Plan struct {
+	Changes []Change `json:"changes"`
+
+	tables []Table
+}
+
+func (p *Plan) HasDestructive() bool {
+	for _, c := range p.Changes {
+		if c.Destructive && !c.Manual {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Plan) String() string {
+	if len(p.Changes) == 0 {
+		return "No changes\n"
+	}
+	var sb strings.Builder
+	for _, c := range p.Changes {
+		sb.WriteString(c.String())
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// Plan compares the desired tables with the existing ones
+func (db *DynamoDBInitializer) Plan(ctx context.Context, tables []Table) (*Plan, error) {
+	svc := dynamodb.NewFromConfig(db.AwsConfig)
+
+	res := &Plan{tables: tables}
+	for i := range tables {
+		t := &tables[i]
+		tableName := db.decorateTableName(t.Name)
+
+		response, err := svc.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(tableName),
+		})
+		var notFound *ddbtypes.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			res.Changes = append(res.Changes, Change{Kind: ChangeCreateTable, Table: tableName, table: t})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe the table %s: %w", tableName, err)
+		}
+
+		ttl, err := svc.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{
+			TableName: aws.String(tableName),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe the TTL of %s: %w", tableName, err)
+		}
+
+		res.Changes = append(res.Changes, diffTable(tableName, t, response.Table, ttl.TimeToLiveDescription)...)
+
+		if !t.hasSecurity() {
+			continue
+		}
+		security, err := db.describeSecurity(ctx, svc, tableName, response.Table)
+		if err != nil {
+			return nil, err
+		}
+		if diff := securityDiff(t, security); len(diff) != 0 {
+			res.Changes = append(res.Changes, Change{Kind: ChangeSecurity, Table: tableName, table: t,
+				Details: strings.Join(diff, ", ")})
+		}
+	}
+	return res, nil
+}
+
+// Diff compares the table with the description of the existing one, its security
+// settings are not compared
+func (t *Table) Diff(tableName string, desc *ddbtypes.TableDescription,
+	ttl *ddbtypes.TimeToLiveDescription) []Change {
+	return diffTable(tableName, t, desc, ttl)
+}
+
+func diffTable(tableName string, t *Table, desc *ddbtypes.TableDescription,
+	ttl *ddbtypes.TimeToLiveDescription) []Change {
+
+	attrTypes := map[string]ddbtypes.ScalarAttributeType{}
+	for _, a := range desc.AttributeDefinitions {
+		attrTypes[aws.ToString(a.AttributeName)] = a.AttributeType
+	}
+
+	var res []Change
+	hash, rng := keyNames(desc.KeySchema)
+	if hash != t.HashKeyName || attrTypes[hash] != ddbtypes.ScalarAttributeTypeS ||
+		rng != t.RangeKeyName || (rng != "" && attrTypes[rng] != t.RangeKeyType) {
+
+		res = append(res, Change{Kind: ChangeKeySchema, Table: tableName, table: t,
+			Details:     fmt.Sprintf("the key is (%s, %s), expected (%s, %s)", hash, rng, t.HashKeyName, t.RangeKeyName),
+			Destructive: true, Manual: true})
+	}
+
+	for _, name := range mismatchedLsis(*t, desc) {
+		res = append(res, Change{Kind: ChangeLsi, Table: tableName, Index: name, table: t,
+			Details:     "the LSIs can only be created with the table",
+			Destructive: true, Manual: true})
+	}
+
+	existing := map[string]ddbtypes.GlobalSecondaryIndexDescription{}
+	for _, i := range desc.GlobalSecondaryIndexes {
+		existing[aws.ToString(i.IndexName)] = i
+	}
+	desired := map[string]bool{}
+	for i := range t.GSIs {
+		gsi := &t.GSIs[i]
+		desired[gsi.IndexName()] = true
+
+		cur, ok := existing[gsi.IndexName()]
+		if ok {
+			if details := diffGsi(gsi, &cur, attrTypes); details != "" {
+				res = append(res, Change{Kind: ChangeRecreateGsi, Table: tableName, Index: gsi.IndexName(),
+					table: t, gsi: gsi, Details: details, Destructive: true})
+			}
+			continue
+		}
+
+		// The new version is created next to the old one, the readers keep using
+		// the old one until the new one is backfilled
+		replaced := ""
+		for _, i := range desc.GlobalSecondaryIndexes {
+			if _, ok := gsi.previousVersion(aws.ToString(i.IndexName)); ok {
+				replaced = aws.ToString(i.IndexName)
+			}
+		}
+		if replaced != "" {
+			res = append(res, Change{Kind: ChangeReplaceGsi, Table: tableName, Index: gsi.IndexName(),
+				table: t, gsi: gsi, Details: "replaces " + replaced})
+		} else {
+			res = append(res, Change{Kind: ChangeCreateGsi, Table: tableName, Index: gsi.IndexName(),
+				table: t, gsi: gsi})
+		}
+	}
+	for _, i := range desc.GlobalSecondaryIndexes {
+		name := aws.ToString(i.IndexName)
+		if desired[name] || replacementPending(t, name, existing) {
+			continue
+		}
+		res = append(res, Change{Kind: ChangeDeleteGsi, Table: tableName, Index: name, table: t,
+			Destructive: true})
+	}
+
+	if capacityUpdate(tableName, *t, desc) != nil {
+		res = append(res, Change{Kind: ChangeUpdateCapacity, Table: tableName, table: t,
+			Details: fmt.Sprintf("billing mode %s", t.billingMode())})
+	}
+
+	if currentTableClass(desc) != t.tableClass() {
+		res = append(res, Change{Kind: ChangeTableClass, Table: tableName, table: t,
+			Details: fmt.Sprintf("%s -> %s", currentTableClass(desc), t.tableClass())})
+	}
+
+	enabled := ttl != nil && (ttl.TimeToLiveStatus == ddbtypes.TimeToLiveStatusEnabled ||
+		ttl.TimeToLiveStatus == ddbtypes.TimeToLiveStatusEnabling)
+	var ttlField string
+	if enabled {
+		ttlField = aws.ToString(ttl.AttributeName)
+	}
+	switch {
+	case ttlField == t.TtlFieldName:
+	case ttlField == "":
+		res = append(res, Change{Kind: ChangeEnableTtl, Table: tableName, table: t, Details: t.TtlFieldName})
+	case t.TtlFieldName == "":
+		res = append(res, Change{Kind: ChangeDisableTtl, Table: tableName, table: t,
+			Details: ttlField, ttlField: ttlField})
+	default:
+		// The TTL can't be re-enabled for an hour after it's disabled
+		res = append(res, Change{Kind: ChangeTtlAttribute, Table: tableName, table: t,
+			Details: fmt.Sprintf("the TTL attribute is %s, expected %s", ttlField, t.TtlFieldName),
+			Manual:  true})
+	}
+
+	return res
+}
+
+// replacementPending checks if the index is an old version of a GSI whose current
+// version is not active yet, the readers still need it
+func replacementPending(t *Table, indexName string,
+	existing map[string]ddbtypes.GlobalSecondaryIndexDescription) bool {
+
+	for i := range t.GSIs {
+		gsi := &t.GSIs[i]
+		if _, ok := gsi.previousVersion(indexName); !ok {
+			continue
+		}
+		cur, ok := existing[gsi.IndexName()]
+		return !ok || cur.IndexStatus != ddbtypes.IndexStatusActive
+	}
+	return false
+}
+
+func keyNames(schema []ddbtypes.KeySchemaElement) (string, string) {
+	var hash, rng string
+	for _, k := range schema {
+		switch k.KeyType {
+		case ddbtypes.KeyTypeHash:
+			hash = aws.ToString(k.AttributeName)
+		case ddbtypes.KeyTypeRange:
+			rng = aws.ToString(k.AttributeName)
+		}
+	}
+	return hash, rng
+}
+
+// diffGsi describes how the existing GSI differs from the desired one, it returns
+// an empty string if it doesn't
+func diffGsi(gsi *GSI, cur *ddbtypes.GlobalSecondaryIndexDescription,
+	attrTypes map[string]ddbtypes.ScalarAttributeType) string {
+
+	var res []string
+	hash, rng := keyNames(cur.KeySchema)
+	if hash != gsi.ProjectionField || attrTypes[hash] != gsi.hashKeyType() {
+		res = append(res, fmt.Sprintf("the hash key is %s %s, expected %s %s",
+			hash, attrTypes[hash], gsi.ProjectionField, gsi.hashKeyType()))
+	}
+	if rng != gsi.RangeKeyField || (rng != "" && attrTypes[rng] != gsi.RangeKeyType) {
+		res = append(res, fmt.Sprintf("the range key is %s %s, expected %s %s",
+			rng, attrTypes[rng], gsi.RangeKeyField, gsi.RangeKeyType))
+	}
+	if !gsi.projectionMatches(cur.Projection) {
+		res = append(res, "the projection differs")
+	}
+	return strings.Join(res, ", ")
+}
+
+// Apply makes the changes of the plan, and then updates the auto-scaling of the
+// planned tables. It refuses to start if the plan has destructive changes, unless
+// they are allowed. The manual changes are skipped, Apply returns ErrManualChanges
+// after making the rest.
+//
+// A replaced GSI is kept until its new version is active, the plans made after
+// that delete it. The GSIs are created one at a time, each one is waited for up to
+// GsiWaitTimeout, which has to be raised for the tables that take longer to
+// backfill.
+func (db *DynamoDBInitializer) Apply(ctx context.Context, plan *Plan, allowDestructive bool) error {
+	if plan.HasDestructive() && !allowDestructive {
+		return ErrDestructiveChanges
+	}
+
+	svc := dynamodb.NewFromConfig(db.AwsConfig)
+
+	hasManual := false
+	for _, c := range plan.Changes {
+		if c.Manual {
+			L(ctx).Warn("Skipping the manual change", zap.String("change", c.String()))
+			hasManual = true
+			continue
+		}
+
+		L(ctx).Info("Applying the change", zap.String("change", c.String()))
+		err := db.applyChange(ctx, svc, &c)
+		if err != nil {
+			return fmt.Errorf("failed to apply %s: %w", c.String(), err)
+		}
+	}
+
+	for i := range plan.tables {
+		err := db.ensureAutoScaling(ctx, db.decorateTableName(plan.tables[i].Name), plan.tables[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	if hasManual {
+		return ErrManualChanges
+	}
+	return nil
+}
+
+func (db *DynamoDBInitializer) applyChange(ctx context.Context, svc *dynamodb.Client, c *Change) error {
+	switch c.Kind {
+	case ChangeCreateTable:
+		return db.createTable(ctx, svc, *c.table)
+	case ChangeCreateGsi, ChangeReplaceGsi:
+		// Waits for the backfill to finish
+		return db.ensureGsi(ctx, svc, c.Table, []GSI{*c.gsi})
+	case ChangeRecreateGsi:
+		err := db.deleteGsi(ctx, svc, c.Table, c.Index)
+		if err != nil {
+			return err
+		}
+		return db.ensureGsi(ctx, svc, c.Table, []GSI{*c.gsi})
+	case ChangeDeleteGsi:
+		return db.deleteGsi(ctx, svc, c.Table, c.Index)
+	case ChangeUpdateCapacity:
+		return db.ensureCapacity(ctx, svc, c.Table, *c.table)
+	case ChangeTableClass:
+		return db.ensureTableClass(ctx, svc, c.Table, *c.table)
+	case ChangeSecurity:
+		return db.ensureSecurity(ctx, svc, c.Table, *c.table)
+	case ChangeEnableTtl:
+		return db.ensureTtlIsSet(ctx, svc, c.Table, c.table.TtlFieldName)
+	case ChangeDisableTtl:
+		_, err := svc.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+			TableName: aws.String(c.Table),
+			TimeToLiveSpecification: &ddbtypes.TimeToLiveSpecification{
+				AttributeName: aws.String(c.ttlField),
+				Enabled:       aws.Bool(false),
+			},
+		})
+		return err
+	}
+	return fmt.Errorf("unknown change kind: %s", c.Kind)
+}
+
+// deleteGsi deletes the GSI and waits for it to disappear
+func (db *DynamoDBInitializer) deleteGsi(ctx context.Context, client *dynamodb.Client,
+	tableName, indexName string) error {
+
+	ctx = WithFields(ctx, zap.String("table-name", tableName), zap.String("gsi-name", indexName))
+
+	// Only one GSI can be changed at a time
+	err := db.waitForGsi(ctx, tableName, client)
+	if err != nil {
+		return err
+	}
+
+	L(ctx).Info("Deleting the GSI")
+	_, err = client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+		TableName: aws.String(tableName),
+		GlobalSecondaryIndexUpdates: []ddbtypes.GlobalSecondaryIndexUpdate{{
+			Delete: &ddbtypes.DeleteGlobalSecondaryIndexAction{IndexName: aws.String(indexName)},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	indexIsGone := func(ctx context.Context, input *dynamodb.DescribeTableInput,
+		output *dynamodb.DescribeTableOutput, err error) (bool, error) {
+
+		if err != nil {
+			return false, err
+		}
+		for _, i := range output.Table.GlobalSecondaryIndexes {
+			if aws.ToString(i.IndexName) == indexName {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client, func(options *dynamodb.TableExistsWaiterOptions) {
+		options.MinDelay = 100 * time.Millisecond
+		options.Retryable = indexIsGone
+	})
+	params := &dynamodb.DescribeTableInput{TableName: aws.String(tableName)}
+	err = waiter.Wait(ctx, params, 15*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	L(ctx).Info("The GSI is deleted")
+	return nil
+}
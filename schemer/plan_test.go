@@ -0,0 +1,195 @@
+package schemer
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func attrDef(name string, tp ddbtypes.ScalarAttributeType) ddbtypes.AttributeDefinition {
+	return ddbtypes.AttributeDefinition{AttributeName: aws.String(name), AttributeType: tp}
+}
+
+func keySchema(hash, rng string) []ddbtypes.KeySchemaElement {
+	res := []ddbtypes.KeySchemaElement{{AttributeName: aws.String(hash), KeyType: ddbtypes.KeyTypeHash}}
+	if rng != "" {
+		res = append(res, ddbtypes.KeySchemaElement{AttributeName: aws.String(rng), KeyType: ddbtypes.KeyTypeRange})
+	}
+	return res
+}
+
+func TestDiffTable(t *testing.T) {
+	table := &Table{
+		Name:         "tokens",
+		HashKeyName:  "id",
+		RangeKeyName: "range",
+		RangeKeyType: ddbtypes.ScalarAttributeTypeS,
+		TtlFieldName: "ttl",
+		GSIs: []GSI{{
+			Name:            "by-value",
+			ProjectionField: "value",
+		}, {
+			Name:            "by-size",
+			ProjectionField: "size",
+			HashKeyType:     ddbtypes.ScalarAttributeTypeN,
+		}, {
+			Name:            "by-time",
+			ProjectionField: "value",
+			RangeKeyField:   "time",
+			RangeKeyType:    ddbtypes.ScalarAttributeTypeN,
+		}},
+	}
+	desc := &ddbtypes.TableDescription{
+		KeySchema: keySchema("id", "range"),
+		AttributeDefinitions: []ddbtypes.AttributeDefinition{
+			attrDef("id", ddbtypes.ScalarAttributeTypeS),
+			attrDef("range", ddbtypes.ScalarAttributeTypeS),
+			attrDef("value", ddbtypes.ScalarAttributeTypeS),
+			attrDef("time", ddbtypes.ScalarAttributeTypeN),
+		},
+		BillingModeSummary: &ddbtypes.BillingModeSummary{BillingMode: ddbtypes.BillingModePayPerRequest},
+		GlobalSecondaryIndexes: []ddbtypes.GlobalSecondaryIndexDescription{{
+			IndexName:  aws.String("by-value"),
+			KeySchema:  keySchema("value", ""),
+			Projection: &ddbtypes.Projection{ProjectionType: ddbtypes.ProjectionTypeAll},
+		}, {
+			IndexName:  aws.String("by-time"),
+			KeySchema:  keySchema("value", "time"),
+			Projection: &ddbtypes.Projection{ProjectionType: ddbtypes.ProjectionTypeKeysOnly},
+		}, {
+			IndexName:  aws.String("stale"),
+			KeySchema:  keySchema("value", ""),
+			Projection: &ddbtypes.Projection{ProjectionType: ddbtypes.ProjectionTypeAll},
+		}},
+	}
+	ttl := &ddbtypes.TimeToLiveDescription{
+		AttributeName:    aws.String("ttl"),
+		TimeToLiveStatus: ddbtypes.TimeToLiveStatusEnabled,
+	}
+
+	changes := diffTable("tokens-test", table, desc, ttl)
+	require.Equal(t, 3, len(changes))
+	assert.Equal(t, "create_gsi tokens-test/by-size", changes[0].String())
+	assert.Equal(t, "recreate_gsi tokens-test/by-time: the projection differs (destructive)", changes[1].String())
+	assert.Equal(t, "delete_gsi tokens-test/stale (destructive)", changes[2].String())
+
+	// The key schema and the TTL attribute can't be changed automatically
+	table.RangeKeyType = ddbtypes.ScalarAttributeTypeN
+	table.TtlFieldName = "expires"
+	table.GSIs = nil
+	desc.GlobalSecondaryIndexes = nil
+	changes = diffTable("tokens-test", table, desc, ttl)
+	require.Equal(t, 2, len(changes))
+	assert.Equal(t, ChangeKeySchema, changes[0].Kind)
+	assert.True(t, changes[0].Manual)
+	assert.Equal(t, ChangeTtlAttribute, changes[1].Kind)
+	assert.True(t, changes[1].Manual)
+
+	plan := &Plan{Changes: changes}
+	assert.False(t, plan.HasDestructive())
+
+	table.RangeKeyType = ddbtypes.ScalarAttributeTypeS
+	table.BillingMode = ddbtypes.BillingModeProvisioned
+	ttl.TimeToLiveStatus = ddbtypes.TimeToLiveStatusDisabled
+	changes = diffTable("tokens-test", table, desc, ttl)
+	require.Equal(t, 2, len(changes))
+	assert.Equal(t, "update_capacity tokens-test: billing mode PROVISIONED", changes[0].String())
+	assert.Equal(t, "enable_ttl tokens-test: expires", changes[1].String())
+
+	assert.Empty(t, diffTable("tokens-test", table, &ddbtypes.TableDescription{
+		KeySchema:             desc.KeySchema,
+		AttributeDefinitions:  desc.AttributeDefinitions,
+		ProvisionedThroughput: throughputDesc(1, 1),
+	}, &ddbtypes.TimeToLiveDescription{
+		AttributeName:    aws.String("expires"),
+		TimeToLiveStatus: ddbtypes.TimeToLiveStatusEnabling,
+	}))
+
+	// The tables without the class summary are standard
+	table.TableClass = ddbtypes.TableClassStandardInfrequentAccess
+	ttl.AttributeName = aws.String("expires")
+	ttl.TimeToLiveStatus = ddbtypes.TimeToLiveStatusEnabled
+	desc.BillingModeSummary = nil
+	desc.ProvisionedThroughput = throughputDesc(1, 1)
+	changes = diffTable("tokens-test", table, desc, ttl)
+	require.Equal(t, 1, len(changes))
+	assert.Equal(t, "table_class tokens-test: STANDARD -> STANDARD_INFREQUENT_ACCESS", changes[0].String())
+	assert.False(t, changes[0].Destructive)
+
+	desc.TableClassSummary = &ddbtypes.TableClassSummary{TableClass: ddbtypes.TableClassStandardInfrequentAccess}
+	assert.Empty(t, diffTable("tokens-test", table, desc, ttl))
+}
+
+func TestApplyRefusesDestructive(t *testing.T) {
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	plan := &Plan{Changes: []Change{{Kind: ChangeDeleteGsi, Table: "tokens-test", Index: "stale", Destructive: true}}}
+	assert.True(t, plan.HasDestructive())
+
+	db := &DynamoDBInitializer{}
+	assert.ErrorIs(t, db.Apply(ctx, plan, false), ErrDestructiveChanges)
+
+	out, err := json.Marshal(plan)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"changes": [{"kind": "delete_gsi", "table": "tokens-test", "index": "stale",
+		"destructive": true, "manual": false}]}`, string(out))
+	assert.Equal(t, "No changes\n", (&Plan{}).String())
+}
+
+func TestReplaceGsi(t *testing.T) {
+	table := &Table{
+		Name:        "tokens",
+		HashKeyName: "id",
+		GSIs: []GSI{{
+			Name:            "by-value",
+			Version:         2,
+			ProjectionField: "value",
+			ProjectionType:  ddbtypes.ProjectionTypeKeysOnly,
+		}},
+	}
+	assert.Equal(t, "by-value-v2", table.GSIs[0].IndexName())
+	assert.Equal(t, "by-value", table.GSIs[0].VersionName(0))
+
+	oldGsi := ddbtypes.GlobalSecondaryIndexDescription{
+		IndexName:   aws.String("by-value-v1"),
+		KeySchema:   keySchema("value", ""),
+		Projection:  &ddbtypes.Projection{ProjectionType: ddbtypes.ProjectionTypeAll},
+		IndexStatus: ddbtypes.IndexStatusActive,
+	}
+	desc := &ddbtypes.TableDescription{
+		KeySchema: keySchema("id", ""),
+		AttributeDefinitions: []ddbtypes.AttributeDefinition{
+			attrDef("id", ddbtypes.ScalarAttributeTypeS),
+			attrDef("value", ddbtypes.ScalarAttributeTypeS),
+		},
+		BillingModeSummary:     &ddbtypes.BillingModeSummary{BillingMode: ddbtypes.BillingModePayPerRequest},
+		GlobalSecondaryIndexes: []ddbtypes.GlobalSecondaryIndexDescription{oldGsi},
+	}
+
+	// The new version is created next to the old one
+	changes := diffTable("tokens-test", table, desc, nil)
+	require.Equal(t, 1, len(changes))
+	assert.Equal(t, "replace_gsi tokens-test/by-value-v2: replaces by-value-v1", changes[0].String())
+	assert.False(t, changes[0].Destructive)
+
+	// The old version is kept while the new one is backfilled
+	newGsi := ddbtypes.GlobalSecondaryIndexDescription{
+		IndexName:   aws.String("by-value-v2"),
+		KeySchema:   keySchema("value", ""),
+		Projection:  &ddbtypes.Projection{ProjectionType: ddbtypes.ProjectionTypeKeysOnly},
+		IndexStatus: ddbtypes.IndexStatusCreating,
+	}
+	desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, newGsi)
+	assert.Empty(t, diffTable("tokens-test", table, desc, nil))
+
+	// And deleted once it's active
+	desc.GlobalSecondaryIndexes[1].IndexStatus = ddbtypes.IndexStatusActive
+	changes = diffTable("tokens-test", table, desc, nil)
+	require.Equal(t, 1, len(changes))
+	assert.Equal(t, "delete_gsi tokens-test/by-value-v1 (destructive)", changes[0].String())
+}
@@ -2,8 +2,10 @@ package schemer
 
 import (
 	"context"
+	"fmt"
 	. "github.com/Cyberax/argus-vision/visibility/logging"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/applicationautoscaling"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"go.uber.org/zap"
@@ -15,22 +17,138 @@ type DynamoDBInitializer struct {
 	Prefix    string
 	Suffix    string
 	AwsConfig aws.Config
+	// Manages the auto-scaled capacity of the provisioned tables
+	AutoScaler AutoScaler
+	// How long to wait for the created GSIs to be backfilled, 15 minutes if zero
+	GsiWaitTimeout time.Duration
 }
 
 func NewDynamoDbInitializer(prefix, suffix string, config aws.Config) *DynamoDBInitializer {
 	return &DynamoDBInitializer{
-		Prefix:    prefix,
-		Suffix:    suffix,
-		AwsConfig: config,
+		Prefix:     prefix,
+		Suffix:     suffix,
+		AwsConfig:  config,
+		AutoScaler: applicationautoscaling.NewFromConfig(config),
 	}
 }
 
 type GSI struct {
-	Name            string
+	Name string
+	// Bumped to replace the GSI with a changed definition, the new version is
+	// created under a new name next to the old one. The version 0 is named Name.
+	Version int
+	// The hash key of the GSI
 	ProjectionField string
+	// The hash key type, a string if it's not set
+	HashKeyType ddbtypes.ScalarAttributeType
 
 	RangeKeyField string
 	RangeKeyType  ddbtypes.ScalarAttributeType
+
+	// All the attributes are projected if it's not set
+	ProjectionType ddbtypes.ProjectionType
+	// The projected attributes besides the keys, with ProjectionTypeInclude
+	NonKeyAttributes []string
+
+	// The GSI's own capacity, used if the table's billing mode is provisioned
+	Capacity Capacity
+}
+
+// IndexName is the name of the GSI's configured version
+func (g *GSI) IndexName() string {
+	return g.VersionName(g.Version)
+}
+
+// VersionName is the name of the given version of the GSI
+func (g *GSI) VersionName(version int) string {
+	if version == 0 {
+		return g.Name
+	}
+	return fmt.Sprintf("%s-v%d", g.Name, version)
+}
+
+// previousVersion returns the version of the GSI the index is, if it's an older one
+func (g *GSI) previousVersion(indexName string) (int, bool) {
+	for v := g.Version - 1; v >= 0; v-- {
+		if g.VersionName(v) == indexName {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+func (g *GSI) hashKeyType() ddbtypes.ScalarAttributeType {
+	if g.HashKeyType == "" {
+		return ddbtypes.ScalarAttributeTypeS
+	}
+	return g.HashKeyType
+}
+
+func (g *GSI) projection() *ddbtypes.Projection {
+	return makeProjection(g.ProjectionType, g.NonKeyAttributes)
+}
+
+// projectionMatches checks if the existing GSI has the configured projection, it
+// can't be changed in place
+func (g *GSI) projectionMatches(existing *ddbtypes.Projection) bool {
+	return projectionMatches(g.projection(), existing)
+}
+
+// LSI is the local secondary index, it shares the table's hash key. The LSIs can
+// only be created with the table, and they limit the size of the items with the
+// same hash key to 10GB.
+type LSI struct {
+	Name string
+
+	RangeKeyField string
+	// The range key type, a string if it's not set
+	RangeKeyType ddbtypes.ScalarAttributeType
+
+	// All the attributes are projected if it's not set
+	ProjectionType ddbtypes.ProjectionType
+	// The projected attributes besides the keys, with ProjectionTypeInclude
+	NonKeyAttributes []string
+}
+
+func (l *LSI) rangeKeyType() ddbtypes.ScalarAttributeType {
+	if l.RangeKeyType == "" {
+		return ddbtypes.ScalarAttributeTypeS
+	}
+	return l.RangeKeyType
+}
+
+func (l *LSI) projection() *ddbtypes.Projection {
+	return makeProjection(l.ProjectionType, l.NonKeyAttributes)
+}
+
+func makeProjection(projectionType ddbtypes.ProjectionType, nonKeyAttributes []string) *ddbtypes.Projection {
+	if projectionType == "" {
+		return &ddbtypes.Projection{ProjectionType: ddbtypes.ProjectionTypeAll}
+	}
+	res := &ddbtypes.Projection{ProjectionType: projectionType}
+	if projectionType == ddbtypes.ProjectionTypeInclude {
+		res.NonKeyAttributes = nonKeyAttributes
+	}
+	return res
+}
+
+func projectionMatches(desired, existing *ddbtypes.Projection) bool {
+	if existing == nil || existing.ProjectionType != desired.ProjectionType {
+		return false
+	}
+	have := map[string]bool{}
+	for _, a := range existing.NonKeyAttributes {
+		have[a] = true
+	}
+	if len(have) != len(desired.NonKeyAttributes) {
+		return false
+	}
+	for _, a := range desired.NonKeyAttributes {
+		if !have[a] {
+			return false
+		}
+	}
+	return true
 }
 
 type Table struct {
@@ -42,7 +160,23 @@ type Table struct {
 
 	TtlFieldName string
 
+	// The on-demand billing is used if it's not set
+	BillingMode ddbtypes.BillingMode
+	Capacity    Capacity
+	// The standard class is used if it's not set. The infrequent access class has
+	// the cheaper storage and the more expensive reads and writes.
+	TableClass ddbtypes.TableClass
+
+	// The ID or ARN of the customer-managed KMS key to encrypt the table with, the
+	// AWS owned key is used if it's not set. An alias never matches the key's ARN
+	// that DynamoDB reports, so the table would always be planned for re-encryption.
+	KmsKeyId            string
+	PointInTimeRecovery bool
+	DeletionProtection  bool
+	Tags                map[string]string
+
 	GSIs []GSI
+	LSIs []LSI
 }
 
 func (db *DynamoDBInitializer) decorateTableName(name string) string {
@@ -53,98 +187,193 @@ func (db *DynamoDBInitializer) trimTableName(name string) string {
 	return strings.TrimPrefix(strings.TrimSuffix(name, db.Suffix), db.Prefix)
 }
 
+// InitSchema creates the missing tables. The existing ones are left as they are,
+// changing them can take hours (e.g. backfilling a GSI), so their differences are
+// only reported and left to Apply.
 func (db *DynamoDBInitializer) InitSchema(ctx context.Context, tablesToCreate []Table) error {
 	L(ctx).Info("Describing tables")
 
-	svc := dynamodb.NewFromConfig(db.AwsConfig)
+	plan, err := db.Plan(ctx, tablesToCreate)
+	if err != nil {
+		return err
+	}
 
-	var tables = make(map[string]int64)
-	lti := dynamodb.ListTablesInput{}
-	for {
-		output, err := svc.ListTables(ctx, &lti)
+	svc := dynamodb.NewFromConfig(db.AwsConfig)
+	for _, c := range plan.Changes {
+		if c.Kind != ChangeCreateTable {
+			L(ctx).Warn("Table differs from the schema, apply the schema changes to fix it",
+				zap.String("change", c.String()))
+			continue
+		}
+		err = db.createTable(ctx, svc, *c.table)
 		if err != nil {
 			return err
 		}
+	}
 
-		for _, t := range output.TableNames {
-			tables[db.trimTableName(t)] = 1
-		}
+	L(ctx).Info("All tables are ready")
+	return nil
+}
+
+// createTable creates the table with its LSIs and GSIs, and sets up its TTL and
+// auto-scaling
+func (db *DynamoDBInitializer) createTable(ctx context.Context, svc *dynamodb.Client, t Table) error {
+	newTableName := db.decorateTableName(t.Name)
+
+	L(ctx).Info("Creating table", zap.String("table-name", newTableName))
+
+	attrDefs := []ddbtypes.AttributeDefinition{{
+		AttributeName: aws.String(t.HashKeyName), AttributeType: "S"},
+	}
+	keySchema := []ddbtypes.KeySchemaElement{{
+		AttributeName: aws.String(t.HashKeyName), KeyType: "HASH",
+	}}
+
+	if t.RangeKeyName != "" {
+		attrDefs = append(attrDefs, ddbtypes.AttributeDefinition{
+			AttributeName: aws.String(t.RangeKeyName), AttributeType: t.RangeKeyType})
+		keySchema = append(keySchema, ddbtypes.KeySchemaElement{
+			AttributeName: aws.String(t.RangeKeyName), KeyType: "RANGE",
+		})
+	}
 
-		if output.LastEvaluatedTableName == nil {
-			break
+	defined := map[string]bool{t.HashKeyName: true, t.RangeKeyName: true}
+	var lsis []ddbtypes.LocalSecondaryIndex
+	for _, lsi := range t.LSIs {
+		if !defined[lsi.RangeKeyField] {
+			defined[lsi.RangeKeyField] = true
+			attrDefs = append(attrDefs, ddbtypes.AttributeDefinition{
+				AttributeName: aws.String(lsi.RangeKeyField), AttributeType: lsi.rangeKeyType()})
 		}
-		lti.ExclusiveStartTableName = output.LastEvaluatedTableName
+		lsis = append(lsis, ddbtypes.LocalSecondaryIndex{
+			IndexName: aws.String(lsi.Name),
+			KeySchema: []ddbtypes.KeySchemaElement{{
+				AttributeName: aws.String(t.HashKeyName), KeyType: ddbtypes.KeyTypeHash,
+			}, {
+				AttributeName: aws.String(lsi.RangeKeyField), KeyType: ddbtypes.KeyTypeRange,
+			}},
+			Projection: lsi.projection(),
+		})
 	}
 
-	// Now create the missing tables
-	for _, t := range tablesToCreate {
-		if _, ok := tables[t.Name]; ok {
-			L(ctx).Info("Table exists", zap.String("table-name", t.Name))
+	input := &dynamodb.CreateTableInput{
+		TableName:             aws.String(newTableName),
+		AttributeDefinitions:  attrDefs,
+		KeySchema:             keySchema,
+		LocalSecondaryIndexes: lsis,
+		BillingMode:           t.billingMode(),
+		TableClass:            t.tableClass(),
+		SSESpecification:      t.sseSpecification(),
+		Tags:                  t.tags(),
+	}
+	if t.DeletionProtection {
+		input.DeletionProtectionEnabled = aws.Bool(true)
+	}
+	if t.provisioned() {
+		input.ProvisionedThroughput = t.Capacity.throughput()
+	}
+	_, err := svc.CreateTable(ctx, input)
 
-			err := db.ensureGsi(ctx, svc, db.decorateTableName(t.Name), t.GSIs)
-			if err != nil {
-				return err
-			}
-			err = db.ensureTtlIsSet(ctx, svc, db.decorateTableName(t.Name), t.TtlFieldName)
-			if err != nil {
-				return err
-			}
+	if err != nil {
+		return err
+	}
 
-			continue
-		}
+	waiter := dynamodb.NewTableExistsWaiter(svc)
+	params := &dynamodb.DescribeTableInput{TableName: aws.String(newTableName)}
+	err = waiter.Wait(ctx, params, 5*time.Minute)
+	if err != nil {
+		return err
+	}
 
-		newTableName := db.decorateTableName(t.Name)
+	err = db.ensureGsi(ctx, svc, newTableName, t.GSIs)
+	if err != nil {
+		return err
+	}
 
-		L(ctx).Info("Creating table", zap.String("table-name", newTableName))
+	err = db.ensureTtlIsSet(ctx, svc, newTableName, t.TtlFieldName)
+	if err != nil {
+		return err
+	}
 
-		attrDefs := []ddbtypes.AttributeDefinition{{
-			AttributeName: aws.String(t.HashKeyName), AttributeType: "S"},
-		}
-		keySchema := []ddbtypes.KeySchemaElement{{
-			AttributeName: aws.String(t.HashKeyName), KeyType: "HASH",
-		}}
+	// The point-in-time recovery can't be enabled on create
+	err = db.ensureSecurity(ctx, svc, newTableName, t)
+	if err != nil {
+		return err
+	}
 
-		if t.RangeKeyName != "" {
-			attrDefs = append(attrDefs, ddbtypes.AttributeDefinition{
-				AttributeName: aws.String(t.RangeKeyName), AttributeType: t.RangeKeyType})
-			keySchema = append(keySchema, ddbtypes.KeySchemaElement{
-				AttributeName: aws.String(t.RangeKeyName), KeyType: "RANGE",
-			})
-		}
+	return db.ensureAutoScaling(ctx, newTableName, t)
+}
 
-		_, err := svc.CreateTable(ctx, &dynamodb.CreateTableInput{
-			TableName:            aws.String(newTableName),
-			AttributeDefinitions: attrDefs,
-			KeySchema:            keySchema,
-			BillingMode:          ddbtypes.BillingModePayPerRequest,
-		})
+func (t *Table) tableClass() ddbtypes.TableClass {
+	if t.TableClass == "" {
+		return ddbtypes.TableClassStandard
+	}
+	return t.TableClass
+}
 
-		if err != nil {
-			return err
-		}
+func currentTableClass(desc *ddbtypes.TableDescription) ddbtypes.TableClass {
+	if desc.TableClassSummary == nil || desc.TableClassSummary.TableClass == "" {
+		return ddbtypes.TableClassStandard
+	}
+	return desc.TableClassSummary.TableClass
+}
 
-		waiter := dynamodb.NewTableExistsWaiter(svc)
-		params := &dynamodb.DescribeTableInput{TableName: aws.String(newTableName)}
-		err = waiter.Wait(ctx, params, 5*time.Minute)
-		if err != nil {
-			return err
-		}
+// ensureTableClass switches the table's class, DynamoDB allows it twice in 30 days
+func (db *DynamoDBInitializer) ensureTableClass(ctx context.Context, client *dynamodb.Client,
+	tableName string, t Table) error {
 
-		err = db.ensureGsi(ctx, svc, newTableName, t.GSIs)
-		if err != nil {
-			return err
-		}
+	ctx = WithFields(ctx, zap.String("table-name", tableName))
 
-		err = db.ensureTtlIsSet(ctx, svc, newTableName, t.TtlFieldName)
-		if err != nil {
-			return err
-		}
+	response, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return err
+	}
+	if currentTableClass(response.Table) == t.tableClass() {
+		L(ctx).Info("Table class is up-to-date")
+		return nil
 	}
 
-	L(ctx).Info("All tables are ready")
+	L(ctx).Info("Switching the table class", zap.String("table-class", string(t.tableClass())))
+	err = db.updateTable(ctx, client, &dynamodb.UpdateTableInput{
+		TableName:  aws.String(tableName),
+		TableClass: t.tableClass(),
+	})
+	if err != nil {
+		return err
+	}
+	L(ctx).Info("Finished switching the table class")
 	return nil
 }
 
+// mismatchedLsis lists the configured LSIs that the table doesn't have as configured
+func mismatchedLsis(t Table, desc *ddbtypes.TableDescription) []string {
+	existing := map[string]ddbtypes.LocalSecondaryIndexDescription{}
+	for _, i := range desc.LocalSecondaryIndexes {
+		existing[aws.ToString(i.IndexName)] = i
+	}
+
+	var res []string
+	for _, lsi := range t.LSIs {
+		cur, ok := existing[lsi.Name]
+		if !ok || !projectionMatches(lsi.projection(), cur.Projection) {
+			res = append(res, lsi.Name)
+			continue
+		}
+		var rangeKey string
+		for _, k := range cur.KeySchema {
+			if k.KeyType == ddbtypes.KeyTypeRange {
+				rangeKey = aws.ToString(k.AttributeName)
+			}
+		}
+		if rangeKey != lsi.RangeKeyField {
+			res = append(res, lsi.Name)
+		}
+	}
+	return res
+}
+
 func (db *DynamoDBInitializer) ensureTtlIsSet(ctx context.Context,
 	client *dynamodb.Client, tableName string, ttlField string) error {
 
@@ -201,10 +430,10 @@ func (db *DynamoDBInitializer) ensureGsi(ctx context.Context, client *dynamodb.C
 		return err
 	}
 
-	existing := map[string]bool{}
+	existing := map[string]*ddbtypes.GlobalSecondaryIndexDescription{}
 	hasPending := false
-	for _, i := range response.Table.GlobalSecondaryIndexes {
-		existing[*i.IndexName] = true
+	for idx, i := range response.Table.GlobalSecondaryIndexes {
+		existing[*i.IndexName] = &response.Table.GlobalSecondaryIndexes[idx]
 		if i.IndexStatus != ddbtypes.IndexStatusActive {
 			hasPending = true
 		}
@@ -218,8 +447,12 @@ func (db *DynamoDBInitializer) ensureGsi(ctx context.Context, client *dynamodb.C
 	}
 
 	for _, gsi := range gsis {
-		if existing[gsi.Name] {
-			L(ctx).Info("GSI exists", zap.String("gsi-name", gsi.Name))
+		if cur, ok := existing[gsi.IndexName()]; ok {
+			if !gsi.projectionMatches(cur.Projection) {
+				L(ctx).Warn("GSI projection differs from the configured one, it can't be changed in place",
+					zap.String("gsi-name", gsi.IndexName()))
+			}
+			L(ctx).Info("GSI exists", zap.String("gsi-name", gsi.IndexName()))
 			continue
 		}
 
@@ -229,7 +462,7 @@ func (db *DynamoDBInitializer) ensureGsi(ctx context.Context, client *dynamodb.C
 			KeyType:       ddbtypes.KeyTypeHash,
 		}}
 		attrDefs = append(attrDefs, ddbtypes.AttributeDefinition{
-			AttributeName: aws.String(gsi.ProjectionField), AttributeType: "S"})
+			AttributeName: aws.String(gsi.ProjectionField), AttributeType: gsi.hashKeyType()})
 
 		if gsi.RangeKeyField != "" {
 			keySchemaElems = append(keySchemaElems, ddbtypes.KeySchemaElement{
@@ -240,19 +473,22 @@ func (db *DynamoDBInitializer) ensureGsi(ctx context.Context, client *dynamodb.C
 				AttributeName: aws.String(gsi.RangeKeyField), AttributeType: gsi.RangeKeyType})
 		}
 
-		L(ctx).Info("Creating the GSI", zap.String("gsi-name", gsi.Name))
+		L(ctx).Info("Creating the GSI", zap.String("gsi-name", gsi.IndexName()))
 
+		create := &ddbtypes.CreateGlobalSecondaryIndexAction{
+			IndexName:  aws.String(gsi.IndexName()),
+			KeySchema:  keySchemaElems,
+			Projection: gsi.projection(),
+		}
+		// The billing mode is switched after the GSIs are created
+		if currentBillingMode(response.Table) == ddbtypes.BillingModeProvisioned {
+			create.ProvisionedThroughput = gsi.Capacity.throughput()
+		}
 		_, err := client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
 			TableName: aws.String(tableName),
 			GlobalSecondaryIndexUpdates: []ddbtypes.GlobalSecondaryIndexUpdate{{
-				Create: &ddbtypes.CreateGlobalSecondaryIndexAction{
-					IndexName: aws.String(gsi.Name),
-					KeySchema: keySchemaElems,
-					Projection: &ddbtypes.Projection{
-						ProjectionType: ddbtypes.ProjectionTypeAll,
-					},
-				}},
-			},
+				Create: create,
+			}},
 			AttributeDefinitions: attrDefs,
 		})
 		if err != nil {
@@ -299,8 +535,12 @@ func (db *DynamoDBInitializer) waitForGsi(ctx context.Context, tableName string,
 		options.Retryable = indexesAreReady
 	})
 
+	timeout := db.GsiWaitTimeout
+	if timeout == 0 {
+		timeout = 15 * time.Minute
+	}
 	params := &dynamodb.DescribeTableInput{TableName: aws.String(tableName)}
-	err := waiter.Wait(ctx, params, 15*time.Minute)
+	err := waiter.Wait(ctx, params, timeout)
 	if err != nil {
 		return err
 	}
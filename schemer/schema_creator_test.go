@@ -32,12 +32,32 @@ func TestDbInitializer(t *testing.T) {
 				ProjectionField: "value",
 				RangeKeyField:   "range",
 				RangeKeyType:    ddbtypes.ScalarAttributeTypeS,
+			}, {
+				Name:             "size-index",
+				ProjectionField:  "size",
+				HashKeyType:      ddbtypes.ScalarAttributeTypeN,
+				ProjectionType:   ddbtypes.ProjectionTypeInclude,
+				NonKeyAttributes: []string{"value"},
 			}},
 		},
 		{
 			Name:        "blobs",
 			HashKeyName: "blobId",
 		},
+		{
+			Name:         "parts",
+			HashKeyName:  "blobId",
+			RangeKeyName: "part",
+			RangeKeyType: ddbtypes.ScalarAttributeTypeN,
+			LSIs: []LSI{{
+				Name:          "by-size",
+				RangeKeyField: "size",
+				RangeKeyType:  ddbtypes.ScalarAttributeTypeN,
+			}, {
+				Name:          "by-name",
+				RangeKeyField: "name",
+			}},
+		},
 	}
 	err := schemer.InitSchema(ctx, tables)
 	assert.NoError(t, err)
@@ -46,6 +66,11 @@ func TestDbInitializer(t *testing.T) {
 	err = schemer.InitSchema(ctx, tables)
 	require.NoError(t, err)
 
+	// Nothing has drifted
+	plan, err := schemer.Plan(ctx, tables)
+	require.NoError(t, err)
+	assert.Empty(t, plan.Changes)
+
 	// Check a simple DDB request
 	values := make(map[string]ddbtypes.AttributeValue)
 	values["id"] = &ddbtypes.AttributeValueMemberS{Value: "hello"}
@@ -80,3 +105,72 @@ func TestDbInitializer(t *testing.T) {
 	assert.Equal(t, "hello", idxResp.Items[0]["id"].(*ddbtypes.AttributeValueMemberS).Value)
 	assert.Equal(t, "r1", idxResp.Items[0]["range"].(*ddbtypes.AttributeValueMemberS).Value)
 }
+
+func TestGsiProjection(t *testing.T) {
+	gsi := GSI{Name: "by-value", ProjectionField: "value"}
+	assert.Equal(t, ddbtypes.ScalarAttributeTypeS, gsi.hashKeyType())
+	assert.Equal(t, ddbtypes.ProjectionTypeAll, gsi.projection().ProjectionType)
+	assert.True(t, gsi.projectionMatches(&ddbtypes.Projection{ProjectionType: ddbtypes.ProjectionTypeAll}))
+
+	gsi.ProjectionType = ddbtypes.ProjectionTypeInclude
+	gsi.NonKeyAttributes = []string{"a", "b"}
+	assert.Equal(t, []string{"a", "b"}, gsi.projection().NonKeyAttributes)
+	assert.True(t, gsi.projectionMatches(&ddbtypes.Projection{
+		ProjectionType: ddbtypes.ProjectionTypeInclude, NonKeyAttributes: []string{"b", "a"}}))
+	assert.False(t, gsi.projectionMatches(&ddbtypes.Projection{
+		ProjectionType: ddbtypes.ProjectionTypeInclude, NonKeyAttributes: []string{"a"}}))
+	assert.False(t, gsi.projectionMatches(&ddbtypes.Projection{ProjectionType: ddbtypes.ProjectionTypeAll}))
+
+	// The non-key attributes only go with the INCLUDE projection
+	gsi.ProjectionType = ddbtypes.ProjectionTypeKeysOnly
+	assert.Nil(t, gsi.projection().NonKeyAttributes)
+}
+
+func TestMismatchedLsis(t *testing.T) {
+	table := Table{
+		Name:         "blobs",
+		HashKeyName:  "blobId",
+		RangeKeyName: "part",
+		LSIs: []LSI{{
+			Name:          "by-size",
+			RangeKeyField: "size",
+		}, {
+			Name:             "by-time",
+			RangeKeyField:    "time",
+			ProjectionType:   ddbtypes.ProjectionTypeInclude,
+			NonKeyAttributes: []string{"size"},
+		}},
+	}
+	lsiKey := func(rangeKey string) []ddbtypes.KeySchemaElement {
+		return []ddbtypes.KeySchemaElement{
+			{AttributeName: aws.String("blobId"), KeyType: ddbtypes.KeyTypeHash},
+			{AttributeName: aws.String(rangeKey), KeyType: ddbtypes.KeyTypeRange},
+		}
+	}
+
+	assert.Equal(t, []string{"by-size", "by-time"}, mismatchedLsis(table, &ddbtypes.TableDescription{}))
+
+	desc := &ddbtypes.TableDescription{
+		LocalSecondaryIndexes: []ddbtypes.LocalSecondaryIndexDescription{{
+			IndexName:  aws.String("by-size"),
+			KeySchema:  lsiKey("size"),
+			Projection: &ddbtypes.Projection{ProjectionType: ddbtypes.ProjectionTypeAll},
+		}, {
+			IndexName:  aws.String("by-time"),
+			KeySchema:  lsiKey("time"),
+			Projection: &ddbtypes.Projection{ProjectionType: ddbtypes.ProjectionTypeKeysOnly},
+		}},
+	}
+	assert.Equal(t, []string{"by-time"}, mismatchedLsis(table, desc))
+
+	desc.LocalSecondaryIndexes[1].Projection = &ddbtypes.Projection{
+		ProjectionType: ddbtypes.ProjectionTypeInclude, NonKeyAttributes: []string{"size"}}
+	assert.Empty(t, mismatchedLsis(table, desc))
+
+	desc.LocalSecondaryIndexes[0].KeySchema = lsiKey("other")
+	assert.Equal(t, []string{"by-size"}, mismatchedLsis(table, desc))
+
+	assert.Equal(t, ddbtypes.ScalarAttributeTypeS, table.LSIs[0].rangeKeyType())
+	table.LSIs[0].RangeKeyType = ddbtypes.ScalarAttributeTypeN
+	assert.Equal(t, ddbtypes.ScalarAttributeTypeN, table.LSIs[0].rangeKeyType())
+}
@@ -0,0 +1,205 @@
+package schemer
+
+import (
+	"context"
+	"fmt"
+	. "github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.uber.org/zap"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tableSecurity is the actual state of the table's security settings
+type tableSecurity struct {
+	desc *ddbtypes.TableDescription
+	pitr bool
+	tags map[string]string
+}
+
+func (t *Table) hasSecurity() bool {
+	return t.KmsKeyId != "" || t.DeletionProtection || t.PointInTimeRecovery || len(t.Tags) != 0
+}
+
+func (t *Table) sseSpecification() *ddbtypes.SSESpecification {
+	if t.KmsKeyId == "" {
+		return nil
+	}
+	return &ddbtypes.SSESpecification{
+		Enabled:        aws.Bool(true),
+		SSEType:        ddbtypes.SSETypeKms,
+		KMSMasterKeyId: aws.String(t.KmsKeyId),
+	}
+}
+
+func (t *Table) tags() []ddbtypes.Tag {
+	var res []ddbtypes.Tag
+	for k, v := range t.Tags {
+		res = append(res, ddbtypes.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	sort.Slice(res, func(i, j int) bool { return *res[i].Key < *res[j].Key })
+	return res
+}
+
+// kmsKeyMatches checks if the table is encrypted with the key, given by its ID or ARN
+// (not an alias, DynamoDB only reports the ARN of the key)
+func kmsKeyMatches(sse *ddbtypes.SSEDescription, keyId string) bool {
+	if sse == nil || sse.SSEType != ddbtypes.SSETypeKms ||
+		(sse.Status != ddbtypes.SSEStatusEnabled && sse.Status != ddbtypes.SSEStatusEnabling) {
+		return false
+	}
+	arn := aws.ToString(sse.KMSMasterKeyArn)
+	return arn == keyId || strings.HasSuffix(arn, ":key/"+keyId)
+}
+
+// securityDiff lists the settings the table lacks. The settings are only ever turned
+// on and the tags are only added, the ones set outside the schema are kept.
+func securityDiff(t *Table, cur *tableSecurity) []string {
+	var res []string
+	if t.KmsKeyId != "" && !kmsKeyMatches(cur.desc.SSEDescription, t.KmsKeyId) {
+		res = append(res, "KMS key "+t.KmsKeyId)
+	}
+	if t.DeletionProtection && !aws.ToBool(cur.desc.DeletionProtectionEnabled) {
+		res = append(res, "deletion protection")
+	}
+	if t.PointInTimeRecovery && !cur.pitr {
+		res = append(res, "point-in-time recovery")
+	}
+	for _, tag := range missingTags(t, cur.tags) {
+		res = append(res, fmt.Sprintf("tag %s=%s", *tag.Key, *tag.Value))
+	}
+	return res
+}
+
+func missingTags(t *Table, existing map[string]string) []ddbtypes.Tag {
+	var res []ddbtypes.Tag
+	for _, tag := range t.tags() {
+		if v, ok := existing[*tag.Key]; !ok || v != *tag.Value {
+			res = append(res, tag)
+		}
+	}
+	return res
+}
+
+func (db *DynamoDBInitializer) describeSecurity(ctx context.Context, client *dynamodb.Client,
+	tableName string, desc *ddbtypes.TableDescription) (*tableSecurity, error) {
+
+	res := &tableSecurity{desc: desc, tags: map[string]string{}}
+
+	backups, err := client.DescribeContinuousBackups(ctx, &dynamodb.DescribeContinuousBackupsInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the backups of %s: %w", tableName, err)
+	}
+	if d := backups.ContinuousBackupsDescription; d != nil && d.PointInTimeRecoveryDescription != nil {
+		res.pitr = d.PointInTimeRecoveryDescription.PointInTimeRecoveryStatus ==
+			ddbtypes.PointInTimeRecoveryStatusEnabled
+	}
+
+	input := &dynamodb.ListTagsOfResourceInput{ResourceArn: desc.TableArn}
+	for {
+		tags, err := client.ListTagsOfResource(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the tags of %s: %w", tableName, err)
+		}
+		for _, tag := range tags.Tags {
+			res.tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+		if tags.NextToken == nil {
+			break
+		}
+		input.NextToken = tags.NextToken
+	}
+
+	return res, nil
+}
+
+// ensureSecurity turns on the table's encryption with the KMS key, the deletion
+// protection and the point-in-time recovery, and adds the tags
+func (db *DynamoDBInitializer) ensureSecurity(ctx context.Context, client *dynamodb.Client,
+	tableName string, t Table) error {
+
+	if !t.hasSecurity() {
+		return nil
+	}
+
+	ctx = WithFields(ctx, zap.String("table-name", tableName))
+
+	response, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return err
+	}
+	cur, err := db.describeSecurity(ctx, client, tableName, response.Table)
+	if err != nil {
+		return err
+	}
+
+	if t.KmsKeyId != "" && !kmsKeyMatches(cur.desc.SSEDescription, t.KmsKeyId) {
+		L(ctx).Info("Enabling the encryption with the KMS key", zap.String("kms-key-id", t.KmsKeyId))
+		err = db.updateTable(ctx, client, &dynamodb.UpdateTableInput{
+			TableName:        aws.String(tableName),
+			SSESpecification: t.sseSpecification(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.DeletionProtection && !aws.ToBool(cur.desc.DeletionProtectionEnabled) {
+		L(ctx).Info("Enabling the deletion protection")
+		err = db.updateTable(ctx, client, &dynamodb.UpdateTableInput{
+			TableName:                 aws.String(tableName),
+			DeletionProtectionEnabled: aws.Bool(true),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.PointInTimeRecovery && !cur.pitr {
+		L(ctx).Info("Enabling the point-in-time recovery")
+		_, err = client.UpdateContinuousBackups(ctx, &dynamodb.UpdateContinuousBackupsInput{
+			TableName: aws.String(tableName),
+			PointInTimeRecoverySpecification: &ddbtypes.PointInTimeRecoverySpecification{
+				PointInTimeRecoveryEnabled: aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if tags := missingTags(&t, cur.tags); len(tags) != 0 {
+		L(ctx).Info("Tagging the table", zap.Int("tags", len(tags)))
+		_, err = client.TagResource(ctx, &dynamodb.TagResourceInput{
+			ResourceArn: cur.desc.TableArn,
+			Tags:        tags,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	L(ctx).Info("Table security settings are up-to-date")
+	return nil
+}
+
+// updateTable updates the table and waits for it to become active again
+func (db *DynamoDBInitializer) updateTable(ctx context.Context, client *dynamodb.Client,
+	input *dynamodb.UpdateTableInput) error {
+
+	_, err := client.UpdateTable(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	params := &dynamodb.DescribeTableInput{TableName: input.TableName}
+	return waiter.Wait(ctx, params, 15*time.Minute)
+}
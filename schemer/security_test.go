@@ -0,0 +1,54 @@
+package schemer
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSecurityDiff(t *testing.T) {
+	table := &Table{
+		Name:                "tokens",
+		KmsKeyId:            "1234abcd-12ab-34cd-56ef-1234567890ab",
+		PointInTimeRecovery: true,
+		DeletionProtection:  true,
+		Tags:                map[string]string{"team": "tracing", "env": "prod"},
+	}
+	assert.True(t, table.hasSecurity())
+	assert.False(t, (&Table{Name: "blobs"}).hasSecurity())
+
+	cur := &tableSecurity{
+		desc: &ddbtypes.TableDescription{},
+		tags: map[string]string{"env": "dev", "owner": "someone"},
+	}
+	assert.Equal(t, []string{
+		"KMS key 1234abcd-12ab-34cd-56ef-1234567890ab",
+		"deletion protection",
+		"point-in-time recovery",
+		"tag env=prod",
+		"tag team=tracing",
+	}, securityDiff(table, cur))
+
+	// The extra tags are kept
+	cur = &tableSecurity{
+		desc: &ddbtypes.TableDescription{
+			SSEDescription: &ddbtypes.SSEDescription{
+				SSEType: ddbtypes.SSETypeKms,
+				Status:  ddbtypes.SSEStatusEnabled,
+				KMSMasterKeyArn: aws.String(
+					"arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"),
+			},
+			DeletionProtectionEnabled: aws.Bool(true),
+		},
+		pitr: true,
+		tags: map[string]string{"env": "prod", "team": "tracing", "owner": "someone"},
+	}
+	assert.Empty(t, securityDiff(table, cur))
+
+	// The disabled settings are not turned off
+	assert.Empty(t, securityDiff(&Table{Name: "tokens"}, cur))
+
+	cur.desc.SSEDescription.Status = ddbtypes.SSEStatusDisabled
+	assert.Equal(t, []string{"KMS key 1234abcd-12ab-34cd-56ef-1234567890ab"}, securityDiff(table, cur))
+}
@@ -0,0 +1,317 @@
+package spanstore
+
+import (
+	"context"
+	"fmt"
+	. "github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jaegertracing/jaeger/pkg/metrics"
+	"go.uber.org/zap"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ActivityTableName = "activity"
+
+const activityDayFormat = "2006-01-02"
+
+// The hourly counters of the activity record are in the "hNN" attributes, the
+// counters of the nested maps can't be incremented atomically
+const activityHourPrefix = "h"
+
+// The buckets this recent might have the counts that are not flushed yet, they are
+// always searched. The counts must be flushed more often than this.
+const ActivityGracePeriod = 5 * time.Minute
+
+type activityKey struct {
+	service string
+	bucket  time.Time
+}
+
+// ActivityTracker counts the spans of each service in the hourly buckets. The counts
+// are aggregated in memory and periodically added to the per-service daily records
+// of the activity table. The reader uses them to skip the empty buckets.
+//
+// Once an hour is over, the services the tracker has seen get the zero count for it
+// if they had no spans, so the reader can tell the empty buckets from the ones that
+// were not tracked. The counts are added up, so the bucket stays empty only if none
+// of the writers had spans in it.
+type ActivityTracker struct {
+	client *dynamodb.Client
+	suffix string
+
+	ttlSeconds int64
+	timer      func() time.Time
+
+	mtx    sync.Mutex
+	counts map[activityKey]int64
+	// The services that had spans since the tracker was started
+	services map[string]bool
+	// The first hour that hasn't got the zero counts yet, the hour the tracker was
+	// started in is not tracked completely
+	zeroFrom time.Time
+
+	capacity *capacityReporter
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func NewActivityTracker(client *dynamodb.Client, suffix string, ttlSeconds int64,
+	factory metrics.Factory) *ActivityTracker {
+
+	return &ActivityTracker{
+		client:     client,
+		suffix:     suffix,
+		ttlSeconds: ttlSeconds,
+		timer:      time.Now,
+		counts:     map[activityKey]int64{},
+		services:   map[string]bool{},
+		zeroFrom:   time.Now().UTC().Truncate(time.Hour).Add(time.Hour),
+		capacity:   newCapacityReporter(factory),
+		stop:       make(chan struct{}),
+	}
+}
+
+// Record notes the span of the service, the nil tracker ignores it
+func (a *ActivityTracker) Record(service string, startTime time.Time) {
+	if a == nil {
+		return
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.counts[activityKey{service: service, bucket: startTime.UTC().Truncate(time.Hour)}]++
+	a.services[service] = true
+}
+
+// addZeroCounts adds the zero counts of the known services for the hours that are
+// over, unless they have the spans already. Must be called with the lock held.
+func (a *ActivityTracker) addZeroCounts() {
+	over := a.timer().Add(-ActivityGracePeriod).UTC().Truncate(time.Hour)
+	for ; a.zeroFrom.Before(over); a.zeroFrom = a.zeroFrom.Add(time.Hour) {
+		for service := range a.services {
+			key := activityKey{service: service, bucket: a.zeroFrom}
+			if _, ok := a.counts[key]; !ok {
+				a.counts[key] = 0
+			}
+		}
+	}
+}
+
+// Start flushes the counts periodically, Stop flushes the remaining ones
+func (a *ActivityTracker) Start(ctx context.Context, interval time.Duration) {
+	a.done.Add(1)
+	go func() {
+		defer a.done.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stop:
+				a.flushAndLog(ctx)
+				return
+			case <-ticker.C:
+			}
+			a.flushAndLog(ctx)
+		}
+	}()
+}
+
+func (a *ActivityTracker) Stop() {
+	close(a.stop)
+	a.done.Wait()
+}
+
+func (a *ActivityTracker) flushAndLog(ctx context.Context) {
+	err := a.Flush(ctx)
+	if err != nil {
+		L(ctx).Error("Failed to flush the service activity", zap.Error(err))
+	}
+}
+
+// Flush adds the aggregated counts to the activity records. The counts that failed
+// to be saved are kept for the next attempt.
+func (a *ActivityTracker) Flush(ctx context.Context) error {
+	ctx, done := a.capacity.start(ctx, "flush_activity", 0)
+	defer done()
+
+	a.mtx.Lock()
+	a.addZeroCounts()
+	counts := a.counts
+	a.counts = map[activityKey]int64{}
+	a.mtx.Unlock()
+
+	// Group the counts by the record
+	type recordKey struct{ service, day string }
+	records := map[recordKey]map[activityKey]int64{}
+	for k, v := range counts {
+		rk := recordKey{service: k.service, day: k.bucket.Format(activityDayFormat)}
+		if records[rk] == nil {
+			records[rk] = map[activityKey]int64{}
+		}
+		records[rk][k] = v
+	}
+
+	ttl := fmt.Sprintf("%d", a.timer().Unix()+a.ttlSeconds)
+	var firstErr error
+	for rk, hours := range records {
+		err := a.addCounts(ctx, rk.service, rk.day, hours, ttl)
+		if err == nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		a.mtx.Lock()
+		for k, v := range hours {
+			a.counts[k] += v
+		}
+		a.mtx.Unlock()
+	}
+
+	return firstErr
+}
+
+func (a *ActivityTracker) addCounts(ctx context.Context, service, day string,
+	hours map[activityKey]int64, ttl string) error {
+
+	names := map[string]string{"#ttl": "ttl"}
+	values := map[string]types.AttributeValue{":ttl": &types.AttributeValueMemberN{Value: ttl}}
+	var adds []string
+	for k, v := range hours {
+		hour := fmt.Sprintf("%02d", k.bucket.Hour())
+		names["#h"+hour] = activityHourPrefix + hour
+		values[":h"+hour] = &types.AttributeValueMemberN{Value: strconv.FormatInt(v, 10)}
+		adds = append(adds, "#h"+hour+" :h"+hour)
+	}
+	sort.Strings(adds)
+
+	res, err := a.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ActivityTableName + a.suffix),
+		Key: map[string]types.AttributeValue{
+			"service": &types.AttributeValueMemberS{Value: service},
+			"day":     &types.AttributeValueMemberS{Value: day},
+		},
+		UpdateExpression:          aws.String("ADD " + strings.Join(adds, ", ") + " SET #ttl = :ttl"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnConsumedCapacity:    types.ReturnConsumedCapacityTotal,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update the service activity: %w", err)
+	}
+	meterFrom(ctx).addWrite(res.ConsumedCapacity)
+	return nil
+}
+
+// loadActivity reads the span counts of the service's hourly buckets in the time
+// range. It returns false if the service has no activity records in the range, e.g.
+// if its spans were written before the activity was tracked.
+func (r *DdbReader) loadActivity(ctx context.Context, service string,
+	minTime, maxTime time.Time) (map[time.Time]int64, bool, error) {
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(ActivityTableName + r.suffix),
+		KeyConditionExpression: aws.String("#svc = :svc AND #day BETWEEN :min AND :max"),
+		ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+		ExpressionAttributeNames: map[string]string{
+			"#svc": "service",
+			"#day": "day",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":svc": &types.AttributeValueMemberS{Value: service},
+			":min": &types.AttributeValueMemberS{Value: minTime.UTC().Format(activityDayFormat)},
+			":max": &types.AttributeValueMemberS{Value: maxTime.UTC().Format(activityDayFormat)},
+		},
+	}
+	input.FilterExpression = aws.String(r.notExpired(input.ExpressionAttributeNames, input.ExpressionAttributeValues))
+	paginator := dynamodb.NewQueryPaginator(r.client, input)
+
+	res := map[time.Time]int64{}
+	found := false
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to query the service activity: %w", err)
+		}
+		meterFrom(ctx).addRead(page.ConsumedCapacity)
+
+		for _, item := range page.Items {
+			found = true
+			day, ok := item["day"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+			dayTime, err := time.Parse(activityDayFormat, day.Value)
+			if err != nil {
+				continue
+			}
+			for k, v := range item {
+				hour, count, ok := parseActivityHour(k, v)
+				if ok {
+					res[dayTime.Add(time.Duration(hour)*time.Hour)] = count
+				}
+			}
+		}
+	}
+
+	return res, found, nil
+}
+
+func parseActivityHour(name string, value types.AttributeValue) (int, int64, bool) {
+	if len(name) != len(activityHourPrefix)+2 || !strings.HasPrefix(name, activityHourPrefix) {
+		return 0, 0, false
+	}
+	hour, err := strconv.Atoi(name[len(activityHourPrefix):])
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, 0, false
+	}
+	num, ok := value.(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, 0, false
+	}
+	count, err := strconv.ParseInt(num.Value, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return hour, count, true
+}
+
+// planBuckets chooses the hourly buckets to search and their order. The recent
+// buckets are always searched first, their counts might be not flushed yet. Then go
+// the older buckets with the most spans, the densest ones are the likeliest to fill
+// the page. The buckets without the record might have not been tracked, they go
+// last, the most recent first. Only the buckets with the recorded zero count are
+// skipped.
+func planBuckets(buckets []time.Time, activity map[time.Time]int64, now time.Time) []time.Time {
+	recent := now.Add(-ActivityGracePeriod).UTC().Truncate(time.Hour)
+
+	var res, older []time.Time
+	for _, b := range buckets {
+		if !b.Before(recent) {
+			res = append(res, b)
+			continue
+		}
+		if count, ok := activity[b]; ok && count == 0 {
+			continue
+		}
+		older = append(older, b)
+	}
+
+	// The buckets come the most recent first, the ties keep that order
+	sort.SliceStable(older, func(i, j int) bool {
+		ci, iok := activity[older[i]]
+		cj, jok := activity[older[j]]
+		if iok != jok {
+			return iok
+		}
+		return ci > cj
+	})
+	return append(res, older...)
+}
@@ -0,0 +1,77 @@
+package spanstore
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPlanBuckets(t *testing.T) {
+	now := time.Date(2023, 2, 10, 13, 2, 0, 0, time.UTC)
+	buckets := timeBuckets(now.Add(-5*time.Hour), now)
+	assert.Equal(t, 6, len(buckets))
+
+	activity := map[time.Time]int64{
+		time.Date(2023, 2, 10, 8, 0, 0, 0, time.UTC):  5,
+		time.Date(2023, 2, 10, 9, 0, 0, 0, time.UTC):  0,
+		time.Date(2023, 2, 10, 10, 0, 0, 0, time.UTC): 50,
+		time.Date(2023, 2, 10, 12, 0, 0, 0, time.UTC): 0,
+	}
+
+	// The recorded empty buckets are skipped, except the previous one that might have
+	// unflushed counts. The older ones go from the densest, then the ones without the
+	// record.
+	assert.Equal(t, []time.Time{
+		time.Date(2023, 2, 10, 13, 0, 0, 0, time.UTC),
+		time.Date(2023, 2, 10, 12, 0, 0, 0, time.UTC),
+		time.Date(2023, 2, 10, 10, 0, 0, 0, time.UTC),
+		time.Date(2023, 2, 10, 8, 0, 0, 0, time.UTC),
+		time.Date(2023, 2, 10, 11, 0, 0, 0, time.UTC),
+	}, planBuckets(buckets, activity, now))
+
+	// The past searches have no recent buckets
+	assert.Equal(t, []time.Time{
+		time.Date(2023, 2, 10, 10, 0, 0, 0, time.UTC),
+		time.Date(2023, 2, 10, 8, 0, 0, 0, time.UTC),
+		time.Date(2023, 2, 10, 13, 0, 0, 0, time.UTC),
+		time.Date(2023, 2, 10, 11, 0, 0, 0, time.UTC),
+	}, planBuckets(buckets, activity, now.Add(24*time.Hour)))
+}
+
+func TestActivityTracker(t *testing.T) {
+	var nilTracker *ActivityTracker
+	nilTracker.Record("svc", time.Now())
+
+	tracker := NewActivityTracker(nil, "-test", 3600, nil)
+	start := time.Date(2023, 2, 10, 13, 45, 0, 0, time.FixedZone("X", 3600))
+	tracker.Record("svc", start)
+	tracker.Record("svc", start.Add(time.Minute))
+	tracker.Record("svc", start.Add(time.Hour))
+	assert.Equal(t, map[activityKey]int64{
+		{service: "svc", bucket: time.Date(2023, 2, 10, 12, 0, 0, 0, time.UTC)}: 2,
+		{service: "svc", bucket: time.Date(2023, 2, 10, 13, 0, 0, 0, time.UTC)}: 1,
+	}, tracker.counts)
+
+	// The services get the zero counts for the complete hours without spans
+	tracker.counts = map[activityKey]int64{
+		{service: "svc", bucket: time.Date(2023, 2, 10, 13, 0, 0, 0, time.UTC)}: 1,
+	}
+	tracker.zeroFrom = time.Date(2023, 2, 10, 12, 0, 0, 0, time.UTC)
+	tracker.timer = func() time.Time { return time.Date(2023, 2, 10, 15, 3, 0, 0, time.UTC) }
+	tracker.addZeroCounts()
+	assert.Equal(t, map[activityKey]int64{
+		{service: "svc", bucket: time.Date(2023, 2, 10, 12, 0, 0, 0, time.UTC)}: 0,
+		{service: "svc", bucket: time.Date(2023, 2, 10, 13, 0, 0, 0, time.UTC)}: 1,
+	}, tracker.counts)
+	assert.Equal(t, time.Date(2023, 2, 10, 14, 0, 0, 0, time.UTC), tracker.zeroFrom)
+
+	hour, count, ok := parseActivityHour("h07", &types.AttributeValueMemberN{Value: "42"})
+	assert.True(t, ok)
+	assert.Equal(t, 7, hour)
+	assert.Equal(t, int64(42), count)
+	for _, name := range []string{"ttl", "h24", "hx1", "h1"} {
+		_, _, ok = parseActivityHour(name, &types.AttributeValueMemberN{Value: "42"})
+		assert.False(t, ok, name)
+	}
+}
@@ -0,0 +1,124 @@
+package spanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"time"
+)
+
+var errArchiveSearchNotSupported = errors.New("the archived traces can only be loaded by their IDs")
+
+type ArchiveClient interface {
+	dynamodb.QueryAPIClient
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput,
+		optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+}
+
+// DdbArchive keeps the archived traces in their own table, on the Standard-IA
+// class. The spans are stored as they are, without the search attributes, the
+// summaries or the separate process records, as the archive is only read by the
+// trace ID. The traces archived into the span table before are still found by the
+// span reader, until they expire.
+type DdbArchive struct {
+	client     ArchiveClient
+	suffix     string
+	ttlSeconds int64
+	timer      func() time.Time
+}
+
+var _ spanstore.Reader = &DdbArchive{}
+var _ spanstore.Writer = &DdbArchive{}
+
+func NewDdbArchive(client ArchiveClient, suffix string, ttlSeconds int64) *DdbArchive {
+	return &DdbArchive{
+		client:     client,
+		suffix:     suffix,
+		ttlSeconds: ttlSeconds,
+		timer:      time.Now,
+	}
+}
+
+// WriteSpan saves the span, the archived spans were redacted when they were written
+// to the span table
+func (a *DdbArchive) WriteSpan(ctx context.Context, span *model.Span) error {
+	ddbModel, err := ToDdbModel(span, nil)
+	if err != nil {
+		return fmt.Errorf("failed to convert to DDB model: %w", err)
+	}
+	ddbModel.FlattenedTags, ddbModel.NumericTags = nil, nil
+	ddbModel.OperationBucket, ddbModel.ErrorBucket = "", ""
+
+	item, err := attributevalue.MarshalMap(ddbModel)
+	if err != nil {
+		return err
+	}
+	item["ttl"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", a.timer().Unix()+a.ttlSeconds)}
+
+	_, err = a.client.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(ArchiveTableName + a.suffix),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to persist the archived span: %w", err)
+	}
+	return nil
+}
+
+func (a *DdbArchive) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	paginator := dynamodb.NewQueryPaginator(a.client, &dynamodb.QueryInput{
+		TableName:              aws.String(ArchiveTableName + a.suffix),
+		KeyConditionExpression: aws.String("#tid = :tid"),
+		FilterExpression:       aws.String("attribute_not_exists(#ttl) OR #ttl > :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#tid": "trace_id",
+			"#ttl": "ttl",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tid": &types.AttributeValueMemberS{Value: formatTraceId(traceID)},
+			":now": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", a.timer().Unix())},
+		},
+	})
+
+	var stored []StoredSpan
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query the archived trace: %w", err)
+		}
+		var spans []StoredSpan
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &spans)
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, spans...)
+	}
+
+	if len(stored) == 0 {
+		return nil, spanstore.ErrTraceNotFound
+	}
+	return assembleTrace(stored)
+}
+
+func (a *DdbArchive) GetServices(context.Context) ([]string, error) {
+	return nil, errArchiveSearchNotSupported
+}
+
+func (a *DdbArchive) GetOperations(context.Context,
+	spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	return nil, errArchiveSearchNotSupported
+}
+
+func (a *DdbArchive) FindTraces(context.Context, *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	return nil, errArchiveSearchNotSupported
+}
+
+func (a *DdbArchive) FindTraceIDs(context.Context, *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	return nil, errArchiveSearchNotSupported
+}
@@ -0,0 +1,65 @@
+package spanstore
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type fakeArchiveClient struct {
+	*fakeReaderClient
+}
+
+func (f *fakeArchiveClient) PutItem(_ context.Context, input *dynamodb.PutItemInput,
+	_ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	traceId := input.Item["trace_id"].(*types.AttributeValueMemberS).Value
+	key := aws.ToString(input.TableName) + "//" + traceId
+	f.items[key] = append(f.items[key], input.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeArchiveClient{newFakeReaderClient()}
+	archive := NewDdbArchive(client, "-test", 3600)
+	archive.timer = func() time.Time { return time.Unix(1676030400, 0) }
+
+	tid := model.NewTraceID(0, 1)
+	start := time.Now().UTC()
+	spans := []*model.Span{
+		makeTestSpan(tid, 1, "api", "GET /", start, time.Second, model.String("http.method", "GET")),
+		makeTestSpan(tid, 2, "db", "SELECT", start, time.Millisecond),
+	}
+	for _, span := range spans {
+		require.NoError(t, archive.WriteSpan(ctx, span))
+	}
+
+	// The spans are stored without the search attributes
+	items := client.items[ArchiveTableName+"-test//"+formatTraceId(tid)]
+	require.Equal(t, 2, len(items))
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "1676034000"}, items[0]["ttl"])
+	assert.NotContains(t, items[0], "flattened_tags")
+	assert.NotContains(t, items[0], "operation_bucket")
+
+	trace, err := archive.GetTrace(ctx, tid)
+	require.NoError(t, err)
+	assert.Equal(t, spans, trace.Spans)
+	assert.Empty(t, client.queriesOf(SpanTableName, ""))
+
+	_, err = archive.GetTrace(ctx, model.NewTraceID(0, 2))
+	assert.Equal(t, spanstore.ErrTraceNotFound, err)
+
+	// The archive is not searchable
+	_, err = archive.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{ServiceName: "api"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package spanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jaegertracing/jaeger/model"
+	"go.uber.org/zap"
+)
+
+type BackfillStats struct {
+	SpansScanned    int64
+	SpansBackfilled int64
+}
+
+// SummaryBackfiller makes the spans written before the trace summaries and the
+// operation and error indexes were introduced searchable. It folds each of them
+// into its trace summary and sets its operation and error buckets. The spans that
+// have the operation bucket are skipped, so the backfill can be resumed. It must
+// not run concurrently with itself, and it should run after the ID migration, so
+// the summaries are keyed by the canonical trace IDs.
+type SummaryBackfiller struct {
+	client *dynamodb.Client
+	suffix string
+	dryRun bool
+	writer *DdbWriter
+}
+
+func NewSummaryBackfiller(client *dynamodb.Client, suffix string, dryRun bool) *SummaryBackfiller {
+	return &SummaryBackfiller{
+		client: client,
+		suffix: suffix,
+		dryRun: dryRun,
+		writer: &DdbWriter{client: client, suffix: suffix},
+	}
+}
+
+func (b *SummaryBackfiller) Backfill(ctx context.Context) (*BackfillStats, error) {
+	stats := &BackfillStats{}
+	tableName := aws.String(SpanTableName + b.suffix)
+	paginator := dynamodb.NewScanPaginator(b.client, &dynamodb.ScanInput{
+		TableName:                tableName,
+		FilterExpression:         aws.String("attribute_not_exists(#ob)"),
+		ExpressionAttributeNames: map[string]string{"#ob": "operation_bucket"},
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return stats, fmt.Errorf("failed to scan the spans: %w", err)
+		}
+
+		for _, item := range page.Items {
+			stats.SpansScanned++
+
+			var stored StoredSpan
+			err = attributevalue.UnmarshalMap(item, &stored)
+			if err != nil {
+				return stats, err
+			}
+			// The process records are not searched for
+			if isProcessRecord(&stored) {
+				continue
+			}
+			ttl, ok := item["ttl"].(*types.AttributeValueMemberN)
+			if !ok || stored.Process == nil {
+				L(ctx).Warn("The span has no TTL or process, skipping it",
+					zap.String("segment-id", stored.SegmentId))
+				continue
+			}
+			span, err := FromDdbModel(&stored)
+			if err != nil {
+				L(ctx).Warn("Failed to parse the span, skipping it", zap.Error(err),
+					zap.String("segment-id", stored.SegmentId))
+				continue
+			}
+			stats.SpansBackfilled++
+			if b.dryRun {
+				continue
+			}
+
+			err = b.backfillSpan(ctx, tableName, span, &stored, ttl.Value)
+			if err != nil {
+				return stats, err
+			}
+		}
+
+		L(ctx).Info("Backfilled a page of spans", zap.Int64("scanned", stats.SpansScanned),
+			zap.Int64("backfilled", stats.SpansBackfilled))
+	}
+
+	return stats, nil
+}
+
+// backfillSpan updates the summary first, the span is only marked as backfilled
+// after that. If the backfill is interrupted in between, the span is counted in
+// the summary twice, but its trace can't get lost.
+func (b *SummaryBackfiller) backfillSpan(ctx context.Context, tableName *string,
+	span *model.Span, stored *StoredSpan, ttl string) error {
+
+	err := b.writer.updateTraceSummary(ctx, span, stored, ttl, true)
+	if err != nil {
+		return err
+	}
+
+	update := "SET #ob = :ob"
+	names := map[string]string{"#ob": "operation_bucket", "#seg": "segment_id"}
+	values := map[string]types.AttributeValue{
+		":ob": &types.AttributeValueMemberS{
+			Value: operationBucket(span.Process.ServiceName, span.OperationName, span.StartTime)},
+	}
+	if isErrorSpan(span) {
+		update += ", #eb = :eb"
+		names["#eb"] = "error_bucket"
+		values[":eb"] = &types.AttributeValueMemberS{Value: stored.ServiceAndTime}
+	}
+
+	_, err = b.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: tableName,
+		Key: map[string]types.AttributeValue{
+			"service_and_time": &types.AttributeValueMemberS{Value: stored.ServiceAndTime},
+			"segment_id":       &types.AttributeValueMemberS{Value: stored.SegmentId},
+		},
+		UpdateExpression: aws.String(update),
+		// The span might have expired in the meantime, it's not re-created
+		ConditionExpression:       aws.String("attribute_exists(#seg)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	var condFailed *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &condFailed) {
+		return fmt.Errorf("failed to backfill the span's buckets: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package spanstore
+
+import (
+	"context"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/SimplestCloud/jaeger-ddb-spanstore/schemer"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestSummaryBackfill(t *testing.T) {
+	ddb := schemer.NewDdbConnection(t, false)
+	defer ddb.Close()
+
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	require.NoError(t, EnsureTablesAreReady(ctx, "-test", ddb.Config, SchemaOptions{}))
+
+	client := dynamodb.NewFromConfig(ddb.Config)
+	dep := NewDependencyManager(client, "-test", 3600)
+	writer := NewDdbWriter(client, "-test", 3600, dep, WriterOptions{})
+	reader := NewDdbReader(client, "-test", ReaderOptions{})
+
+	start := time.Now().UTC().Truncate(time.Second)
+	tid := model.NewTraceID(0, 0x1)
+	span := makeTestSpan(tid, 1, "api", "GET /", start, 100*time.Millisecond, model.Bool("error", true))
+	require.NoError(t, writer.WriteSpan(ctx, span))
+
+	// Make the span look like it was written before the summaries were introduced
+	stored, err := ToDdbModel(span, nil)
+	require.NoError(t, err)
+	_, err = client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(SpanTableName + "-test"),
+		Key: map[string]types.AttributeValue{
+			"service_and_time": &types.AttributeValueMemberS{Value: stored.ServiceAndTime},
+			"segment_id":       &types.AttributeValueMemberS{Value: stored.SegmentId},
+		},
+		UpdateExpression: aws.String("REMOVE operation_bucket, error_bucket"),
+	})
+	require.NoError(t, err)
+	_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(TraceTableName + "-test"),
+		Key: map[string]types.AttributeValue{
+			"trace_id": &types.AttributeValueMemberS{Value: stored.TraceId},
+			"service":  &types.AttributeValueMemberS{Value: "api"},
+		},
+	})
+	require.NoError(t, err)
+
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:   "api",
+		OperationName: "GET /",
+		Tags:          map[string]string{"error": "true"},
+		StartTimeMin:  start.Add(-time.Minute),
+		StartTimeMax:  start.Add(time.Minute),
+	}
+	ids, err := reader.FindTraceIDs(ctx, query)
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+
+	backfiller := NewSummaryBackfiller(client, "-test", false)
+	stats, err := backfiller.Backfill(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.SpansBackfilled)
+
+	ids, err = reader.FindTraceIDs(ctx, query)
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{tid}, ids)
+	summary, err := reader.loadTraceSummary(ctx, stored.TraceId)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), summary.SpanCount)
+
+	// The backfilled spans are skipped
+	stats, err = backfiller.Backfill(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), stats.SpansBackfilled)
+}
@@ -0,0 +1,142 @@
+package spanstore
+
+import (
+	"context"
+	. "github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"github.com/jaegertracing/jaeger/pkg/metrics"
+	"go.uber.org/zap"
+	"sync"
+)
+
+// capacityMeter sums up the capacity consumed by the DynamoDB calls made on behalf
+// of one API call
+type capacityMeter struct {
+	mtx   sync.Mutex
+	read  float64
+	write float64
+
+	// The read capacity the API call may consume, zero means no limit
+	readBudget float64
+}
+
+type capacityMeterKey struct{}
+
+func meterFrom(ctx context.Context) *capacityMeter {
+	res, _ := ctx.Value(capacityMeterKey{}).(*capacityMeter)
+	return res
+}
+
+// addRead accounts for the capacity consumed by a read, the nil meter ignores it
+func (m *capacityMeter) addRead(consumed *types.ConsumedCapacity) {
+	if m == nil || consumed == nil || consumed.CapacityUnits == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.read += *consumed.CapacityUnits
+}
+
+// addWrite accounts for the capacity consumed by a write, the nil meter ignores it
+func (m *capacityMeter) addWrite(consumed *types.ConsumedCapacity) {
+	if m == nil || consumed == nil || consumed.CapacityUnits == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.write += *consumed.CapacityUnits
+}
+
+func (m *capacityMeter) totals() (float64, float64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.read, m.write
+}
+
+// The share of the read capacity budget a search may spend walking the indexes, the
+// rest is left for loading the traces it has found
+const searchBudgetShare = 0.5
+
+// budgetExceeded tells if the API call has consumed all the read capacity it may use
+func (m *capacityMeter) budgetExceeded() bool {
+	return m.exceeds(1)
+}
+
+// searchBudgetExceeded tells if the search has used up its share of the read
+// capacity budget for walking the indexes
+func (m *capacityMeter) searchBudgetExceeded() bool {
+	return m.exceeds(searchBudgetShare)
+}
+
+func (m *capacityMeter) exceeds(share float64) bool {
+	if m == nil || m.readBudget == 0 {
+		return false
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.read >= m.readBudget*share
+}
+
+type capacityMetrics struct {
+	Read  metrics.Histogram
+	Write metrics.Histogram
+}
+
+// capacityReporter publishes the capacity consumed by the API calls
+type capacityReporter struct {
+	factory metrics.Factory
+
+	mtx   sync.Mutex
+	byApi map[string]*capacityMetrics
+}
+
+func newCapacityReporter(factory metrics.Factory) *capacityReporter {
+	if factory == nil {
+		factory = metrics.NullFactory
+	}
+	return &capacityReporter{
+		factory: factory,
+		byApi:   map[string]*capacityMetrics{},
+	}
+}
+
+func (c *capacityReporter) metricsFor(api string) *capacityMetrics {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	res, ok := c.byApi[api]
+	if !ok {
+		tags := map[string]string{"api": api}
+		res = &capacityMetrics{
+			Read:  c.factory.Histogram(metrics.HistogramOptions{Name: "consumed_read_capacity", Tags: tags}),
+			Write: c.factory.Histogram(metrics.HistogramOptions{Name: "consumed_write_capacity", Tags: tags}),
+		}
+		c.byApi[api] = res
+	}
+	return res
+}
+
+// start attributes the capacity consumed within the returned context to the API
+// call. The nested API calls are attributed to the outermost one. The returned
+// function reports the consumed capacity to the metrics and to the request log.
+func (c *capacityReporter) start(ctx context.Context, api string,
+	readBudget float64) (context.Context, func()) {
+
+	if meterFrom(ctx) != nil {
+		return ctx, func() {}
+	}
+
+	meter := &capacityMeter{readBudget: readBudget}
+	ctx = context.WithValue(ctx, capacityMeterKey{}, meter)
+	return ctx, func() {
+		read, write := meter.totals()
+		m := c.metricsFor(api)
+		m.Read.Record(read)
+		m.Write.Record(write)
+
+		grpc_ctxtags.Extract(ctx).Set("ddb.read_capacity", read).Set("ddb.write_capacity", write)
+		L(ctx).Debug("Consumed DynamoDB capacity", zap.String("api", api),
+			zap.Float64("read-capacity", read), zap.Float64("write-capacity", write))
+	}
+}
@@ -0,0 +1,46 @@
+package spanstore
+
+import (
+	"context"
+	"expvar"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/SimplestCloud/jaeger-ddb-spanstore/utils"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func TestCapacityMeter(t *testing.T) {
+	// No meter, nothing is accounted
+	meterFrom(context.Background()).addRead(&types.ConsumedCapacity{CapacityUnits: aws.Float64(1)})
+	assert.False(t, meterFrom(context.Background()).budgetExceeded())
+
+	reporter := newCapacityReporter(utils.NewExpvarFactory("test_capacity"))
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	ctx, done := reporter.start(ctx, "find_traces", 10)
+
+	// The nested calls are accounted to the outer one
+	nested, nestedDone := reporter.start(ctx, "get_trace", 0)
+	meterFrom(nested).addRead(&types.ConsumedCapacity{CapacityUnits: aws.Float64(4.5)})
+	nestedDone()
+	assert.False(t, meterFrom(ctx).budgetExceeded())
+	assert.False(t, meterFrom(ctx).searchBudgetExceeded())
+	meterFrom(ctx).addRead(&types.ConsumedCapacity{CapacityUnits: aws.Float64(0.5)})
+	assert.True(t, meterFrom(ctx).searchBudgetExceeded())
+	assert.False(t, meterFrom(ctx).budgetExceeded())
+
+	meterFrom(ctx).addRead(&types.ConsumedCapacity{CapacityUnits: aws.Float64(5)})
+	meterFrom(ctx).addWrite(&types.ConsumedCapacity{CapacityUnits: aws.Float64(2)})
+	meterFrom(ctx).addRead(&types.ConsumedCapacity{})
+	meterFrom(ctx).addRead(nil)
+	assert.True(t, meterFrom(ctx).budgetExceeded())
+	done()
+
+	assert.Equal(t, `{"count": 1, "sum": 10}`,
+		expvar.Get("test_capacity.consumed_read_capacity|api=find_traces").String())
+	assert.Equal(t, `{"count": 1, "sum": 2}`,
+		expvar.Get("test_capacity.consumed_write_capacity|api=find_traces").String())
+	assert.Nil(t, expvar.Get("test_capacity.consumed_read_capacity|api=get_trace"))
+}
@@ -78,13 +78,15 @@ func (d *DependencyManager) RegisterCall(ctx context.Context, service, operation
 	ddbModelMap["ttl"] = &types.AttributeValueMemberN{
 		Value: fmt.Sprintf("%d", time.Now().Unix()+d.ttlSeconds)}
 
-	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
-		Item:      ddbModelMap,
-		TableName: aws.String(ServiceTableName + d.suffix),
+	res, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:                   ddbModelMap,
+		TableName:              aws.String(ServiceTableName + d.suffix),
+		ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to record the operation: %w", err)
 	}
+	meterFrom(ctx).addWrite(res.ConsumedCapacity)
 
 	// Make a note that we recorded the operation
 	d.mtx.Lock()
@@ -0,0 +1,135 @@
+package spanstore
+
+import (
+	"context"
+	"fmt"
+	. "github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/SimplestCloud/jaeger-ddb-spanstore/schemer"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// IndexResolver picks the GSI versions the reader queries. While a GSI is being
+// replaced, the readers keep using its old version until the new one is backfilled.
+type IndexResolver struct {
+	client *dynamodb.Client
+	suffix string
+
+	mtx sync.RWMutex
+	// The GSI name -> the name of its version in use
+	names map[string]string
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func NewIndexResolver(client *dynamodb.Client, suffix string) *IndexResolver {
+	return &IndexResolver{
+		client: client,
+		suffix: suffix,
+		names:  map[string]string{},
+		stop:   make(chan struct{}),
+	}
+}
+
+// Start refreshes the GSI versions periodically, the zero interval disables it
+func (r *IndexResolver) Start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	r.done.Add(1)
+	go func() {
+		defer r.done.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+			err := r.Refresh(ctx)
+			if err != nil {
+				L(ctx).Error("Failed to refresh the GSI versions", zap.Error(err))
+			}
+		}
+	}()
+}
+
+func (r *IndexResolver) Stop() {
+	close(r.stop)
+	r.done.Wait()
+}
+
+// Refresh picks the newest active version of each GSI
+func (r *IndexResolver) Refresh(ctx context.Context) error {
+	names := map[string]string{}
+	for _, t := range ddbTables {
+		if len(t.GSIs) == 0 {
+			continue
+		}
+		response, err := r.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(t.Name + r.suffix),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to describe the table %s: %w", t.Name+r.suffix, err)
+		}
+		for _, gsi := range t.GSIs {
+			if name, ok := activeVersion(&gsi, response.Table.GlobalSecondaryIndexes); ok {
+				names[gsi.Name] = name
+			}
+		}
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for k, v := range names {
+		if r.names[k] != v {
+			L(ctx).Info("Switching the GSI version", zap.String("gsi", k), zap.String("gsi-version", v))
+		}
+	}
+	r.names = names
+	return nil
+}
+
+func activeVersion(gsi *schemer.GSI, existing []types.GlobalSecondaryIndexDescription) (string, bool) {
+	active := map[string]bool{}
+	for _, i := range existing {
+		active[aws.ToString(i.IndexName)] = i.IndexStatus == types.IndexStatusActive
+	}
+	for v := gsi.Version; v >= 0; v-- {
+		if active[gsi.VersionName(v)] {
+			return gsi.VersionName(v), true
+		}
+	}
+	return "", false
+}
+
+// name returns the version of the GSI to query, the nil resolver (or the one that
+// wasn't refreshed yet) returns the configured version
+func (r *IndexResolver) name(gsiName string) string {
+	if r != nil {
+		r.mtx.RLock()
+		defer r.mtx.RUnlock()
+		if name, ok := r.names[gsiName]; ok {
+			return name
+		}
+	}
+	return configuredIndexName(gsiName)
+}
+
+func configuredIndexName(gsiName string) string {
+	for _, t := range ddbTables {
+		for _, gsi := range t.GSIs {
+			if gsi.Name == gsiName {
+				return gsi.IndexName()
+			}
+		}
+	}
+	return gsiName
+}
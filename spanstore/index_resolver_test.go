@@ -0,0 +1,99 @@
+package spanstore
+
+import (
+	"context"
+	"github.com/SimplestCloud/jaeger-ddb-spanstore/schemer"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestIndexResolver(t *testing.T) {
+	var nilResolver *IndexResolver
+	assert.Equal(t, "by-time-v1", nilResolver.name(byTimeIndex))
+
+	// The old version is used until the new one is backfilled
+	resolver := NewIndexResolver(nil, "-test")
+	assert.Equal(t, byTraceIdIndex, resolver.name(byTraceIdIndex))
+	resolver.names[byTimeIndex] = "by-time"
+	assert.Equal(t, "by-time", resolver.name(byTimeIndex))
+
+	// The refresh is disabled
+	resolver.Start(context.Background(), 0)
+	resolver.Stop()
+
+	gsi := &schemer.GSI{Name: "by-time", Version: 2}
+	existing := []types.GlobalSecondaryIndexDescription{
+		{IndexName: aws.String("by-time"), IndexStatus: types.IndexStatusActive},
+		{IndexName: aws.String("by-time-v1"), IndexStatus: types.IndexStatusActive},
+		{IndexName: aws.String("by-time-v2"), IndexStatus: types.IndexStatusCreating},
+	}
+	name, ok := activeVersion(gsi, existing)
+	assert.True(t, ok)
+	assert.Equal(t, "by-time-v1", name)
+
+	existing[2].IndexStatus = types.IndexStatusActive
+	name, _ = activeVersion(gsi, existing)
+	assert.Equal(t, "by-time-v2", name)
+
+	_, ok = activeVersion(gsi, nil)
+	assert.False(t, ok)
+}
+
+// The span tables created before the search GSIs got their projections have the
+// version 0 of "by-time" and "by-duration", which project all the attributes
+func TestSearchGsisAreReplaced(t *testing.T) {
+	table := ddbTables[0]
+	require.Equal(t, SpanTableName, table.Name)
+
+	desc := &types.TableDescription{
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(table.HashKeyName), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String(table.RangeKeyName), KeyType: types.KeyTypeRange},
+		},
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(table.HashKeyName), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String(table.RangeKeyName), AttributeType: table.RangeKeyType},
+		},
+		BillingModeSummary: &types.BillingModeSummary{BillingMode: types.BillingModePayPerRequest},
+	}
+	baseline := []schemer.GSI{
+		{Name: byTimeIndex, ProjectionField: "service_and_time", RangeKeyField: "start_time_nanos",
+			RangeKeyType: types.ScalarAttributeTypeN},
+		{Name: "by-duration", ProjectionField: "service_and_time", RangeKeyField: "duration_nanos",
+			RangeKeyType: types.ScalarAttributeTypeN},
+		{Name: byTraceIdIndex, ProjectionField: "trace_id", RangeKeyField: "span_id",
+			RangeKeyType: types.ScalarAttributeTypeS},
+	}
+	for _, gsi := range baseline {
+		desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, types.GlobalSecondaryIndexDescription{
+			IndexName: aws.String(gsi.Name),
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String(gsi.ProjectionField), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String(gsi.RangeKeyField), KeyType: types.KeyTypeRange},
+			},
+			Projection:  &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			IndexStatus: types.IndexStatusActive,
+		})
+		desc.AttributeDefinitions = append(desc.AttributeDefinitions,
+			types.AttributeDefinition{AttributeName: aws.String(gsi.ProjectionField),
+				AttributeType: types.ScalarAttributeTypeS},
+			types.AttributeDefinition{AttributeName: aws.String(gsi.RangeKeyField),
+				AttributeType: gsi.RangeKeyType})
+	}
+	ttl := &types.TimeToLiveDescription{AttributeName: aws.String(table.TtlFieldName),
+		TimeToLiveStatus: types.TimeToLiveStatusEnabled}
+
+	var changes []string
+	for _, c := range table.Diff(table.Name, desc, ttl) {
+		changes = append(changes, c.String())
+	}
+	assert.ElementsMatch(t, []string{
+		"replace_gsi span/by-time-v1: replaces by-time",
+		"create_gsi span/by-operation",
+		"create_gsi span/by-error",
+		"delete_gsi span/by-duration (destructive)",
+	}, changes)
+}
@@ -0,0 +1,270 @@
+package spanstore
+
+import (
+	"context"
+	"fmt"
+	. "github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.uber.org/zap"
+	"strconv"
+)
+
+type MigrationStats struct {
+	SpansScanned      int64
+	SpansMigrated     int64
+	SummariesScanned  int64
+	SummariesMigrated int64
+}
+
+// IdMigrator rewrites the items that have IDs in the legacy encoding into the
+// canonical one
+type IdMigrator struct {
+	client *dynamodb.Client
+	suffix string
+	dryRun bool
+}
+
+func NewIdMigrator(client *dynamodb.Client, suffix string, dryRun bool) *IdMigrator {
+	return &IdMigrator{
+		client: client,
+		suffix: suffix,
+		dryRun: dryRun,
+	}
+}
+
+func (m *IdMigrator) Migrate(ctx context.Context) (*MigrationStats, error) {
+	stats := &MigrationStats{}
+
+	err := m.migrateSpans(ctx, stats)
+	if err != nil {
+		return stats, err
+	}
+	err = m.migrateSummaries(ctx, stats)
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// migrateSpans moves the spans to their canonical keys, the segment ID includes
+// the trace and span IDs, so the item is re-created and the old one is deleted
+func (m *IdMigrator) migrateSpans(ctx context.Context, stats *MigrationStats) error {
+	tableName := aws.String(SpanTableName + m.suffix)
+	paginator := dynamodb.NewScanPaginator(m.client, &dynamodb.ScanInput{TableName: tableName})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to scan the spans: %w", err)
+		}
+
+		for _, item := range page.Items {
+			stats.SpansScanned++
+
+			var stored StoredSpan
+			err = attributevalue.UnmarshalMap(item, &stored)
+			if err != nil {
+				return err
+			}
+			if isCanonicalSpan(&stored) {
+				continue
+			}
+
+			oldSegmentId := stored.SegmentId
+			err = canonicalizeSpan(&stored)
+			if err != nil {
+				L(ctx).Warn("Failed to parse the span IDs, skipping it", zap.Error(err),
+					zap.String("segment-id", oldSegmentId))
+				continue
+			}
+			stats.SpansMigrated++
+
+			L(ctx).Debug("Migrating the span", zap.String("old-segment-id", oldSegmentId),
+				zap.String("segment-id", stored.SegmentId))
+			if m.dryRun {
+				continue
+			}
+
+			canonical, err := attributevalue.MarshalMap(&stored)
+			if err != nil {
+				return err
+			}
+			// Keep the attributes that are not in the model (e.g. TTL) as they are
+			for _, k := range []string{"trace_id", "span_id", "segment_id", "references"} {
+				if v, ok := canonical[k]; ok {
+					item[k] = v
+				}
+			}
+
+			_, err = m.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: tableName, Item: item})
+			if err != nil {
+				return fmt.Errorf("failed to write the migrated span: %w", err)
+			}
+			if oldSegmentId != stored.SegmentId {
+				_, err = m.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+					TableName: tableName,
+					Key: map[string]types.AttributeValue{
+						"service_and_time": &types.AttributeValueMemberS{Value: stored.ServiceAndTime},
+						"segment_id":       &types.AttributeValueMemberS{Value: oldSegmentId},
+					},
+				})
+				if err != nil {
+					return fmt.Errorf("failed to delete the legacy span: %w", err)
+				}
+			}
+		}
+
+		L(ctx).Info("Migrated a page of spans", zap.Int64("scanned", stats.SpansScanned),
+			zap.Int64("migrated", stats.SpansMigrated))
+	}
+
+	return nil
+}
+
+// migrateSummaries moves the summary records to their canonical keys. The spans
+// written after the switch to the canonical IDs might have already created the
+// canonical record, in this case both records are merged.
+func (m *IdMigrator) migrateSummaries(ctx context.Context, stats *MigrationStats) error {
+	tableName := aws.String(TraceTableName + m.suffix)
+	paginator := dynamodb.NewScanPaginator(m.client, &dynamodb.ScanInput{TableName: tableName})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to scan the trace summaries: %w", err)
+		}
+
+		for _, item := range page.Items {
+			stats.SummariesScanned++
+
+			var record StoredTraceSummary
+			err = attributevalue.UnmarshalMap(item, &record)
+			if err != nil {
+				return err
+			}
+			if len(record.TraceId) == canonicalTraceIdLen {
+				continue
+			}
+
+			tid, err := parseTraceId(record.TraceId)
+			if err != nil {
+				L(ctx).Warn("Failed to parse the trace ID, skipping it", zap.Error(err),
+					zap.String("trace-id", record.TraceId))
+				continue
+			}
+			stats.SummariesMigrated++
+			if m.dryRun {
+				continue
+			}
+
+			err = m.mergeSummary(ctx, tableName, item, record, formatTraceId(tid))
+			if err != nil {
+				return err
+			}
+		}
+
+		L(ctx).Info("Migrated a page of trace summaries", zap.Int64("scanned", stats.SummariesScanned),
+			zap.Int64("migrated", stats.SummariesMigrated))
+	}
+
+	return nil
+}
+
+func (m *IdMigrator) mergeSummary(ctx context.Context, tableName *string,
+	item map[string]types.AttributeValue, legacy StoredTraceSummary, canonicalId string) error {
+
+	existing, err := m.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      tableName,
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]types.AttributeValue{
+			"trace_id": &types.AttributeValueMemberS{Value: canonicalId},
+			"service":  &types.AttributeValueMemberS{Value: legacy.Service},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read the canonical trace summary: %w", err)
+	}
+
+	merged := legacy
+	merged.TraceId = canonicalId
+	if existing.Item != nil {
+		var current StoredTraceSummary
+		err = attributevalue.UnmarshalMap(existing.Item, &current)
+		if err != nil {
+			return err
+		}
+		merged = mergeSummaryRecords(merged, current)
+		if readTtl(existing.Item) > readTtl(item) {
+			item["ttl"] = existing.Item["ttl"]
+		}
+	}
+
+	mergedItem, err := attributevalue.MarshalMap(&merged)
+	if err != nil {
+		return err
+	}
+	if ttl, ok := item["ttl"]; ok {
+		mergedItem["ttl"] = ttl
+	}
+
+	_, err = m.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: tableName, Item: mergedItem})
+	if err != nil {
+		return fmt.Errorf("failed to write the migrated trace summary: %w", err)
+	}
+
+	_, err = m.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: tableName,
+		Key: map[string]types.AttributeValue{
+			"trace_id": &types.AttributeValueMemberS{Value: legacy.TraceId},
+			"service":  &types.AttributeValueMemberS{Value: legacy.Service},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete the legacy trace summary: %w", err)
+	}
+
+	return nil
+}
+
+func readTtl(item map[string]types.AttributeValue) int64 {
+	ttl, ok := item["ttl"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0
+	}
+	res, _ := strconv.ParseInt(ttl.Value, 10, 64)
+	return res
+}
+
+// mergeSummaryRecords combines two summary records of the same trace and service
+func mergeSummaryRecords(a, b StoredTraceSummary) StoredTraceSummary {
+	res := a
+	if b.StartTime != 0 && (res.StartTime == 0 || b.StartTime < res.StartTime) {
+		res.StartTime = b.StartTime
+		res.ServiceAndTime = b.ServiceAndTime
+	}
+	if b.EndTime > res.EndTime {
+		res.EndTime = b.EndTime
+	}
+	if b.RootOperation != "" {
+		res.RootOperation = b.RootOperation
+	}
+	res.SpanCount += b.SpanCount
+	res.HasError = res.HasError || b.HasError
+
+	ops := map[string]bool{}
+	res.Operations = append([]string{}, a.Operations...)
+	for _, o := range a.Operations {
+		ops[o] = true
+	}
+	for _, o := range b.Operations {
+		if !ops[o] {
+			res.Operations = append(res.Operations, o)
+			ops[o] = true
+		}
+	}
+	return res
+}
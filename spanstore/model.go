@@ -3,17 +3,49 @@ package spanstore
 import (
 	"context"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	. "github.com/Cyberax/argus-vision/visibility/logging"
 	"github.com/SimplestCloud/jaeger-ddb-spanstore/schemer"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/jaegertracing/jaeger/model"
+	"math"
+	"regexp"
+	"strconv"
 	"time"
 )
 
 const SpanTableName = "span"
 const ServiceTableName = "service"
+const TraceTableName = "trace"
+const DependencyTableName = "dependency"
+const ArchiveTableName = "archive"
+
+const byTimeIndex = "by-time"
+const byTraceIdIndex = "by-trace-id"
+const byServiceTimeIndex = "by-service-time"
+const byErrorIndex = "by-error"
+const byOperationIndex = "by-operation"
+
+const bucketFormat = "2006-01-02-15"
+
+// The magnitude limits of the DynamoDB numbers
+const maxDdbNumber = 1e125
+const minDdbNumber = 1e-129
+
+const canonicalTraceIdLen = 32
+const canonicalSpanIdLen = 16
+const errorTagName = "error"
+const statusCodeTagName = "otel.status_code"
+const statusCodeError = "ERROR"
+
+// The span attributes the search reads from the indexes besides their keys: the
+// trace ID and the attributes of the filters. The version 0 of "by-time" projected
+// all the attributes, the version 1 replaces it. The other search GSIs were created
+// with this projection, so they are not versioned.
+var searchAttributes = []string{"trace_id", "ttl", "flattened_tags", "numeric_tags"}
 
 var ddbTables = []schemer.Table{
 	{
@@ -24,19 +56,34 @@ var ddbTables = []schemer.Table{
 		TtlFieldName: "ttl",
 		GSIs: []schemer.GSI{
 			{
-				Name:            "by-time",
-				ProjectionField: "service_and_time",
-				RangeKeyField:   "start_time_nanos",
-				RangeKeyType:    types.ScalarAttributeTypeN,
+				Name:             byTimeIndex,
+				Version:          1,
+				ProjectionField:  "service_and_time",
+				RangeKeyField:    "start_time_nanos",
+				RangeKeyType:     types.ScalarAttributeTypeN,
+				ProjectionType:   types.ProjectionTypeInclude,
+				NonKeyAttributes: append(searchAttributes, "error_bucket"),
 			},
 			{
-				Name:            "by-duration",
-				ProjectionField: "service_and_time",
-				RangeKeyField:   "duration_nanos",
-				RangeKeyType:    types.ScalarAttributeTypeN,
+				Name:             byOperationIndex,
+				ProjectionField:  "operation_bucket",
+				RangeKeyField:    "start_time_nanos",
+				RangeKeyType:     types.ScalarAttributeTypeN,
+				ProjectionType:   types.ProjectionTypeInclude,
+				NonKeyAttributes: append(searchAttributes, "error_bucket"),
 			},
 			{
-				Name:            "by-trace-id",
+				// Sparse index, only the failed spans have the error bucket
+				Name:             byErrorIndex,
+				ProjectionField:  "error_bucket",
+				RangeKeyField:    "start_time_nanos",
+				RangeKeyType:     types.ScalarAttributeTypeN,
+				ProjectionType:   types.ProjectionTypeInclude,
+				NonKeyAttributes: searchAttributes,
+			},
+			{
+				// GetTrace reads the whole spans
+				Name:            byTraceIdIndex,
 				ProjectionField: "trace_id",
 				RangeKeyField:   "span_id",
 				RangeKeyType:    types.ScalarAttributeTypeS,
@@ -44,6 +91,26 @@ var ddbTables = []schemer.Table{
 		},
 	},
 	{
+		Name:         TraceTableName,
+		HashKeyName:  "trace_id",
+		RangeKeyName: "service",
+		RangeKeyType: types.ScalarAttributeTypeS,
+		TtlFieldName: "ttl",
+		GSIs: []schemer.GSI{
+			{
+				// The search only needs the trace IDs, which are the table's keys
+				Name:             byServiceTimeIndex,
+				ProjectionField:  "service_and_time",
+				RangeKeyField:    "start_time_nanos",
+				RangeKeyType:     types.ScalarAttributeTypeN,
+				ProjectionType:   types.ProjectionTypeInclude,
+				NonKeyAttributes: []string{"ttl"},
+			},
+		},
+	},
+	{
+		// The service catalog is read by every search form and is tiny, Standard-IA
+		// would only raise its request cost
 		Name:         ServiceTableName,
 		HashKeyName:  "service",
 		RangeKeyName: "operation",
@@ -51,19 +118,51 @@ var ddbTables = []schemer.Table{
 		TtlFieldName: "ttl",
 	},
 	{
-		Name:         "dependency",
+		Name:         ActivityTableName,
+		HashKeyName:  "service",
+		RangeKeyName: "day",
+		RangeKeyType: types.ScalarAttributeTypeS,
+		TtlFieldName: "ttl",
+	},
+	{
+		// Only read when the dependency graph is opened, so the storage would dominate
+		// the cost. Nothing writes the dependencies yet, the class only pays off once
+		// they are rolled up into the table.
+		Name:         DependencyTableName,
 		HashKeyName:  "time_bucket",
 		RangeKeyName: "dependency",
 		RangeKeyType: types.ScalarAttributeTypeS,
 		TtlFieldName: "ttl",
+		TableClass:   types.TableClassStandardInfrequentAccess,
 	},
+	{
+		// The archived traces are kept for long and only read when one is opened
+		Name:         ArchiveTableName,
+		HashKeyName:  "trace_id",
+		RangeKeyName: "span_id",
+		RangeKeyType: types.ScalarAttributeTypeS,
+		TtlFieldName: "ttl",
+		TableClass:   types.TableClassStandardInfrequentAccess,
+	},
+}
+
+// Tables returns the schema of the store's tables
+func Tables(opts SchemaOptions) []schemer.Table {
+	res := append([]schemer.Table{}, ddbTables...)
+	for i := range res {
+		res[i].KmsKeyId = opts.KmsKeyId
+		res[i].PointInTimeRecovery = opts.PointInTimeRecovery
+		res[i].DeletionProtection = opts.DeletionProtection
+		res[i].Tags = opts.Tags
+	}
+	return res
 }
 
-func EnsureTablesAreReady(ctx context.Context, suffix string, config aws.Config) error {
+func EnsureTablesAreReady(ctx context.Context, suffix string, config aws.Config, opts SchemaOptions) error {
 	initializer := schemer.NewDynamoDbInitializer("", suffix, config)
 
 	L(ctx).Info("Ensuring tables are present")
-	err := initializer.InitSchema(ctx, ddbTables)
+	err := initializer.InitSchema(ctx, Tables(opts))
 	if err != nil {
 		return err
 	}
@@ -76,6 +175,18 @@ type StoredService struct {
 	Operation string `dynamodbav:"operation,omitempty"`
 }
 
+// StoredDependency counts the calls between two services within a day, the daily
+// records are summed up for the requested time range
+type StoredDependency struct {
+	// The day in the activityDayFormat
+	TimeBucket string `dynamodbav:"time_bucket,omitempty"`
+	// The "<parent>#<child>" key with the URL-escaped service names
+	Dependency string `dynamodbav:"dependency,omitempty"`
+	Parent     string `dynamodbav:"parent,omitempty"`
+	Child      string `dynamodbav:"child,omitempty"`
+	CallCount  uint64 `dynamodbav:"call_count,omitempty"`
+}
+
 // StoredSpanRef the stored version of model.SpanRef
 type StoredSpanRef struct {
 	TraceId string            `dynamodbav:"trace_id,omitempty"`
@@ -94,10 +205,38 @@ type StoredKeyValue struct {
 	VBinary  []byte          `dynamodbav:"v_binary,omitempty"`
 }
 
-// StoredLog the stored version of model.Log
+// StoredLog the stored version of model.Log, the OpenTelemetry event name is moved
+// out of the "event" field of the OpenTelemetry spans' logs
 type StoredLog struct {
 	Timestamp int64            `dynamodbav:"timestamp_nanos,omitempty"`
+	Name      string           `dynamodbav:"name,omitempty"`
 	Fields    []StoredKeyValue `dynamodbav:"fields,omitempty"`
+	// The position of the event name among the log fields
+	NamePosition int `dynamodbav:"name_position,omitempty"`
+}
+
+// StoredStatus the OpenTelemetry span status
+type StoredStatus struct {
+	Code        string `dynamodbav:"code,omitempty"`
+	Description string `dynamodbav:"description,omitempty"`
+}
+
+// StoredScope the OpenTelemetry instrumentation scope
+type StoredScope struct {
+	Name    string `dynamodbav:"name,omitempty"`
+	Version string `dynamodbav:"version,omitempty"`
+	// The scope came in the "otel.library.*" tags of the older SDKs
+	LibraryTags bool `dynamodbav:"library_tags,omitempty"`
+}
+
+// StoredLink the OpenTelemetry span link, Jaeger represents it as a FOLLOWS_FROM
+// reference
+type StoredLink struct {
+	TraceId string `dynamodbav:"trace_id,omitempty"`
+	SpanId  string `dynamodbav:"span_id,omitempty"`
+	// The position of the reference among the span references, the links without
+	// it are restored after the references
+	Position *int `dynamodbav:"position,omitempty"`
 }
 
 // StoredProcess the stored version of model.Process
@@ -114,6 +253,12 @@ type StoredSpan struct {
 	SegmentId string `dynamodbav:"segment_id,omitempty"`
 	// Tags for searching
 	FlattenedTags map[string]string `dynamodbav:"flattened_tags,omitempty"`
+	// Numeric tags for searching with comparisons, they are stored as DynamoDB numbers
+	NumericTags map[string]attributevalue.Number `dynamodbav:"numeric_tags,omitempty"`
+	// The copy of the bucket key, set only for the failed spans
+	ErrorBucket string `dynamodbav:"error_bucket,omitempty"`
+	// The bucket key of the operation index
+	OperationBucket string `dynamodbav:"operation_bucket,omitempty"`
 
 	TraceId       string           `dynamodbav:"trace_id,omitempty"`
 	SpanId        string           `dynamodbav:"span_id,omitempty"`
@@ -127,44 +272,173 @@ type StoredSpan struct {
 	Process       *StoredProcess   `dynamodbav:"process,omitempty"`
 	ProcessId     string           `dynamodbav:"process_id,omitempty"`
 	Warnings      []string         `dynamodbav:"warnings,omitempty"`
+
+	// The hash of the process, if it's stored in the per-trace process record
+	ProcessHash string `dynamodbav:"process_hash,omitempty"`
+
+	// OpenTelemetry data, it's moved out of the well-known tags and references
+	Status *StoredStatus `dynamodbav:"status,omitempty"`
+	Scope  *StoredScope  `dynamodbav:"scope,omitempty"`
+	Links  []StoredLink  `dynamodbav:"links,omitempty"`
+	// The positions of the tags that were moved into the OpenTelemetry fields,
+	// the tags without the position are restored after the other tags
+	OtelTagPositions map[string]int `dynamodbav:"otel_tag_positions,omitempty"`
 }
 
-func ToDdbModel(span *model.Span) (*StoredSpan, error) {
+// ToDdbModel converts the span into its stored form, the indexer selects the tags
+// that can be searched for. The nil indexer makes all the tags searchable.
+func ToDdbModel(span *model.Span, indexer *TagIndexer) (*StoredSpan, error) {
 	res := &StoredSpan{}
 
 	res.TraceId = formatTraceId(span.TraceID)
 	res.SpanId = formatSpanId(span.SpanID)
 	res.OperationName = span.OperationName
-	res.References = translateReferences(span.References)
 	res.Flags = span.Flags
 	res.StartTime = span.StartTime.UnixNano()
 	res.Duration = span.Duration
-	res.Tags = translateTags(span.Tags)
-	res.Logs = translateLogs(span.Logs)
+	tags, references := extractOtelSemantics(span, res)
+	res.References = translateReferences(references)
+	res.Tags = translateTags(tags)
+	res.Logs = translateLogs(span.Logs, isOtelSpan(span))
 	res.Process = translateProcess(span.Process)
 	res.ProcessId = span.ProcessID
 	res.Warnings = span.Warnings
 
-	// We bucket by every hour to ensure sharing
-	timeBucket := span.StartTime.UTC().Format("2006-01-02-15")
-	res.ServiceAndTime = span.Process.ServiceName + "-" + timeBucket
+	res.ServiceAndTime = serviceBucket(span.Process.ServiceName, span.StartTime)
 	res.SegmentId = res.TraceId + "-" + res.SpanId
+	res.OperationBucket = operationBucket(span.Process.ServiceName, span.OperationName, span.StartTime)
+	if isErrorSpan(span) {
+		res.ErrorBucket = res.ServiceAndTime
+	}
 
 	res.FlattenedTags = map[string]string{}
-	flattenTags(span.Tags, res.FlattenedTags)
-	flattenTags(span.Process.Tags, res.FlattenedTags)
+	res.NumericTags = map[string]attributevalue.Number{}
+	indexer.flattenTags(span.Process.ServiceName, span.Tags, res.FlattenedTags, res.NumericTags)
+	indexer.flattenTags(span.Process.ServiceName, span.Process.Tags, res.FlattenedTags, res.NumericTags)
 
 	return res, nil
 }
 
+// serviceBucket creates the partition key for the service and the time. We bucket
+// by every hour to ensure sharding.
+func serviceBucket(service string, tm time.Time) string {
+	return service + "-" + tm.UTC().Format(bucketFormat)
+}
+
+func operationBucket(service, operation string, tm time.Time) string {
+	return service + "#" + operation + "#" + tm.UTC().Format(bucketFormat)
+}
+
+// timeBuckets lists the hourly buckets between minTime and maxTime (inclusive),
+// the most recent bucket goes first.
+func timeBuckets(minTime, maxTime time.Time) []time.Time {
+	var res []time.Time
+	first := minTime.UTC().Truncate(time.Hour)
+	for cur := maxTime.UTC().Truncate(time.Hour); !cur.Before(first); cur = cur.Add(-time.Hour) {
+		res = append(res, cur)
+	}
+	return res
+}
+
+// isRootSpan checks if the span has no parent within its own trace
+func isRootSpan(span *model.Span) bool {
+	return span.ParentSpanID() == 0
+}
+
+// isErrorSpan checks if the span is marked with the "error" tag or has the
+// error status
+func isErrorSpan(span *model.Span) bool {
+	for _, t := range span.Tags {
+		switch t.Key {
+		case errorTagName:
+			if (t.VType == model.ValueType_BOOL && t.VBool) ||
+				(t.VType == model.ValueType_STRING && t.VStr == "true") {
+				return true
+			}
+		case statusCodeTagName:
+			if t.VType == model.ValueType_STRING && t.VStr == statusCodeError {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// formatSpanId is the canonical fixed-width encoding of the span IDs
 func formatSpanId(sid model.SpanID) string {
-	return fmt.Sprintf("%x", uint64(sid))
+	return fmt.Sprintf("%016x", uint64(sid))
 }
 
+// formatTraceId is the canonical fixed-width encoding of the trace IDs, it's the
+// same as the one used by the Jaeger UI
 func formatTraceId(tid model.TraceID) string {
+	return fmt.Sprintf("%016x%016x", tid.High, tid.Low)
+}
+
+// formatLegacyTraceId is the unpadded encoding of the trace IDs that was used before
+// the switch to the canonical one. It's ambiguous, different IDs can be encoded
+// into the same string.
+func formatLegacyTraceId(tid model.TraceID) string {
 	return fmt.Sprintf("%x%x", tid.High, tid.Low)
 }
 
+// isCanonicalSpan checks if all the span's IDs are in the canonical encoding
+func isCanonicalSpan(stored *StoredSpan) bool {
+	if len(stored.TraceId) != canonicalTraceIdLen {
+		return false
+	}
+	// The process records have only the trace ID
+	if isProcessRecord(stored) {
+		return true
+	}
+	if len(stored.SpanId) != canonicalSpanIdLen {
+		return false
+	}
+	for _, r := range stored.References {
+		if len(r.TraceId) != canonicalTraceIdLen || len(r.SpanId) != canonicalSpanIdLen {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalizeSpan converts the span's (or the process record's) IDs into the
+// canonical encoding
+func canonicalizeSpan(stored *StoredSpan) error {
+	traceId, err := parseTraceId(stored.TraceId)
+	if err != nil {
+		return err
+	}
+	stored.TraceId = formatTraceId(traceId)
+	if isProcessRecord(stored) {
+		stored.SegmentId = stored.TraceId + "-" + stored.SpanId
+		return nil
+	}
+
+	spanId, err := parseSpanId(stored.SpanId)
+	if err != nil {
+		return err
+	}
+	stored.SpanId = formatSpanId(spanId)
+	stored.SegmentId = stored.TraceId + "-" + stored.SpanId
+
+	for i := range stored.References {
+		ref := &stored.References[i]
+		refTraceId, err := parseTraceId(ref.TraceId)
+		if err != nil {
+			return err
+		}
+		refSpanId, err := parseSpanId(ref.SpanId)
+		if err != nil {
+			return err
+		}
+		ref.TraceId = formatTraceId(refTraceId)
+		ref.SpanId = formatSpanId(refSpanId)
+	}
+
+	return nil
+}
+
 func translateProcess(process *model.Process) *StoredProcess {
 	return &StoredProcess{
 		ServiceName: process.ServiceName,
@@ -177,41 +451,80 @@ func translateReferences(references []model.SpanRef) []StoredSpanRef {
 	for _, r := range references {
 		res = append(res, StoredSpanRef{
 			TraceId: formatTraceId(r.TraceID),
-			SpanId:  fmt.Sprintf("%x", r.SpanID),
+			SpanId:  formatSpanId(r.SpanID),
 			RefType: r.RefType,
 		})
 	}
 	return res
 }
 
-func translateLogs(logs []model.Log) []StoredLog {
+func translateLogs(logs []model.Log, otel bool) []StoredLog {
 	var res []StoredLog
 	for _, l := range logs {
+		name, position, fields := "", 0, l.Fields
+		if otel {
+			name, position, fields = extractEventName(l.Fields)
+		}
 		res = append(res, StoredLog{
-			Timestamp: l.Timestamp.UnixNano(),
-			Fields:    translateTags(l.Fields),
+			Timestamp:    l.Timestamp.UnixNano(),
+			Name:         name,
+			Fields:       translateTags(fields),
+			NamePosition: position,
 		})
 	}
 	return res
 }
 
-func flattenTags(tags []model.KeyValue, res map[string]string) {
-	for _, t := range tags {
-		switch t.VType {
-		case model.ValueType_STRING:
-			res[t.Key] = t.VStr
-		case model.ValueType_BOOL:
-			res[t.Key] = fmt.Sprintf("%t", t.VBool)
-		case model.ValueType_INT64:
-			res[t.Key] = fmt.Sprintf("%d", t.VInt64)
-		case model.ValueType_FLOAT64:
-			res[t.Key] = fmt.Sprintf("%f", t.VFloat64)
-		case model.ValueType_BINARY:
-			res[t.Key] = base64.StdEncoding.EncodeToString(t.VBinary)
+func flattenValue(t model.KeyValue) string {
+	switch t.VType {
+	case model.ValueType_BOOL:
+		return fmt.Sprintf("%t", t.VBool)
+	case model.ValueType_INT64:
+		return fmt.Sprintf("%d", t.VInt64)
+	case model.ValueType_FLOAT64:
+		return strconv.FormatFloat(t.VFloat64, 'g', -1, 64)
+	case model.ValueType_BINARY:
+		return base64.StdEncoding.EncodeToString(t.VBinary)
+	default:
+		return t.VStr
+	}
+}
+
+// decimalNumber matches the strings that are plain decimal numbers, ParseFloat also
+// takes the hex numbers, "Inf" and "NaN"
+var decimalNumber = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?$`)
+
+// numericValue converts the numeric tag (or the string tag that has a number in it,
+// as many instrumentations record the numbers as strings) into the DynamoDB number,
+// if it can be represented by it
+func numericValue(t model.KeyValue) (attributevalue.Number, bool) {
+	switch t.VType {
+	case model.ValueType_INT64:
+		return attributevalue.Number(strconv.FormatInt(t.VInt64, 10)), true
+	case model.ValueType_FLOAT64:
+		return floatNumber(t.VFloat64)
+	case model.ValueType_STRING:
+		if !decimalNumber.MatchString(t.VStr) {
+			return "", false
 		}
+		f, err := strconv.ParseFloat(t.VStr, 64)
+		if err != nil {
+			return "", false
+		}
+		return floatNumber(f)
+	default:
+		return "", false
 	}
 }
 
+func floatNumber(f float64) (attributevalue.Number, bool) {
+	v := math.Abs(f)
+	if math.IsNaN(v) || v >= maxDdbNumber || (v != 0 && v < minDdbNumber) {
+		return "", false
+	}
+	return attributevalue.Number(strconv.FormatFloat(f, 'g', -1, 64)), true
+}
+
 func translateTags(tags []model.KeyValue) []StoredKeyValue {
 	var res []StoredKeyValue
 	for _, t := range tags {
@@ -227,3 +540,126 @@ func translateTags(tags []model.KeyValue) []StoredKeyValue {
 	}
 	return res
 }
+
+// FromDdbModel converts the stored span back into its model.Span form
+func FromDdbModel(stored *StoredSpan) (*model.Span, error) {
+	traceId, err := parseTraceId(stored.TraceId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the trace ID: %w", err)
+	}
+	spanId, err := parseSpanId(stored.SpanId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the span ID: %w", err)
+	}
+	references, err := restoreReferences(stored.References)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &model.Span{
+		TraceID:       traceId,
+		SpanID:        spanId,
+		OperationName: stored.OperationName,
+		References:    references,
+		Flags:         stored.Flags,
+		StartTime:     time.Unix(0, stored.StartTime).UTC(),
+		Duration:      stored.Duration,
+		Tags:          restoreTags(stored.Tags),
+		Logs:          restoreLogs(stored.Logs),
+		Process:       restoreProcess(stored.Process),
+		ProcessID:     stored.ProcessId,
+		Warnings:      stored.Warnings,
+	}
+
+	err = restoreOtelSemantics(stored, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// parseTraceId parses both the canonical and the legacy trace IDs. The legacy
+// encoding is ambiguous unless the high part is zero, so for the legacy IDs we
+// assume that the low part has all 16 digits, which is true for 15/16 of
+// random IDs.
+func parseTraceId(tid string) (model.TraceID, error) {
+	if len(tid) != canonicalTraceIdLen && len(tid) > 1 && tid[0] == '0' {
+		// The high part of the legacy ID is zero, it's encoded as a single "0"
+		low, err := strconv.ParseUint(tid[1:], 16, 64)
+		if err != nil {
+			return model.TraceID{}, err
+		}
+		return model.NewTraceID(0, low), nil
+	}
+	return model.TraceIDFromString(tid)
+}
+
+// parseSpanId parses both the canonical and the legacy span IDs. The legacy
+// references have the span IDs as the hex dump of their text form.
+func parseSpanId(sid string) (model.SpanID, error) {
+	if len(sid) == 2*canonicalSpanIdLen {
+		decoded, err := hex.DecodeString(sid)
+		if err != nil {
+			return 0, err
+		}
+		sid = string(decoded)
+	}
+	return model.SpanIDFromString(sid)
+}
+
+func restoreProcess(process *StoredProcess) *model.Process {
+	if process == nil {
+		return &model.Process{}
+	}
+	return &model.Process{
+		ServiceName: process.ServiceName,
+		Tags:        restoreTags(process.Tags),
+	}
+}
+
+func restoreReferences(references []StoredSpanRef) ([]model.SpanRef, error) {
+	var res []model.SpanRef
+	for _, r := range references {
+		traceId, err := parseTraceId(r.TraceId)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the reference trace ID: %w", err)
+		}
+		spanId, err := parseSpanId(r.SpanId)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the reference span ID: %w", err)
+		}
+		res = append(res, model.SpanRef{
+			TraceID: traceId,
+			SpanID:  spanId,
+			RefType: r.RefType,
+		})
+	}
+	return res, nil
+}
+
+func restoreLogs(logs []StoredLog) []model.Log {
+	var res []model.Log
+	for _, l := range logs {
+		res = append(res, model.Log{
+			Timestamp: time.Unix(0, l.Timestamp).UTC(),
+			Fields:    restoreEventName(l.Name, l.NamePosition, restoreTags(l.Fields)),
+		})
+	}
+	return res
+}
+
+func restoreTags(tags []StoredKeyValue) []model.KeyValue {
+	var res []model.KeyValue
+	for _, t := range tags {
+		res = append(res, model.KeyValue{
+			Key:      t.Key,
+			VType:    t.VType,
+			VStr:     t.VStr,
+			VBool:    t.VBool,
+			VInt64:   t.VInt64,
+			VFloat64: t.VFloat64,
+			VBinary:  t.VBinary,
+		})
+	}
+	return res
+}
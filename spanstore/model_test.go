@@ -0,0 +1,393 @@
+package spanstore
+
+import (
+	"expvar"
+	"github.com/SimplestCloud/jaeger-ddb-spanstore/utils"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+	"time"
+)
+
+func makeTestSpan(traceId model.TraceID, spanId model.SpanID, service, operation string,
+	start time.Time, duration time.Duration, tags ...model.KeyValue) *model.Span {
+
+	return &model.Span{
+		TraceID:       traceId,
+		SpanID:        spanId,
+		OperationName: operation,
+		StartTime:     start,
+		Duration:      duration,
+		Tags:          tags,
+		Process: &model.Process{
+			ServiceName: service,
+			Tags:        []model.KeyValue{model.String("hostname", "host1")},
+		},
+	}
+}
+
+func TestModelRoundTrip(t *testing.T) {
+	start := time.Date(2023, 2, 10, 13, 45, 0, 0, time.UTC)
+	span := makeTestSpan(model.NewTraceID(0, 0x1234), 0x55, "svc", "op", start, time.Second,
+		model.String("str", "value"), model.Bool("error", true), model.Int64("int", 42),
+		model.Float64("float", 1.5), model.Binary("bin", []byte{1, 2, 3}))
+	span.References = []model.SpanRef{model.NewChildOfRef(span.TraceID, 0x11)}
+	span.Logs = []model.Log{{Timestamp: start, Fields: []model.KeyValue{model.String("event", "hi")}}}
+	span.Warnings = []string{"warning"}
+
+	stored, err := ToDdbModel(span, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "svc-2023-02-10-13", stored.ServiceAndTime)
+	assert.Equal(t, "svc#op#2023-02-10-13", stored.OperationBucket)
+	assert.Equal(t, "00000000000000000000000000001234-0000000000000055", stored.SegmentId)
+	assert.Equal(t, "0000000000000011", stored.References[0].SpanId)
+	assert.Equal(t, "value", stored.FlattenedTags["str"])
+	assert.Equal(t, "true", stored.FlattenedTags["error"])
+	assert.Equal(t, "host1", stored.FlattenedTags["hostname"])
+
+	restored, err := FromDdbModel(stored)
+	require.NoError(t, err)
+	assert.Equal(t, span, restored)
+}
+
+func TestRootAndErrorSpans(t *testing.T) {
+	tid := model.NewTraceID(0, 0x1234)
+	root := makeTestSpan(tid, 1, "svc", "op", time.Now(), time.Second)
+	child := makeTestSpan(tid, 2, "svc", "op", time.Now(), time.Second, model.String("error", "true"))
+	child.References = []model.SpanRef{model.NewChildOfRef(tid, 1)}
+
+	assert.True(t, isRootSpan(root))
+	assert.False(t, isRootSpan(child))
+	assert.False(t, isErrorSpan(root))
+	assert.True(t, isErrorSpan(child))
+	assert.True(t, isErrorSpan(makeTestSpan(tid, 3, "svc", "op", time.Now(), time.Second,
+		model.String("otel.status_code", "ERROR"))))
+
+	// Only the failed spans get into the error index
+	stored, err := ToDdbModel(root, nil)
+	require.NoError(t, err)
+	assert.Empty(t, stored.ErrorBucket)
+	stored, err = ToDdbModel(child, nil)
+	require.NoError(t, err)
+	assert.Equal(t, stored.ServiceAndTime, stored.ErrorBucket)
+}
+
+func TestTimeBuckets(t *testing.T) {
+	minTime := time.Date(2023, 2, 10, 13, 45, 0, 0, time.UTC)
+	buckets := timeBuckets(minTime, minTime.Add(2*time.Hour))
+	assert.Equal(t, []time.Time{
+		time.Date(2023, 2, 10, 15, 0, 0, 0, time.UTC),
+		time.Date(2023, 2, 10, 14, 0, 0, 0, time.UTC),
+		time.Date(2023, 2, 10, 13, 0, 0, 0, time.UTC),
+	}, buckets)
+}
+
+func TestMergeSummaries(t *testing.T) {
+	summary := mergeSummaries("abc", []StoredTraceSummary{
+		{Service: "api", RootOperation: "GET /", Operations: []string{"GET /"},
+			StartTime: 100, EndTime: 500, SpanCount: 2},
+		{Service: "db", Operations: []string{"query"},
+			StartTime: 150, EndTime: 700, SpanCount: 3, HasError: true},
+	})
+
+	assert.Equal(t, "api", summary.RootService)
+	assert.Equal(t, "GET /", summary.RootOperation)
+	assert.Equal(t, int64(100), summary.StartTime)
+	assert.Equal(t, int64(700), summary.EndTime)
+	assert.Equal(t, time.Duration(600), summary.Duration())
+	assert.Equal(t, int64(5), summary.SpanCount)
+	assert.True(t, summary.HasError)
+	assert.Equal(t, []string{"api", "db"}, summary.ServiceNames())
+}
+
+func TestTagIndexing(t *testing.T) {
+	indexer, err := NewTagIndexer(&TagIndexingConfig{
+		TagIndexingRules: TagIndexingRules{
+			Deny:           []string{"db.statement", "*.stack"},
+			MaxValueLength: 10,
+		},
+		Services: map[string]TagIndexingRules{
+			"api": {Allow: []string{"http.*"}, Deny: []string{"http.url"}},
+		},
+	}, utils.NewExpvarFactory("test_tag_indexing"))
+	require.NoError(t, err)
+
+	tags := []model.KeyValue{
+		model.String("db.statement", "SELECT 1"),
+		model.String("error.stack", "trace"),
+		model.String("http.method", "GET"),
+		model.String("http.url", "/"),
+		model.String("user", "a-very-long-user-name"),
+		model.Int64("rows", 10),
+		model.String("aws/lambda.stack", "trace"),
+	}
+
+	res, numeric := map[string]string{}, map[string]attributevalue.Number{}
+	indexer.flattenTags("db", tags, res, numeric)
+	assert.Equal(t, map[string]string{"http.method": "GET", "http.url": "/", "rows": "10"}, res)
+	assert.Equal(t, map[string]attributevalue.Number{"rows": "10"}, numeric)
+
+	res, numeric = map[string]string{}, map[string]attributevalue.Number{}
+	indexer.flattenTags("api", tags, res, numeric)
+	assert.Equal(t, map[string]string{"http.method": "GET"}, res)
+	assert.Empty(t, numeric)
+
+	assert.Equal(t, "9", expvar.Get("test_tag_indexing.tags_dropped_from_index|reason=denied").String())
+	assert.Equal(t, "1", expvar.Get("test_tag_indexing.tags_dropped_from_index|reason=too_long").String())
+
+	// The patterns match the keys with "/" as a whole
+	assert.True(t, globMatch("k8s.*", "k8s.pod/name"))
+	assert.True(t, globMatch("*/name", "k8s.pod/name"))
+	assert.True(t, globMatch("k8s.pod?name", "k8s.pod/name"))
+	assert.False(t, globMatch("k8s.*", "aws/k8s.pod"))
+
+	_, err = NewTagIndexer(&TagIndexingConfig{TagIndexingRules: TagIndexingRules{Deny: []string{"["}}},
+		utils.NewExpvarFactory("test_bad_tag_indexing"))
+	assert.Error(t, err)
+}
+
+func TestNumericTags(t *testing.T) {
+	span := makeTestSpan(model.NewTraceID(1, 2), 3, "db", "query", time.Now(), time.Second,
+		model.Int64("db.rows", 1500), model.Float64("db.load", 0.25),
+		model.Float64("db.bad", math.NaN()), model.String("db.name", "users"),
+		model.String("http.status_code", "503"), model.String("db.cost", "-1.5e3"),
+		model.String("db.hex", "0x10"), model.String("db.inf", "Inf"))
+	stored, err := ToDdbModel(span, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]attributevalue.Number{"db.rows": "1500", "db.load": "0.25",
+		"http.status_code": "503", "db.cost": "-1500"}, stored.NumericTags)
+	assert.Equal(t, "0.25", stored.FlattenedTags["db.load"])
+
+	// The values that are too long are not indexed at all
+	indexer, err := NewTagIndexer(&TagIndexingConfig{TagIndexingRules: TagIndexingRules{MaxValueLength: 4}},
+		utils.NewExpvarFactory("test_numeric_tags"))
+	require.NoError(t, err)
+	stored, err = ToDdbModel(span, indexer)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]attributevalue.Number{"db.rows": "1500", "db.load": "0.25",
+		"http.status_code": "503"}, stored.NumericTags)
+
+	for _, c := range []struct {
+		key, value string
+		expected   *tagPredicate
+	}{
+		{"http.status_code>", "500", &tagPredicate{Key: "http.status_code", Op: ">=", Value: "500"}},
+		{"http.status_code!", "200", &tagPredicate{Key: "http.status_code", Op: "<>", Value: "200"}},
+		{"db.rows>1000", "", &tagPredicate{Key: "db.rows", Op: ">", Value: "1000"}},
+		{"db.rows<-1.5", "true", &tagPredicate{Key: "db.rows", Op: "<", Value: "-1.5"}},
+		{"db.rows<=10", "", &tagPredicate{Key: "db.rows", Op: "<=", Value: "10"}},
+		{"http.status_code", "500", nil},
+		{"http.url>", "/index", nil},
+		{"a>b", "", nil},
+		{">10", "", nil},
+	} {
+		pred, ok := parseTagPredicate(c.key, c.value)
+		assert.Equal(t, c.expected != nil, ok, c.key)
+		assert.Equal(t, c.expected, pred, c.key)
+	}
+}
+
+func TestIdEncoding(t *testing.T) {
+	// These IDs used to collide in the legacy encoding
+	first, second := model.NewTraceID(0x1, 0x23), model.NewTraceID(0x12, 0x3)
+	assert.Equal(t, formatLegacyTraceId(first), formatLegacyTraceId(second))
+	assert.NotEqual(t, formatTraceId(first), formatTraceId(second))
+	assert.Equal(t, first.String(), formatTraceId(first))
+
+	for _, tid := range []model.TraceID{first, model.NewTraceID(0, 0x1234),
+		model.NewTraceID(0x1234, 0xabcdef0123456789)} {
+		parsed, err := parseTraceId(formatTraceId(tid))
+		require.NoError(t, err)
+		assert.Equal(t, tid, parsed)
+	}
+
+	// The unambiguous legacy IDs
+	parsed, err := parseTraceId(formatLegacyTraceId(model.NewTraceID(0, 0x1234)))
+	require.NoError(t, err)
+	assert.Equal(t, model.NewTraceID(0, 0x1234), parsed)
+	parsed, err = parseTraceId(formatLegacyTraceId(model.NewTraceID(0x12, 0xabcdef0123456789)))
+	require.NoError(t, err)
+	assert.Equal(t, model.NewTraceID(0x12, 0xabcdef0123456789), parsed)
+
+	// The legacy references had the hex dump of the span ID text
+	sid, err := parseSpanId("30303030303030303030303030303131")
+	require.NoError(t, err)
+	assert.Equal(t, model.SpanID(0x11), sid)
+	sid, err = parseSpanId("11")
+	require.NoError(t, err)
+	assert.Equal(t, model.SpanID(0x11), sid)
+
+	legacy := &StoredSpan{
+		TraceId:    "01234",
+		SpanId:     "55",
+		SegmentId:  "01234-55",
+		References: []StoredSpanRef{{TraceId: "01234", SpanId: "30303030303030303030303030303131"}},
+	}
+	assert.False(t, isCanonicalSpan(legacy))
+	require.NoError(t, canonicalizeSpan(legacy))
+	assert.True(t, isCanonicalSpan(legacy))
+	assert.Equal(t, "00000000000000000000000000001234-0000000000000055", legacy.SegmentId)
+	assert.Equal(t, "0000000000000011", legacy.References[0].SpanId)
+
+	// The process records are migrated as well, they have no span ID to convert
+	record := &StoredSpan{TraceId: "01234", SpanId: "p-0123456789abcdef", SegmentId: "01234-p-0123456789abcdef"}
+	assert.False(t, isCanonicalSpan(record))
+	require.NoError(t, canonicalizeSpan(record))
+	assert.True(t, isCanonicalSpan(record))
+	assert.Equal(t, "00000000000000000000000000001234-p-0123456789abcdef", record.SegmentId)
+}
+
+func TestOtelRoundTrip(t *testing.T) {
+	tid := model.NewTraceID(0x1, 0x2)
+	span := makeTestSpan(tid, 0x55, "svc", "op", time.Now().UTC(), time.Second,
+		model.String("http.method", "GET"),
+		model.String("otel.status_code", "ERROR"),
+		model.String("otel.status_description", "timeout"),
+		model.String("otel.scope.name", "io.opentelemetry.http"),
+		model.String("otel.scope.version", "1.2.3"))
+	span.References = []model.SpanRef{
+		model.NewChildOfRef(tid, 0x11),
+		model.NewFollowsFromRef(model.NewTraceID(0x3, 0x4), 0x77),
+	}
+	span.Logs = []model.Log{{Timestamp: span.StartTime, Fields: []model.KeyValue{
+		model.String("event", "exception"), model.String("exception.type", "IOError")}}}
+
+	stored, err := ToDdbModel(span, nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, []StoredKeyValue{{Key: "http.method", VStr: "GET"}}, stored.Tags)
+	assert.Equal(t, &StoredStatus{Code: "ERROR", Description: "timeout"}, stored.Status)
+	assert.Equal(t, &StoredScope{Name: "io.opentelemetry.http", Version: "1.2.3"}, stored.Scope)
+	assert.Equal(t, 1, len(stored.References))
+	position := 1
+	assert.Equal(t, []StoredLink{{
+		TraceId:  "00000000000000030000000000000004",
+		SpanId:   "0000000000000077",
+		Position: &position,
+	}}, stored.Links)
+	assert.Equal(t, "exception", stored.Logs[0].Name)
+	assert.Equal(t, 1, len(stored.Logs[0].Fields))
+	// The well-known tags are still searchable
+	assert.Equal(t, "ERROR", stored.FlattenedTags["otel.status_code"])
+
+	restored, err := FromDdbModel(stored)
+	require.NoError(t, err)
+	assert.Equal(t, span, restored)
+
+	// The tags of the older SDKs are preserved as well
+	legacy := makeTestSpan(tid, 0x56, "svc", "op", time.Now().UTC(), time.Second,
+		model.String("otel.library.name", "lib"), model.String("otel.library.version", "0.1"))
+	stored, err = ToDdbModel(legacy, nil)
+	require.NoError(t, err)
+	assert.Empty(t, stored.Tags)
+	restored, err = FromDdbModel(stored)
+	require.NoError(t, err)
+	assert.Equal(t, legacy, restored)
+}
+
+func TestOtelRoundTripPositions(t *testing.T) {
+	tid := model.NewTraceID(0x1, 0x2)
+	linked := model.NewTraceID(0x3, 0x4)
+	span := makeTestSpan(tid, 0x55, "svc", "op", time.Now().UTC(), time.Second,
+		model.String("http.method", "GET"),
+		model.String("otel.scope.name", "io.opentelemetry.http"),
+		model.String("http.url", "/"),
+		model.String("otel.status_code", "ERROR"),
+		model.String("otel.status_description", ""),
+		model.Int64("http.status_code", 500))
+	span.References = []model.SpanRef{
+		model.NewFollowsFromRef(linked, 0x77),
+		model.NewFollowsFromRef(linked, 0x78),
+		model.NewChildOfRef(tid, 0x11),
+		model.NewFollowsFromRef(linked, 0x79),
+	}
+	span.Logs = []model.Log{{Timestamp: span.StartTime, Fields: []model.KeyValue{
+		model.String("exception.type", "IOError"), model.String("event", "exception"),
+		model.String("exception.message", "broken pipe")}}}
+
+	stored, err := ToDdbModel(span, nil)
+	require.NoError(t, err)
+
+	// All the FOLLOWS_FROM references are links, the empty description stays a tag
+	assert.Equal(t, 3, len(stored.Links))
+	assert.Equal(t, 1, len(stored.References))
+	assert.Equal(t, &StoredStatus{Code: "ERROR"}, stored.Status)
+	assert.Equal(t, 4, len(stored.Tags))
+	assert.Equal(t, "exception", stored.Logs[0].Name)
+
+	restored, err := FromDdbModel(stored)
+	require.NoError(t, err)
+	assert.Equal(t, span, restored)
+
+	// The repeated well-known tags are kept as they are
+	repeated := makeTestSpan(tid, 0x56, "svc", "op", time.Now().UTC(), time.Second,
+		model.String("otel.status_code", "ERROR"), model.String("otel.status_code", "OK"))
+	stored, err = ToDdbModel(repeated, nil)
+	require.NoError(t, err)
+	assert.Nil(t, stored.Status)
+	restored, err = FromDdbModel(stored)
+	require.NoError(t, err)
+	assert.Equal(t, repeated, restored)
+
+	// The "event" field of the logs of the other spans is not an event name
+	plain := makeTestSpan(tid, 0x58, "svc", "op", time.Now().UTC(), time.Second)
+	plain.Logs = []model.Log{{Timestamp: plain.StartTime, Fields: []model.KeyValue{
+		model.String("event", "cache miss"), model.String("key", "user:1")}}}
+	stored, err = ToDdbModel(plain, nil)
+	require.NoError(t, err)
+	assert.Empty(t, stored.Logs[0].Name)
+	assert.Equal(t, 2, len(stored.Logs[0].Fields))
+	restored, err = FromDdbModel(stored)
+	require.NoError(t, err)
+	assert.Equal(t, plain, restored)
+
+	// The spans stored without the positions get the OpenTelemetry data at the end
+	old := &StoredSpan{
+		TraceId:    formatTraceId(tid),
+		SpanId:     formatSpanId(0x57),
+		Tags:       []StoredKeyValue{{Key: "http.method", VStr: "GET"}},
+		References: []StoredSpanRef{{TraceId: formatTraceId(tid), SpanId: formatSpanId(0x11)}},
+		Status:     &StoredStatus{Code: "ERROR"},
+		Links:      []StoredLink{{TraceId: formatTraceId(linked), SpanId: formatSpanId(0x77)}},
+	}
+	restored, err = FromDdbModel(old)
+	require.NoError(t, err)
+	assert.Equal(t, []model.KeyValue{model.String("http.method", "GET"),
+		model.String("otel.status_code", "ERROR")}, restored.Tags)
+	assert.Equal(t, model.FollowsFrom, restored.References[1].RefType)
+}
+
+func TestProcessDedup(t *testing.T) {
+	tid := model.NewTraceID(0, 0x1234)
+	first := makeTestSpan(tid, 1, "svc", "op", time.Now().UTC(), time.Second)
+	second := makeTestSpan(tid, 2, "svc", "op", time.Now().UTC(), time.Second)
+
+	var stored []StoredSpan
+	var records []*StoredProcessRecord
+	for _, span := range []*model.Span{first, second} {
+		hash, err := processHash(span.Process)
+		require.NoError(t, err)
+		ddbModel, err := ToDdbModel(span, nil)
+		require.NoError(t, err)
+		records = append(records, detachProcess(ddbModel, hash))
+		assert.Equal(t, &StoredProcess{ServiceName: "svc"}, ddbModel.Process)
+		stored = append(stored, *ddbModel)
+	}
+
+	// Both spans have the same process record
+	assert.Equal(t, records[0], records[1])
+	assert.Equal(t, "host1", records[0].Process.Tags[0].VStr)
+
+	// The reader gets the record together with the spans
+	stored = append(stored, StoredSpan{
+		TraceId: records[0].TraceId,
+		SpanId:  records[0].SpanId,
+		Process: records[0].Process,
+	})
+	trace, err := assembleTrace(stored)
+	require.NoError(t, err)
+	assert.Equal(t, []*model.Span{first, second}, trace.Spans)
+}
@@ -0,0 +1,213 @@
+package spanstore
+
+import (
+	"fmt"
+	"github.com/jaegertracing/jaeger/model"
+	"sort"
+)
+
+// The well-known tags that the collector uses to carry the OpenTelemetry data
+// through the Jaeger model
+const (
+	otelStatusDescriptionTag = "otel.status_description"
+	otelScopeNameTag         = "otel.scope.name"
+	otelScopeVersionTag      = "otel.scope.version"
+	otelLibraryNameTag       = "otel.library.name"
+	otelLibraryVersionTag    = "otel.library.version"
+	// The OpenTelemetry event name is in this field of the Jaeger log
+	eventNameField = "event"
+)
+
+// isOtelSpan checks if the span comes from an OpenTelemetry SDK, the collector
+// tags such spans with their instrumentation scope
+func isOtelSpan(span *model.Span) bool {
+	return hasTag(span.Tags, otelScopeNameTag) || hasTag(span.Tags, otelLibraryNameTag)
+}
+
+// extractOtelSemantics moves the OpenTelemetry data from the span tags and the
+// references into the first-class fields of the stored span, remembering their
+// positions so that they can be put back where they were. It returns the remaining
+// tags and references. The links are the FOLLOWS_FROM references, that's how the
+// collector translates them (without their attributes).
+func extractOtelSemantics(span *model.Span, res *StoredSpan) ([]model.KeyValue, []model.SpanRef) {
+	positions := map[string]int{}
+
+	status := &StoredStatus{}
+	scope := &StoredScope{}
+	for i, t := range span.Tags {
+		// A repeated well-known tag can't be represented, keep the tags as they are
+		if _, ok := positions[t.Key]; ok {
+			return span.Tags, span.References
+		}
+
+		// Only the non-empty string values are well-known
+		if t.VType != model.ValueType_STRING || t.VStr == "" {
+			continue
+		}
+
+		switch t.Key {
+		case statusCodeTagName:
+			status.Code = t.VStr
+		case otelStatusDescriptionTag:
+			status.Description = t.VStr
+		case otelScopeNameTag:
+			scope.Name = t.VStr
+		case otelScopeVersionTag:
+			scope.Version = t.VStr
+		case otelLibraryNameTag:
+			scope.Name, scope.LibraryTags = t.VStr, true
+		case otelLibraryVersionTag:
+			scope.Version, scope.LibraryTags = t.VStr, true
+		default:
+			continue
+		}
+		positions[t.Key] = i
+	}
+
+	// Scope tags of both kinds can't be represented, keep them as they are
+	if scope.LibraryTags && (hasTag(span.Tags, otelScopeNameTag) || hasTag(span.Tags, otelScopeVersionTag)) {
+		return span.Tags, span.References
+	}
+
+	var references []model.SpanRef
+	for i, r := range span.References {
+		if r.RefType != model.FollowsFrom {
+			references = append(references, r)
+			continue
+		}
+		position := i
+		res.Links = append(res.Links, StoredLink{
+			TraceId:  formatTraceId(r.TraceID),
+			SpanId:   formatSpanId(r.SpanID),
+			Position: &position,
+		})
+	}
+
+	var tags []model.KeyValue
+	for _, t := range span.Tags {
+		if _, ok := positions[t.Key]; !ok {
+			tags = append(tags, t)
+		}
+	}
+
+	if *status != (StoredStatus{}) {
+		res.Status = status
+	}
+	if *scope != (StoredScope{}) {
+		res.Scope = scope
+	}
+	if len(positions) != 0 {
+		res.OtelTagPositions = positions
+	}
+	return tags, references
+}
+
+func hasTag(tags []model.KeyValue, key string) bool {
+	for _, t := range tags {
+		if t.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreOtelSemantics puts the OpenTelemetry data back into the well-known tags
+// and the references, at their original positions
+func restoreOtelSemantics(stored *StoredSpan, span *model.Span) error {
+	var tags []model.KeyValue
+	if stored.Status != nil {
+		if stored.Status.Code != "" {
+			tags = append(tags, model.String(statusCodeTagName, stored.Status.Code))
+		}
+		if stored.Status.Description != "" {
+			tags = append(tags, model.String(otelStatusDescriptionTag, stored.Status.Description))
+		}
+	}
+
+	if stored.Scope != nil {
+		nameTag, versionTag := otelScopeNameTag, otelScopeVersionTag
+		if stored.Scope.LibraryTags {
+			nameTag, versionTag = otelLibraryNameTag, otelLibraryVersionTag
+		}
+		if stored.Scope.Name != "" {
+			tags = append(tags, model.String(nameTag, stored.Scope.Name))
+		}
+		if stored.Scope.Version != "" {
+			tags = append(tags, model.String(versionTag, stored.Scope.Version))
+		}
+	}
+
+	var refs []positioned[model.SpanRef]
+	for _, l := range stored.Links {
+		traceId, err := parseTraceId(l.TraceId)
+		if err != nil {
+			return fmt.Errorf("failed to parse the link trace ID: %w", err)
+		}
+		spanId, err := parseSpanId(l.SpanId)
+		if err != nil {
+			return fmt.Errorf("failed to parse the link span ID: %w", err)
+		}
+		position := len(span.References) + len(stored.Links)
+		if l.Position != nil {
+			position = *l.Position
+		}
+		refs = append(refs, positioned[model.SpanRef]{model.NewFollowsFromRef(traceId, spanId), position})
+	}
+	span.References = insertAtPositions(span.References, refs)
+
+	var positionedTags []positioned[model.KeyValue]
+	for _, t := range tags {
+		position, ok := stored.OtelTagPositions[t.Key]
+		if !ok {
+			position = len(span.Tags) + len(tags)
+		}
+		positionedTags = append(positionedTags, positioned[model.KeyValue]{t, position})
+	}
+	span.Tags = insertAtPositions(span.Tags, positionedTags)
+
+	return nil
+}
+
+type positioned[T any] struct {
+	item     T
+	position int
+}
+
+// insertAtPositions puts the items back into the list they were taken out of, the
+// items without the known position have a position past the end
+func insertAtPositions[T any](list []T, items []positioned[T]) []T {
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].position < items[j].position
+	})
+	for _, it := range items {
+		position := it.position
+		if position > len(list) {
+			position = len(list)
+		}
+		var zero T
+		list = append(list, zero)
+		copy(list[position+1:], list[position:])
+		list[position] = it.item
+	}
+	return list
+}
+
+// extractEventName moves the OpenTelemetry event name out of the log fields of an
+// OpenTelemetry span, it returns the name, its position and the remaining fields
+func extractEventName(fields []model.KeyValue) (string, int, []model.KeyValue) {
+	for i, f := range fields {
+		if f.Key == eventNameField && f.VType == model.ValueType_STRING && f.VStr != "" {
+			rest := append(append([]model.KeyValue{}, fields[:i]...), fields[i+1:]...)
+			return f.VStr, i, rest
+		}
+	}
+	return "", 0, fields
+}
+
+// restoreEventName puts the event name back among the log fields
+func restoreEventName(name string, position int, fields []model.KeyValue) []model.KeyValue {
+	if name == "" {
+		return fields
+	}
+	return insertAtPositions(fields, []positioned[model.KeyValue]{{model.String(eventNameField, name), position}})
+}
@@ -7,20 +7,20 @@ import (
 )
 
 type Plugin struct {
-	reader        *DdbReader
-	writer        *DdbWriter
-	archiveWriter *DdbWriter
+	reader  *DdbReader
+	writer  spanstore.Writer
+	archive *DdbArchive
 }
 
 var _ shared.StreamingSpanWriterPlugin = &Plugin{}
 var _ shared.ArchiveStoragePlugin = &Plugin{}
 var _ shared.StoragePlugin = &Plugin{}
 
-func NewPlugin(reader *DdbReader, writer, archiveWriter *DdbWriter) *Plugin {
+func NewPlugin(reader *DdbReader, writer spanstore.Writer, archive *DdbArchive) *Plugin {
 	return &Plugin{
-		reader:        reader,
-		writer:        writer,
-		archiveWriter: archiveWriter,
+		reader:  reader,
+		writer:  writer,
+		archive: archive,
 	}
 }
 
@@ -29,11 +29,11 @@ func (p *Plugin) StreamingSpanWriter() spanstore.Writer {
 }
 
 func (p *Plugin) ArchiveSpanReader() spanstore.Reader {
-	return p.reader
+	return p.archive
 }
 
 func (p *Plugin) ArchiveSpanWriter() spanstore.Writer {
-	return p.archiveWriter
+	return p.archive
 }
 
 func (p *Plugin) SpanReader() spanstore.Reader {
@@ -0,0 +1,128 @@
+package spanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jaegertracing/jaeger/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The span ID prefix of the process records, it can't clash with the hex span IDs
+const processRecordPrefix = "p-"
+
+const processCacheCapacity = 100000
+const processCacheTtl = time.Hour
+
+// The process records outlive the span that saved them by this much, so the later
+// spans of the trace need to extend the record only once in a while
+const processTtlMargin = 24 * time.Hour
+
+// StoredProcessRecord is the process shared by the spans of a trace. It's stored
+// in the span table next to the spans, so the "by-trace-id" index returns it
+// together with them. It has no start time or duration, so it doesn't get into the
+// search indexes.
+type StoredProcessRecord struct {
+	ServiceAndTime string         `dynamodbav:"service_and_time,omitempty"`
+	SegmentId      string         `dynamodbav:"segment_id,omitempty"`
+	TraceId        string         `dynamodbav:"trace_id,omitempty"`
+	SpanId         string         `dynamodbav:"span_id,omitempty"`
+	Process        *StoredProcess `dynamodbav:"process,omitempty"`
+}
+
+func isProcessRecord(stored *StoredSpan) bool {
+	return strings.HasPrefix(stored.SpanId, processRecordPrefix)
+}
+
+func processHash(process *model.Process) (string, error) {
+	hash, err := model.HashCode(process)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x", hash), nil
+}
+
+// detachProcess moves the process tags out of the span into the per-trace process
+// record, the span keeps only the service name and the process hash
+func detachProcess(stored *StoredSpan, hash string) *StoredProcessRecord {
+	res := &StoredProcessRecord{
+		ServiceAndTime: stored.ServiceAndTime,
+		SegmentId:      stored.TraceId + "-" + processRecordPrefix + hash,
+		TraceId:        stored.TraceId,
+		SpanId:         processRecordPrefix + hash,
+		Process:        stored.Process,
+	}
+	stored.ProcessHash = hash
+	stored.Process = &StoredProcess{ServiceName: stored.Process.ServiceName}
+	return res
+}
+
+// storeProcessRecord saves the process record, unless we know it's been saved already
+// and won't expire before the span (whose TTL is spanTtl)
+func (d *DdbWriter) storeProcessRecord(ctx context.Context, record *StoredProcessRecord, spanTtl int64) error {
+	if cached := d.processCache.Get(record.SegmentId); cached != nil && cached.Value() >= spanTtl {
+		return nil
+	}
+
+	ttl := spanTtl + int64(processTtlMargin/time.Second)
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return err
+	}
+	item["ttl"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(ttl, 10)}
+
+	// The record is the same for all the spans, so overwriting it is harmless, as
+	// long as it doesn't shorten the TTL (e.g. set by the archive writer)
+	res, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:                     item,
+		TableName:                aws.String(SpanTableName + d.suffix),
+		ConditionExpression:      aws.String("attribute_not_exists(#ttl) OR #ttl < :ttl"),
+		ExpressionAttributeNames: map[string]string{"#ttl": "ttl"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":ttl": item["ttl"],
+		},
+		ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+	})
+	var condFailed *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &condFailed) {
+		return fmt.Errorf("failed to persist the process record: %w", err)
+	}
+	if err == nil {
+		meterFrom(ctx).addWrite(res.ConsumedCapacity)
+	}
+
+	d.processCache.Set(record.SegmentId, ttl, processCacheTtl)
+	return nil
+}
+
+// joinProcesses separates the process records from the spans and puts the
+// processes back into the spans that refer to them
+func joinProcesses(stored []StoredSpan) []StoredSpan {
+	processes := map[string]*StoredProcess{}
+	var spans []StoredSpan
+	for i := range stored {
+		if isProcessRecord(&stored[i]) {
+			processes[strings.TrimPrefix(stored[i].SpanId, processRecordPrefix)] = stored[i].Process
+			continue
+		}
+		spans = append(spans, stored[i])
+	}
+
+	for i := range spans {
+		if spans[i].ProcessHash == "" {
+			continue
+		}
+		// If the record is missing, the span still has the service name
+		if process, ok := processes[spans[i].ProcessHash]; ok {
+			spans[i].Process = process
+		}
+	}
+
+	return spans
+}
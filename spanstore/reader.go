@@ -2,44 +2,1133 @@ package spanstore
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	. "github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/metrics"
 	"github.com/jaegertracing/jaeger/storage/dependencystore"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+	"math"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+const defaultNumTraces = 100
+const defaultLookback = time.Hour
+const defaultParallelTraceLoads = 8
+
+var ErrServiceNameNotSet = errors.New("service name must be set")
+
+// ErrSearchBudgetExceeded is returned by the searches that were stopped by the read
+// capacity budget before finding anything, and by FindTraceIDs together with the IDs
+// found so far. It's also the error of the traces GetTraces had no budget to load.
+var ErrSearchBudgetExceeded = errors.New("the search has exceeded its read capacity budget, " +
+	"the results are incomplete")
+var ErrStartTimeMinGreaterThanMax = errors.New("start time minimum is above maximum")
+var ErrDurationMinGreaterThanMax = errors.New("duration minimum is above maximum")
+
+// ReaderClient is the part of the DynamoDB API the reader uses, the tests replace
+// it with a fake
+type ReaderClient interface {
+	dynamodb.QueryAPIClient
+	dynamodb.ScanAPIClient
+}
+
+// ReaderOptions are the optional settings of the reader
+type ReaderOptions struct {
+	// Receives the consumed capacity metrics, they are discarded if it's nil
+	Metrics metrics.Factory
+	// The read capacity units a search may consume, including loading the found
+	// traces. Half of it is for walking the indexes, the search stops and returns
+	// partial results once it's used up. Zero means no limit.
+	ReadCapacityBudget float64
+	// The spans written by this process that might be not indexed yet, it's
+	// shared with the writer. Nothing is merged if it's nil.
+	RecentSpans *RecentSpanCache
+	// Keeps the traces that don't change anymore, nothing is cached if it's nil
+	TraceCache *TraceCache
+	// The number of traces GetTraces loads in parallel, the default is used if it's zero
+	MaxParallelTraceLoads int
+	// The number of traces per second GetTraces may load from DynamoDB across all
+	// the calls, the cached traces are not counted. Zero means no limit.
+	TraceLoadRate float64
+	// Picks the GSI versions to query, the configured ones are used if it's nil
+	Indexes *IndexResolver
+	// Also look the traces up by their legacy (unpadded) IDs, it costs one more
+	// query per trace. Only needed until the IdMigrator has been run.
+	LegacyTraceIds bool
+	// Signs the page tokens, it has to be the same for all the replicas behind the
+	// query service. A random key is used if it's empty, then the tokens can't be
+	// used after a restart.
+	PageTokenKey []byte
+}
+
 type DdbReader struct {
+	client ReaderClient
+	suffix string
+	opts   ReaderOptions
+
+	capacity *capacityReporter
+	// Shared by all the GetTraces calls, nil if there is no limit
+	traceLoadLimiter *rate.Limiter
+	timer            func() time.Time
+}
+
+// PagedReader is the Reader that can return the search results page by page
+type PagedReader interface {
+	spanstore.Reader
+	FindTracesPage(ctx context.Context, query *spanstore.TraceQueryParameters,
+		pageToken string) ([]*model.Trace, string, error)
+	FindTraceIDsPage(ctx context.Context, query *spanstore.TraceQueryParameters,
+		pageToken string) ([]model.TraceID, string, error)
 }
 
-var _ spanstore.Reader = &DdbReader{}
+var _ PagedReader = &DdbReader{}
 var _ dependencystore.Reader = &DdbReader{}
 
+func NewDdbReader(client ReaderClient, suffix string, opts ReaderOptions) *DdbReader {
+	res := &DdbReader{
+		client:   client,
+		suffix:   suffix,
+		opts:     opts,
+		capacity: newCapacityReporter(opts.Metrics),
+		timer:    time.Now,
+	}
+	if res.opts.MaxParallelTraceLoads <= 0 {
+		res.opts.MaxParallelTraceLoads = defaultParallelTraceLoads
+	}
+	if opts.TraceLoadRate > 0 {
+		res.traceLoadLimiter = rate.NewLimiter(rate.Limit(opts.TraceLoadRate),
+			int(math.Ceil(opts.TraceLoadRate)))
+	}
+	if len(res.opts.PageTokenKey) == 0 {
+		res.opts.PageTokenKey = make([]byte, 32)
+		_, _ = rand.Read(res.opts.PageTokenKey)
+	}
+	return res
+}
+
 func (r *DdbReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
-	//TODO implement me
-	panic("implement me")
+	ctx, done := r.capacity.start(ctx, "get_trace", 0)
+	defer done()
+	return r.getTrace(ctx, traceID, r.loadIndexedTrace, true)
+}
+
+// getTrace serves the trace from the cache, or loads its stored spans with the
+// load function and merges them with the recently written ones. The loaded trace
+// is cached only if the load function is known to find all of its spans.
+func (r *DdbReader) getTrace(ctx context.Context, traceID model.TraceID,
+	load func(ctx context.Context, traceID model.TraceID) ([]StoredSpan, error),
+	cacheable bool) (*model.Trace, error) {
+
+	canonicalId := formatTraceId(traceID)
+	if trace, ok := r.opts.TraceCache.get(traceID); ok {
+		// The trace might have got the new spans since it was cached
+		recent := r.opts.RecentSpans.get(canonicalId)
+		if trace != nil && hasAllSpans(trace, recent) {
+			return trace, nil
+		}
+		if trace == nil && len(recent) == 0 {
+			return nil, spanstore.ErrTraceNotFound
+		}
+	}
+
+	stored, err := load(ctx, traceID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The "by-trace-id" index lags behind the writes, add the spans we've just written
+	stored = append(stored, r.opts.RecentSpans.get(canonicalId)...)
+
+	if len(stored) == 0 {
+		if cacheable {
+			r.opts.TraceCache.putMissing(traceID)
+		}
+		return nil, spanstore.ErrTraceNotFound
+	}
+
+	trace, err := assembleTrace(stored)
+	if err != nil {
+		return nil, err
+	}
+	if cacheable {
+		r.opts.TraceCache.put(traceID, trace)
+	}
+	return trace, nil
+}
+
+func hasAllSpans(trace *model.Trace, stored []StoredSpan) bool {
+	spanIds := map[string]bool{}
+	for _, s := range trace.Spans {
+		spanIds[formatSpanId(s.SpanID)] = true
+	}
+	for i := range stored {
+		if !spanIds[stored[i].SpanId] {
+			return false
+		}
+	}
+	return true
+}
+
+// loadLimitedTrace is loadIndexedTrace that waits for the trace load rate limit
+func (r *DdbReader) loadLimitedTrace(ctx context.Context, traceID model.TraceID) ([]StoredSpan, error) {
+	if r.traceLoadLimiter != nil {
+		err := r.traceLoadLimiter.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r.loadIndexedTrace(ctx, traceID)
+}
+
+// loadIndexedTrace fetches the trace's spans through the "by-trace-id" index, and
+// with the LegacyTraceIds option also by the legacy encoding of the ID
+func (r *DdbReader) loadIndexedTrace(ctx context.Context, traceID model.TraceID) ([]StoredSpan, error) {
+	canonicalId := formatTraceId(traceID)
+	stored, err := r.loadTraceSpans(ctx, canonicalId)
+	if err != nil {
+		return nil, err
+	}
+	if !r.opts.LegacyTraceIds {
+		return stored, nil
+	}
+
+	// The spans written before the switch to the canonical IDs, until they are
+	// migrated. Different IDs can have the same legacy encoding, so the legacy spans
+	// only belong to the trace their ID parses into (the one the migration moves
+	// them to), otherwise we'd show the spans of another trace.
+	legacyId := formatLegacyTraceId(traceID)
+	if legacyId == canonicalId {
+		return stored, nil
+	}
+	if parsed, err := parseTraceId(legacyId); err != nil || parsed != traceID {
+		return stored, nil
+	}
+	legacy, err := r.loadTraceSpans(ctx, legacyId)
+	if err != nil {
+		return nil, err
+	}
+	for i := range legacy {
+		restoreLegacyTraceId(&legacy[i], legacyId, canonicalId)
+	}
+	return append(stored, legacy...), nil
+}
+
+// GetTraces loads the traces in parallel. It returns the traces that were loaded,
+// in the order of the IDs, and the errors for the ones that were not (including
+// spanstore.ErrTraceNotFound).
+func (r *DdbReader) GetTraces(ctx context.Context,
+	traceIDs []model.TraceID) ([]*model.Trace, map[model.TraceID]error) {
+
+	ctx, done := r.capacity.start(ctx, "get_traces", 0)
+	defer done()
+
+	traces := make([]*model.Trace, len(traceIDs))
+	errs := make([]error, len(traceIDs))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < r.opts.MaxParallelTraceLoads && w < len(traceIDs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				// The search that has found the traces might be out of its budget
+				if meterFrom(ctx).budgetExceeded() {
+					errs[i] = ErrSearchBudgetExceeded
+					continue
+				}
+				traces[i], errs[i] = r.getTrace(ctx, traceIDs[i], r.loadLimitedTrace, true)
+			}
+		}()
+	}
+	for i := range traceIDs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	var res []*model.Trace
+	var resErrs map[model.TraceID]error
+	for i, tid := range traceIDs {
+		if errs[i] == nil {
+			res = append(res, traces[i])
+			continue
+		}
+		if resErrs == nil {
+			resErrs = map[model.TraceID]error{}
+		}
+		resErrs[tid] = errs[i]
+	}
+	return res, resErrs
+}
+
+// restoreLegacyTraceId replaces the ambiguous legacy trace ID with the canonical one.
+// It relabels any span stored under the legacy ID, including the spans of another
+// trace with the same legacy encoding, so the caller has to make sure that the
+// legacy ID parses into the canonical one.
+func restoreLegacyTraceId(stored *StoredSpan, legacyId, canonicalId string) {
+	stored.TraceId = canonicalId
+	for i := range stored.References {
+		if stored.References[i].TraceId == legacyId {
+			stored.References[i].TraceId = canonicalId
+		}
+	}
+}
+
+// loadTraceSpans fetches all the spans of the trace through the "by-trace-id" index
+func (r *DdbReader) loadTraceSpans(ctx context.Context, traceId string) ([]StoredSpan, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(SpanTableName + r.suffix),
+		IndexName:                aws.String(r.opts.Indexes.name(byTraceIdIndex)),
+		KeyConditionExpression:   aws.String("trace_id = :tid"),
+		ReturnConsumedCapacity:   types.ReturnConsumedCapacityTotal,
+		ExpressionAttributeNames: map[string]string{},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tid": &types.AttributeValueMemberS{Value: traceId},
+		},
+	}
+	input.FilterExpression = aws.String(r.notExpired(input.ExpressionAttributeNames, input.ExpressionAttributeValues))
+	return r.querySpans(ctx, input)
+}
+
+func (r *DdbReader) querySpans(ctx context.Context, input *dynamodb.QueryInput) ([]StoredSpan, error) {
+	paginator := dynamodb.NewQueryPaginator(r.client, input)
+
+	var res []StoredSpan
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query the trace spans: %w", err)
+		}
+		meterFrom(ctx).addRead(page.ConsumedCapacity)
+
+		var spans []StoredSpan
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &spans)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, spans...)
+	}
+
+	return res, nil
+}
+
+func assembleTrace(stored []StoredSpan) (*model.Trace, error) {
+	stored = joinProcesses(stored)
+
+	res := &model.Trace{}
+	// A span can be present in both encodings while it's being migrated
+	seen := map[model.SpanID]bool{}
+	for i := range stored {
+		span, err := FromDdbModel(&stored[i])
+		if err != nil {
+			return nil, err
+		}
+		if seen[span.SpanID] {
+			continue
+		}
+		seen[span.SpanID] = true
+		res.Spans = append(res.Spans, span)
+	}
+	return res, nil
 }
 
 func (r *DdbReader) GetServices(ctx context.Context) ([]string, error) {
-	//TODO implement me
-	panic("implement me")
+	ctx, done := r.capacity.start(ctx, "get_services", 0)
+	defer done()
+
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(ServiceTableName + r.suffix),
+		ProjectionExpression:      aws.String("#svc"),
+		ExpressionAttributeNames:  map[string]string{"#svc": "service"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{},
+		ReturnConsumedCapacity:    types.ReturnConsumedCapacityTotal,
+	}
+	input.FilterExpression = aws.String(r.notExpired(input.ExpressionAttributeNames, input.ExpressionAttributeValues))
+	paginator := dynamodb.NewScanPaginator(r.client, input)
+
+	services := map[string]bool{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan the services: %w", err)
+		}
+		meterFrom(ctx).addRead(page.ConsumedCapacity)
+
+		var stored []StoredService
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &stored)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range stored {
+			services[s.Service] = true
+		}
+	}
+
+	res := make([]string, 0, len(services))
+	for s := range services {
+		res = append(res, s)
+	}
+	sort.Strings(res)
+
+	return res, nil
 }
 
-func (r *DdbReader) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
-	//TODO implement me
-	panic("implement me")
+func (r *DdbReader) GetOperations(ctx context.Context,
+	query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+
+	ctx, done := r.capacity.start(ctx, "get_operations", 0)
+	defer done()
+
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(ServiceTableName + r.suffix),
+		KeyConditionExpression:   aws.String("#svc = :svc"),
+		ExpressionAttributeNames: map[string]string{"#svc": "service"},
+		ReturnConsumedCapacity:   types.ReturnConsumedCapacityTotal,
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":svc": &types.AttributeValueMemberS{Value: query.ServiceName},
+		},
+	}
+	input.FilterExpression = aws.String(r.notExpired(input.ExpressionAttributeNames, input.ExpressionAttributeValues))
+	paginator := dynamodb.NewQueryPaginator(r.client, input)
+
+	res := []spanstore.Operation{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query the operations: %w", err)
+		}
+		meterFrom(ctx).addRead(page.ConsumedCapacity)
+
+		var stored []StoredService
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &stored)
+		if err != nil {
+			return nil, err
+		}
+		// We don't record the span kinds, so we return all the operations
+		for _, s := range stored {
+			res = append(res, spanstore.Operation{Name: s.Operation})
+		}
+	}
+
+	return res, nil
 }
 
 func (r *DdbReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
-	//TODO implement me
-	panic("implement me")
+	ctx, done := r.capacity.start(ctx, "find_traces", r.opts.ReadCapacityBudget)
+	defer done()
+
+	summaries, next, err := r.findTraceSummaries(ctx, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, complete, err := r.loadTraces(ctx, summaries)
+	if err != nil {
+		return nil, err
+	}
+	if !complete || (next != nil && meterFrom(ctx).searchBudgetExceeded()) {
+		return r.warnIfPartial(ctx, res)
+	}
+	return res, nil
 }
 
 func (r *DdbReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
-	//TODO implement me
-	panic("implement me")
+	ctx, done := r.capacity.start(ctx, "find_trace_ids", r.opts.ReadCapacityBudget)
+	defer done()
+
+	summaries, next, err := r.findTraceSummaries(ctx, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := summaryTraceIds(summaries)
+	if err != nil {
+		return nil, err
+	}
+	if next != nil && meterFrom(ctx).searchBudgetExceeded() {
+		L(ctx).Warn("The search has exceeded its read capacity budget",
+			zap.Float64("budget", r.opts.ReadCapacityBudget))
+		return res, ErrSearchBudgetExceeded
+	}
+	return res, nil
+}
+
+// FindTracesPage returns the traces matching the query page by page, query.NumTraces
+// is the page size. The page token continues the previous search with the same query,
+// it's empty for the first page. The returned token is empty after the last page.
+func (r *DdbReader) FindTracesPage(ctx context.Context, query *spanstore.TraceQueryParameters,
+	pageToken string) ([]*model.Trace, string, error) {
+
+	ctx, done := r.capacity.start(ctx, "find_traces", r.opts.ReadCapacityBudget)
+	defer done()
+
+	summaries, next, err := r.findTraceSummariesPage(ctx, query, pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	// The next page continues the search, but the traces of this one that were
+	// not loaded are lost
+	res, complete, err := r.loadTraces(ctx, summaries)
+	if err != nil {
+		return nil, "", err
+	}
+	if !complete {
+		res, err = r.warnIfPartial(ctx, res)
+	}
+	return res, next, err
+}
+
+// FindTraceIDsPage is FindTracesPage that returns only the trace IDs
+func (r *DdbReader) FindTraceIDsPage(ctx context.Context, query *spanstore.TraceQueryParameters,
+	pageToken string) ([]model.TraceID, string, error) {
+
+	ctx, done := r.capacity.start(ctx, "find_trace_ids", r.opts.ReadCapacityBudget)
+	defer done()
+
+	summaries, next, err := r.findTraceSummariesPage(ctx, query, pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	res, err := summaryTraceIds(summaries)
+	if err != nil {
+		return nil, "", err
+	}
+	return res, next, nil
+}
+
+func (r *DdbReader) findTraceSummariesPage(ctx context.Context, query *spanstore.TraceQueryParameters,
+	pageToken string) ([]*TraceSummary, string, error) {
+
+	cursor, err := decodeCursor(pageToken, query, r.opts.PageTokenKey)
+	if err != nil {
+		return nil, "", err
+	}
+	summaries, next, err := r.findTraceSummaries(ctx, query, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	nextToken, err := encodeCursor(next, r.opts.PageTokenKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return summaries, nextToken, nil
+}
+
+// warnIfPartial reports the search that was stopped by the read capacity budget. The
+// warning is added to the first span of the found traces, as only the spans are sent
+// to the query service, or the error is returned if nothing was found.
+func (r *DdbReader) warnIfPartial(ctx context.Context, traces []*model.Trace) ([]*model.Trace, error) {
+	L(ctx).Warn("The search has exceeded its read capacity budget",
+		zap.Float64("budget", r.opts.ReadCapacityBudget))
+	if len(traces) == 0 || len(traces[0].Spans) == 0 {
+		return nil, ErrSearchBudgetExceeded
+	}
+
+	// The spans can be shared with the trace cache, so the warned one is a copy
+	warned := *traces[0].Spans[0]
+	warned.Warnings = append(append([]string{}, warned.Warnings...), fmt.Sprintf(
+		"The search was stopped after consuming %g read capacity units, the results are incomplete",
+		r.opts.ReadCapacityBudget))
+	trace := *traces[0]
+	trace.Spans = append([]*model.Span{&warned}, trace.Spans[1:]...)
+	traces[0] = &trace
+	return traces, nil
+}
+
+// loadTraces fetches the spans of the found traces. It returns false if some of
+// them were not loaded because the search is out of its read capacity budget. The
+// traces that failed to load are logged and skipped, the error is only returned if
+// none of the traces were loaded.
+func (r *DdbReader) loadTraces(ctx context.Context, summaries []*TraceSummary) ([]*model.Trace, bool, error) {
+	traceIds, err := summaryTraceIds(summaries)
+	if err != nil {
+		return nil, false, err
+	}
+
+	res, errs := r.GetTraces(ctx, traceIds)
+	complete := true
+	var failed []string
+	var lastErr error
+	for tid, err := range errs {
+		if errors.Is(err, ErrSearchBudgetExceeded) {
+			complete = false
+			continue
+		}
+		if errors.Is(err, spanstore.ErrTraceNotFound) {
+			// The summary can be ahead of the trace-id index
+			L(ctx).Debug("No spans for the trace summary", zap.String("trace-id", tid.String()))
+			continue
+		}
+		failed = append(failed, tid.String())
+		lastErr = err
+	}
+
+	if len(failed) != 0 {
+		sort.Strings(failed)
+		L(ctx).Warn("Failed to load the found traces", zap.Strings("trace-ids", failed),
+			zap.Error(lastErr))
+		if len(res) == 0 {
+			return nil, false, lastErr
+		}
+	}
+	return res, complete, nil
+}
+
+func summaryTraceIds(summaries []*TraceSummary) ([]model.TraceID, error) {
+	var res []model.TraceID
+	for _, s := range summaries {
+		tid, err := parseTraceId(s.TraceId)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, tid)
+	}
+	return res, nil
+}
+
+func validateQuery(query *spanstore.TraceQueryParameters) error {
+	if query.ServiceName == "" {
+		return ErrServiceNameNotSet
+	}
+	if !query.StartTimeMin.IsZero() && !query.StartTimeMax.IsZero() &&
+		query.StartTimeMax.Before(query.StartTimeMin) {
+		return ErrStartTimeMinGreaterThanMax
+	}
+	if query.DurationMin != 0 && query.DurationMax != 0 && query.DurationMin > query.DurationMax {
+		return ErrDurationMinGreaterThanMax
+	}
+	return nil
+}
+
+// findTraceSummaries searches for the traces matching the query, walking the hourly
+// buckets from the most recent one, skipping the ones the service had no spans in.
+// The service, operation and tags select the candidate traces, and the trace-level
+// filters are then applied to their summaries. The cursor continues the previous
+// search, it's nil for the first page. The returned cursor is nil if there are no
+// more results.
+func (r *DdbReader) findTraceSummaries(ctx context.Context, query *spanstore.TraceQueryParameters,
+	cursor *searchCursor) ([]*TraceSummary, *searchCursor, error) {
+
+	err := validateQuery(query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	numTraces := query.NumTraces
+	if numTraces <= 0 {
+		numTraces = defaultNumTraces
+	}
+	if cursor == nil {
+		cursor, err = r.startSearch(ctx, query)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	minTime, maxTime := time.Unix(0, cursor.MinTime), time.Unix(0, cursor.MaxTime)
+
+	// The traces that were returned from the current bucket, and the ones that
+	// can be found in the other buckets as well (with their earliest buckets)
+	current, spanning := map[model.TraceID]bool{}, map[model.TraceID]int64{}
+	for _, s := range cursor.Seen {
+		if tid, err := parseTraceId(s); err == nil {
+			current[tid] = true
+		}
+	}
+	for _, s := range cursor.Spanning {
+		if tid, err := parseTraceId(s.TraceId); err == nil {
+			spanning[tid] = s.Bucket
+		}
+	}
+
+	// A trace has one summary record per service, so it's found once in the service's
+	// summaries. But its spans can be found in every bucket they start in.
+	bySpans := len(query.Tags) != 0 || query.OperationName != ""
+	// The summaries are only read for the duration filters, and to tell which of the
+	// spans' traces can be found again in the other buckets
+	needSummaries := bySpans || query.DurationMin != 0 || query.DurationMax != 0
+
+	var res []*TraceSummary
+	visited := map[model.TraceID]bool{}
+	isNew := func(traceId string) (model.TraceID, bool, error) {
+		// The same trace can have the summaries in the legacy and the canonical form
+		tid, err := parseTraceId(traceId)
+		if err != nil {
+			return tid, false, err
+		}
+		_, isSpanning := spanning[tid]
+		return tid, !visited[tid] && !current[tid] && !isSpanning, nil
+	}
+
+	loaded := map[string]*TraceSummary{}
+	prefetch := func(traceIds []string) error {
+		if !needSummaries {
+			return nil
+		}
+		var missing []string
+		for _, traceId := range traceIds {
+			_, ok, err := isNew(traceId)
+			if err != nil {
+				return err
+			}
+			if _, found := loaded[traceId]; ok && !found {
+				loaded[traceId] = nil
+				missing = append(missing, traceId)
+			}
+		}
+		summaries, err := r.loadTraceSummaries(ctx, missing)
+		if err != nil {
+			return err
+		}
+		for k, v := range summaries {
+			loaded[k] = v
+		}
+		return nil
+	}
+
+	visit := func(traceId string) (bool, error) {
+		tid, ok, err := isNew(traceId)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return true, nil
+		}
+		visited[tid] = true
+
+		summary := &TraceSummary{TraceId: traceId}
+		if needSummaries {
+			var found bool
+			if summary, found = loaded[traceId]; !found {
+				summary, err = r.loadTraceSummary(ctx, traceId)
+				if err != nil {
+					return false, err
+				}
+			}
+			delete(loaded, traceId)
+			if summary == nil || !summaryMatches(query, summary) {
+				return true, nil
+			}
+		}
+
+		res = append(res, summary)
+		startBucket := time.Unix(0, summary.StartTime).Truncate(time.Hour)
+		if bySpans && startBucket != time.Unix(0, summary.EndTime).Truncate(time.Hour) {
+			spanning[tid] = startBucket.Unix()
+		} else {
+			current[tid] = true
+		}
+		return len(res) < numTraces && !meterFrom(ctx).searchBudgetExceeded(), nil
+	}
+
+	for len(cursor.Buckets) != 0 {
+		var lastKey map[string]types.AttributeValue
+		if !bySpans {
+			lastKey, err = r.findSummaryCandidates(ctx, query, cursor.currentBucket(),
+				minTime, maxTime, cursor.startKey(), prefetch, visit)
+		} else {
+			lastKey, err = r.findSpanCandidates(ctx, query, cursor.currentBucket(),
+				minTime, maxTime, cursor.startKey(), prefetch, visit)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if lastKey != nil {
+			// The page is full, continue from the last visited item
+			cursor.setStartKey(lastKey)
+			cursor.Seen, cursor.Spanning = formatTraceIdSet(current), spanningTraces(spanning, cursor.Buckets)
+			return res, cursor, nil
+		}
+
+		// The traces of this bucket can't be found in the other ones
+		cursor.Buckets, cursor.StartKey = cursor.Buckets[1:], nil
+		current = map[model.TraceID]bool{}
+
+		if len(cursor.Buckets) != 0 && meterFrom(ctx).searchBudgetExceeded() {
+			cursor.Seen, cursor.Spanning = nil, spanningTraces(spanning, cursor.Buckets)
+			return res, cursor, nil
+		}
+	}
+
+	return res, nil, nil
+}
+
+// startSearch resolves the time range of the query and plans the buckets to search
+func (r *DdbReader) startSearch(ctx context.Context, query *spanstore.TraceQueryParameters) (*searchCursor, error) {
+	maxTime := query.StartTimeMax
+	if maxTime.IsZero() {
+		maxTime = r.timer()
+	}
+	minTime := query.StartTimeMin
+	if minTime.IsZero() {
+		minTime = maxTime.Add(-defaultLookback)
+	}
+
+	// Skip the buckets where the service had no spans, if we know about them
+	buckets := timeBuckets(minTime, maxTime)
+	activity, found, err := r.loadActivity(ctx, query.ServiceName, minTime, maxTime)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		buckets = planBuckets(buckets, activity, r.timer())
+	}
+
+	res := &searchCursor{
+		Query:   queryFingerprint(query),
+		MinTime: minTime.UnixNano(),
+		MaxTime: maxTime.UnixNano(),
+	}
+	for _, b := range buckets {
+		res.Buckets = append(res.Buckets, b.Unix())
+	}
+	return res, nil
+}
+
+func formatTraceIdSet(ids map[model.TraceID]bool) []string {
+	var res []string
+	for tid := range ids {
+		res = append(res, formatTraceId(tid))
+	}
+	sort.Strings(res)
+	return res
+}
+
+func summaryMatches(query *spanstore.TraceQueryParameters, summary *TraceSummary) bool {
+	if query.DurationMin != 0 && summary.Duration() < query.DurationMin {
+		return false
+	}
+	if query.DurationMax != 0 && summary.Duration() > query.DurationMax {
+		return false
+	}
+	return true
+}
+
+// loadTraceSummary fetches and merges all the per-service summary records of the trace
+func (r *DdbReader) loadTraceSummary(ctx context.Context, traceId string) (*TraceSummary, error) {
+	records, err := r.loadSummaryRecords(ctx, traceId, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return mergeSummaries(traceId, records), nil
 }
 
+// loadSummaryRecords reads the per-service summary records of the trace
+func (r *DdbReader) loadSummaryRecords(ctx context.Context, traceId string,
+	consistent bool) ([]StoredTraceSummary, error) {
+
+	input := &dynamodb.QueryInput{
+		TableName:                aws.String(TraceTableName + r.suffix),
+		KeyConditionExpression:   aws.String("trace_id = :tid"),
+		ConsistentRead:           aws.Bool(consistent),
+		ReturnConsumedCapacity:   types.ReturnConsumedCapacityTotal,
+		ExpressionAttributeNames: map[string]string{},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tid": &types.AttributeValueMemberS{Value: traceId},
+		},
+	}
+	input.FilterExpression = aws.String(r.notExpired(input.ExpressionAttributeNames, input.ExpressionAttributeValues))
+	paginator := dynamodb.NewQueryPaginator(r.client, input)
+
+	var records []StoredTraceSummary
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query the trace summary: %w", err)
+		}
+		meterFrom(ctx).addRead(page.ConsumedCapacity)
+
+		var cur []StoredTraceSummary
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &cur)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, cur...)
+	}
+	return records, nil
+}
+
+// loadTraceSummaries fetches the summaries of the traces in parallel, the traces
+// without the summary get the nil one
+func (r *DdbReader) loadTraceSummaries(ctx context.Context, traceIds []string) (map[string]*TraceSummary, error) {
+	summaries := make([]*TraceSummary, len(traceIds))
+	errs := make([]error, len(traceIds))
+
+	var wg sync.WaitGroup
+	for i := range traceIds {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			summaries[i], errs[i] = r.loadTraceSummary(ctx, traceIds[i])
+		}(i)
+	}
+	wg.Wait()
+
+	res := map[string]*TraceSummary{}
+	for i, traceId := range traceIds {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		res[traceId] = summaries[i]
+	}
+	return res, nil
+}
+
+// findSummaryCandidates walks the service's trace summaries in the bucket, the most
+// recent traces go first. It returns the key of the last visited item if the visitor
+// asked to stop.
+func (r *DdbReader) findSummaryCandidates(ctx context.Context, query *spanstore.TraceQueryParameters,
+	bucket, minTime, maxTime time.Time, startKey map[string]types.AttributeValue,
+	prefetch func(traceIds []string) error,
+	visit func(traceId string) (bool, error)) (map[string]types.AttributeValue, error) {
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(TraceTableName + r.suffix),
+		IndexName:              aws.String(r.opts.Indexes.name(byServiceTimeIndex)),
+		KeyConditionExpression: aws.String("#bucket = :bucket AND #start BETWEEN :min AND :max"),
+		ScanIndexForward:       aws.Bool(false),
+		ExclusiveStartKey:      startKey,
+		ExpressionAttributeNames: map[string]string{
+			"#bucket": "service_and_time",
+			"#start":  "start_time_nanos",
+		},
+		ExpressionAttributeValues: timeRangeValues(serviceBucket(query.ServiceName, bucket), minTime, maxTime),
+	}
+	input.FilterExpression = aws.String(r.notExpired(input.ExpressionAttributeNames, input.ExpressionAttributeValues))
+
+	return r.visitTraceIds(ctx, input, []string{"trace_id", "service", "service_and_time", "start_time_nanos"},
+		prefetch, visit)
+}
+
+// findSpanCandidates walks the service's spans in the bucket that match the operation
+// and the tags using the narrowest index, the most recent spans go first. It returns
+// the key of the last visited item if the visitor asked to stop.
+func (r *DdbReader) findSpanCandidates(ctx context.Context, query *spanstore.TraceQueryParameters,
+	bucket, minTime, maxTime time.Time, startKey map[string]types.AttributeValue,
+	prefetch func(traceIds []string) error,
+	visit func(traceId string) (bool, error)) (map[string]types.AttributeValue, error) {
+
+	// The operation index has only the spans of the operation in the bucket. Otherwise,
+	// the searches for failed spans go to the sparse error index, which only has
+	// the failed spans in it.
+	indexName, bucketField := byTimeIndex, "service_and_time"
+	bucketValue := serviceBucket(query.ServiceName, bucket)
+	onlyErrors := query.Tags[errorTagName] == "true"
+	if query.OperationName != "" {
+		indexName, bucketField = byOperationIndex, "operation_bucket"
+		bucketValue = operationBucket(query.ServiceName, query.OperationName, bucket)
+	} else if onlyErrors {
+		indexName, bucketField = byErrorIndex, "error_bucket"
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(SpanTableName + r.suffix),
+		IndexName:              aws.String(r.opts.Indexes.name(indexName)),
+		KeyConditionExpression: aws.String("#bucket = :bucket AND #start BETWEEN :min AND :max"),
+		ScanIndexForward:       aws.Bool(false),
+		ExclusiveStartKey:      startKey,
+		ExpressionAttributeNames: map[string]string{
+			"#bucket": bucketField,
+			"#start":  "start_time_nanos",
+		},
+		ExpressionAttributeValues: timeRangeValues(bucketValue, minTime, maxTime),
+	}
+
+	filters := []string{r.notExpired(input.ExpressionAttributeNames, input.ExpressionAttributeValues)}
+	if onlyErrors && indexName != byErrorIndex {
+		filters = append(filters, "attribute_exists(#eb)")
+		input.ExpressionAttributeNames["#eb"] = "error_bucket"
+	}
+
+	// Sort the tags to make the expressions stable
+	var tagKeys []string
+	for k := range query.Tags {
+		if onlyErrors && k == errorTagName {
+			continue
+		}
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Strings(tagKeys)
+
+	for i, k := range tagKeys {
+		name, value := fmt.Sprintf("#t%d", i), fmt.Sprintf(":t%d", i)
+		// The numeric comparisons go to the typed tags
+		if pred, ok := parseTagPredicate(k, query.Tags[k]); ok {
+			filters = append(filters, "#nt."+name+" "+pred.Op+" "+value)
+			input.ExpressionAttributeNames["#nt"] = "numeric_tags"
+			input.ExpressionAttributeNames[name] = pred.Key
+			input.ExpressionAttributeValues[value] = &types.AttributeValueMemberN{Value: pred.Value}
+			continue
+		}
+		filters = append(filters, "#ft."+name+" = "+value)
+		input.ExpressionAttributeNames["#ft"] = "flattened_tags"
+		input.ExpressionAttributeNames[name] = k
+		input.ExpressionAttributeValues[value] = &types.AttributeValueMemberS{Value: query.Tags[k]}
+	}
+	input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+
+	keyFields := []string{"trace_id", "service_and_time", "segment_id", "start_time_nanos"}
+	if bucketField != "service_and_time" {
+		keyFields = append(keyFields, bucketField)
+	}
+	return r.visitTraceIds(ctx, input, keyFields, prefetch, visit)
+}
+
+// notExpired adds the condition that filters out the items past their TTL, DynamoDB
+// deletes them only eventually, up to a few days later. The items without the TTL
+// never expire.
+func (r *DdbReader) notExpired(names map[string]string, values map[string]types.AttributeValue) string {
+	names["#ttl"] = "ttl"
+	values[":now"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", r.timer().Unix())}
+	return "(attribute_not_exists(#ttl) OR #ttl > :now)"
+}
+
+func timeRangeValues(bucket string, minTime, maxTime time.Time) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		":bucket": &types.AttributeValueMemberS{Value: bucket},
+		":min":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", minTime.UnixNano())},
+		":max":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", maxTime.UnixNano())},
+	}
+}
+
+// visitTraceIds runs the query and passes the found trace IDs to the visitor. The
+// items are visited in chunks of MaxParallelTraceLoads, the prefetch function gets
+// the trace IDs of the chunk before they are visited. The key fields are the
+// primary key of the table and of the index, if the visitor asks to stop, they are
+// returned as the key to continue the query from.
+func (r *DdbReader) visitTraceIds(ctx context.Context, input *dynamodb.QueryInput, keyFields []string,
+	prefetch func(traceIds []string) error,
+	visit func(traceId string) (bool, error)) (map[string]types.AttributeValue, error) {
+
+	var projection []string
+	for i, f := range keyFields {
+		name := fmt.Sprintf("#k%d", i)
+		input.ExpressionAttributeNames[name] = f
+		projection = append(projection, name)
+	}
+	input.ProjectionExpression = aws.String(strings.Join(projection, ", "))
+	input.ReturnConsumedCapacity = types.ReturnConsumedCapacityTotal
+
+	paginator := dynamodb.NewQueryPaginator(r.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search for traces: %w", err)
+		}
+		meterFrom(ctx).addRead(page.ConsumedCapacity)
+
+		for start := 0; start < len(page.Items); start += r.opts.MaxParallelTraceLoads {
+			end := start + r.opts.MaxParallelTraceLoads
+			if end > len(page.Items) {
+				end = len(page.Items)
+			}
+			chunk := page.Items[start:end]
+
+			var traceIds []string
+			for _, item := range chunk {
+				if tid, ok := item["trace_id"].(*types.AttributeValueMemberS); ok {
+					traceIds = append(traceIds, tid.Value)
+				}
+			}
+			err = prefetch(traceIds)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, item := range chunk {
+				tid, ok := item["trace_id"].(*types.AttributeValueMemberS)
+				if !ok {
+					continue
+				}
+				more, err := visit(tid.Value)
+				if err != nil {
+					return nil, err
+				}
+				if !more {
+					lastKey := map[string]types.AttributeValue{}
+					for _, f := range keyFields {
+						if v, ok := item[f]; ok {
+							lastKey[f] = v
+						}
+					}
+					return lastKey, nil
+				}
+			}
+		}
+
+		// The filtered out items consume the capacity as well
+		if page.LastEvaluatedKey != nil && meterFrom(ctx).searchBudgetExceeded() {
+			return page.LastEvaluatedKey, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetDependencies sums up the daily call counts of the days within the time range,
+// the expired records are skipped. Note that the writer doesn't record the calls
+// yet (see RegisterReference), so the result is empty until it does.
 func (r *DdbReader) GetDependencies(ctx context.Context, endTs time.Time,
 	lookback time.Duration) ([]model.DependencyLink, error) {
-	return []model.DependencyLink{}, nil
+
+	ctx, done := r.capacity.start(ctx, "get_dependencies", 0)
+	defer done()
+
+	type link struct{ parent, child string }
+	counts := map[link]uint64{}
+	var links []link
+
+	endDay := endTs.UTC().Truncate(24 * time.Hour)
+	for day := endTs.Add(-lookback).UTC().Truncate(24 * time.Hour); !day.After(endDay); day = day.Add(24 * time.Hour) {
+		input := &dynamodb.QueryInput{
+			TableName:                aws.String(DependencyTableName + r.suffix),
+			KeyConditionExpression:   aws.String("#bucket = :bucket"),
+			ExpressionAttributeNames: map[string]string{"#bucket": "time_bucket"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":bucket": &types.AttributeValueMemberS{Value: day.Format(activityDayFormat)},
+			},
+			ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+		}
+		input.FilterExpression = aws.String(r.notExpired(input.ExpressionAttributeNames, input.ExpressionAttributeValues))
+		paginator := dynamodb.NewQueryPaginator(r.client, input)
+
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to query the dependencies: %w", err)
+			}
+			meterFrom(ctx).addRead(page.ConsumedCapacity)
+
+			var stored []StoredDependency
+			err = attributevalue.UnmarshalListOfMaps(page.Items, &stored)
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range stored {
+				l := link{parent: d.Parent, child: d.Child}
+				if _, ok := counts[l]; !ok {
+					links = append(links, l)
+				}
+				counts[l] += d.CallCount
+			}
+		}
+	}
+
+	res := []model.DependencyLink{}
+	for _, l := range links {
+		res = append(res, model.DependencyLink{Parent: l.parent, Child: l.child, CallCount: counts[l]})
+	}
+	return res, nil
 }
@@ -0,0 +1,579 @@
+package spanstore
+
+import (
+	"context"
+	"errors"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/SimplestCloud/jaeger-ddb-spanstore/schemer"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeReaderClient serves the queries from the canned items of the partitions, in
+// the order they were added. The filter expressions are not evaluated.
+type fakeReaderClient struct {
+	mtx sync.Mutex
+	// "table/index version/partition key" -> the items
+	items map[string][]map[string]types.AttributeValue
+	// The items per page, all of them if it's zero
+	pageSize int
+	// The read capacity consumed by each page
+	pageCapacity float64
+	// Partition key -> the error its queries fail with
+	failures map[string]error
+
+	queries []*dynamodb.QueryInput
+}
+
+var _ ReaderClient = &fakeReaderClient{}
+
+func newFakeReaderClient() *fakeReaderClient {
+	return &fakeReaderClient{items: map[string][]map[string]types.AttributeValue{}}
+}
+
+func (f *fakeReaderClient) add(table, index, partition string, item map[string]types.AttributeValue) {
+	key := table + "-test/" + configuredIndexName(index) + "/" + partition
+	f.items[key] = append(f.items[key], item)
+}
+
+// addSummary adds the summary record to the trace table and to the "by-service-time" index
+func (f *fakeReaderClient) addSummary(t *testing.T, rec StoredTraceSummary) {
+	item, err := attributevalue.MarshalMap(&rec)
+	require.NoError(t, err)
+	f.add(TraceTableName, "", rec.TraceId, item)
+	f.add(TraceTableName, byServiceTimeIndex, rec.ServiceAndTime, map[string]types.AttributeValue{
+		"trace_id":         item["trace_id"],
+		"service":          item["service"],
+		"service_and_time": item["service_and_time"],
+		"start_time_nanos": item["start_time_nanos"],
+	})
+}
+
+// addSpan adds the span to the span indexes
+func (f *fakeReaderClient) addSpan(t *testing.T, span *model.Span) {
+	stored, err := ToDdbModel(span, nil)
+	require.NoError(t, err)
+	item, err := attributevalue.MarshalMap(stored)
+	require.NoError(t, err)
+	f.add(SpanTableName, byTraceIdIndex, stored.TraceId, item)
+	f.add(SpanTableName, byTimeIndex, stored.ServiceAndTime, item)
+	f.add(SpanTableName, byOperationIndex, stored.OperationBucket, item)
+	if stored.ErrorBucket != "" {
+		f.add(SpanTableName, byErrorIndex, stored.ErrorBucket, item)
+	}
+}
+
+func (f *fakeReaderClient) Query(_ context.Context, input *dynamodb.QueryInput,
+	_ ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.queries = append(f.queries, input)
+
+	var partition string
+	for _, name := range []string{":bucket", ":tid", ":svc"} {
+		if v, ok := input.ExpressionAttributeValues[name].(*types.AttributeValueMemberS); ok {
+			partition = v.Value
+			break
+		}
+	}
+	if err := f.failures[partition]; err != nil {
+		return nil, err
+	}
+	items := f.items[aws.ToString(input.TableName)+"/"+aws.ToString(input.IndexName)+"/"+partition]
+
+	start := 0
+	if input.ExclusiveStartKey != nil {
+		for i, item := range items {
+			matches := true
+			for k, v := range input.ExclusiveStartKey {
+				matches = matches && reflect.DeepEqual(item[k], v)
+			}
+			if matches {
+				start = i + 1
+				break
+			}
+		}
+	}
+	end := len(items)
+	if f.pageSize != 0 && start+f.pageSize < end {
+		end = start + f.pageSize
+	}
+
+	res := &dynamodb.QueryOutput{
+		Items:            items[start:end],
+		ConsumedCapacity: &types.ConsumedCapacity{CapacityUnits: aws.Float64(f.pageCapacity)},
+	}
+	if end < len(items) {
+		res.LastEvaluatedKey = items[end-1]
+	}
+	return res, nil
+}
+
+func (f *fakeReaderClient) Scan(context.Context, *dynamodb.ScanInput,
+	...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	return &dynamodb.ScanOutput{}, nil
+}
+
+// queriesOf returns the queries of the table's index, or of the table itself if
+// the index is empty
+func (f *fakeReaderClient) queriesOf(table, index string) []*dynamodb.QueryInput {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	var res []*dynamodb.QueryInput
+	for _, q := range f.queries {
+		if strings.TrimSuffix(aws.ToString(q.TableName), "-test") == table && aws.ToString(q.IndexName) == configuredIndexName(index) {
+			res = append(res, q)
+		}
+	}
+	return res
+}
+
+func TestFindTracesBySummary(t *testing.T) {
+	ddb := schemer.NewDdbConnection(t, false)
+	defer ddb.Close()
+
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	require.NoError(t, EnsureTablesAreReady(ctx, "-test", ddb.Config, SchemaOptions{}))
+
+	client := dynamodb.NewFromConfig(ddb.Config)
+	dep := NewDependencyManager(client, "-test", 3600)
+	activity := NewActivityTracker(client, "-test", 3600, nil)
+	writer := NewDdbWriter(client, "-test", 3600, dep, WriterOptions{Activity: activity})
+	reader := NewDdbReader(client, "-test", ReaderOptions{})
+
+	start := time.Now().UTC().Truncate(time.Second)
+
+	// A slow trace where each span is fast, but the trace is long
+	slow := model.NewTraceID(0, 0x1)
+	root := makeTestSpan(slow, 1, "api", "GET /", start, 100*time.Millisecond,
+		model.Int64("http.status_code", 503))
+	child := makeTestSpan(slow, 2, "db", "query", start.Add(2*time.Second),
+		100*time.Millisecond, model.Bool("error", true))
+	child.References = []model.SpanRef{model.NewChildOfRef(slow, 1)}
+	require.NoError(t, writer.WriteSpan(ctx, child))
+	require.NoError(t, writer.WriteSpan(ctx, root))
+
+	// A fast trace
+	fast := model.NewTraceID(0, 0x2)
+	require.NoError(t, writer.WriteSpan(ctx, makeTestSpan(fast, 3, "api", "GET /", start,
+		100*time.Millisecond, model.Int64("http.status_code", 200))))
+
+	require.NoError(t, activity.Flush(ctx))
+	counts, found, err := reader.loadActivity(ctx, "api", start.Add(-time.Hour), start)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, int64(2), counts[start.Truncate(time.Hour)])
+
+	summary, err := reader.loadTraceSummary(ctx, formatTraceId(slow))
+	require.NoError(t, err)
+	assert.Equal(t, "api", summary.RootService)
+	assert.Equal(t, "GET /", summary.RootOperation)
+	assert.Equal(t, int64(2), summary.SpanCount)
+	assert.Equal(t, 2100*time.Millisecond, summary.Duration())
+	assert.True(t, summary.HasError)
+	assert.Equal(t, []string{"api", "db"}, summary.ServiceNames())
+
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  "api",
+		StartTimeMin: start.Add(-time.Minute),
+		StartTimeMax: start.Add(time.Minute),
+		DurationMin:  2 * time.Second,
+	}
+	ids, err := reader.FindTraceIDs(ctx, query)
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{slow}, ids)
+
+	query.DurationMin = 0
+	query.DurationMax = time.Second
+	query.OperationName = "GET /"
+	traces, err := reader.FindTraces(ctx, query)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(traces))
+	assert.Equal(t, fast, traces[0].Spans[0].TraceID)
+
+	// Page through both traces one by one
+	query = &spanstore.TraceQueryParameters{
+		ServiceName:  "api",
+		StartTimeMin: start.Add(-time.Minute),
+		StartTimeMax: start.Add(time.Minute),
+		NumTraces:    1,
+	}
+	var paged []model.TraceID
+	token := ""
+	for i := 0; i < 3; i++ {
+		var page []model.TraceID
+		page, token, err = reader.FindTraceIDsPage(ctx, query, token)
+		require.NoError(t, err)
+		paged = append(paged, page...)
+		if token == "" {
+			break
+		}
+	}
+	assert.Empty(t, token)
+	assert.ElementsMatch(t, []model.TraceID{slow, fast}, paged)
+
+	// Only the slow trace has a failed span in the "db" service
+	ids, err = reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+		ServiceName:  "db",
+		Tags:         map[string]string{"error": "true"},
+		StartTimeMin: start.Add(-time.Minute),
+		StartTimeMax: start.Add(time.Minute),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{slow}, ids)
+
+	// The numeric comparison, as "http.status_code>=500" is parsed by the query service
+	ids, err = reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+		ServiceName:  "api",
+		Tags:         map[string]string{"http.status_code>": "500"},
+		StartTimeMin: start.Add(-time.Minute),
+		StartTimeMax: start.Add(time.Minute),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{slow}, ids)
+
+	trace, err := reader.GetTrace(ctx, slow)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(trace.Spans))
+
+	_, err = reader.GetTrace(ctx, model.NewTraceID(0, 0x3))
+	assert.ErrorIs(t, err, spanstore.ErrTraceNotFound)
+
+	trace, err = reader.GetTraceWithHint(ctx, slow, TraceHint{
+		ServiceName:  "api",
+		StartTimeMin: start.Add(-time.Minute),
+		StartTimeMax: start.Add(time.Minute),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(trace.Spans))
+
+	// The expired items are hidden even before DynamoDB deletes them
+	expiredWriter := NewDdbWriter(client, "-test", -3600, dep, WriterOptions{})
+	expired := model.NewTraceID(0, 0x4)
+	require.NoError(t, expiredWriter.WriteSpan(ctx, makeTestSpan(expired, 5, "expired", "GET /", start,
+		100*time.Millisecond)))
+	_, err = reader.GetTrace(ctx, expired)
+	assert.ErrorIs(t, err, spanstore.ErrTraceNotFound)
+	ids, err = reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+		ServiceName:  "expired",
+		StartTimeMin: start.Add(-time.Minute),
+		StartTimeMax: start.Add(time.Minute),
+	})
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+}
+
+func TestGetTracesPartialResults(t *testing.T) {
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	now := time.Now()
+
+	// The cached traces don't need the database
+	cache := NewTraceCache(1<<20, time.Minute, time.Minute, nil)
+	var ids []model.TraceID
+	for i := 1; i <= 20; i++ {
+		tid := model.NewTraceID(0, uint64(i))
+		ids = append(ids, tid)
+		if i%5 == 0 {
+			cache.putMissing(tid)
+			continue
+		}
+		cache.put(tid, &model.Trace{Spans: []*model.Span{
+			makeTestSpan(tid, 1, "svc", "op", now.Add(-time.Hour), time.Second)}})
+	}
+
+	reader := NewDdbReader(nil, "-test", ReaderOptions{TraceCache: cache, MaxParallelTraceLoads: 3})
+	traces, errs := reader.GetTraces(ctx, ids)
+	require.Equal(t, 16, len(traces))
+	for i, trace := range traces {
+		// The order of the IDs is kept
+		assert.Equal(t, ids[i+i/4], trace.Spans[0].TraceID)
+	}
+	require.Equal(t, 4, len(errs))
+	assert.ErrorIs(t, errs[model.NewTraceID(0, 5)], spanstore.ErrTraceNotFound)
+
+	// The rate limiter gives up when the context is done, the cached traces
+	// are not limited
+	limited := NewDdbReader(nil, "-test", ReaderOptions{TraceCache: cache, TraceLoadRate: 1})
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	uncached := model.NewTraceID(0, 100)
+	traces, errs = limited.GetTraces(cancelled, append([]model.TraceID{uncached}, ids[:3]...))
+	assert.Equal(t, 3, len(traces))
+	require.Equal(t, 1, len(errs))
+	assert.ErrorIs(t, errs[uncached], context.Canceled)
+}
+
+func TestFindTracesFailedLoads(t *testing.T) {
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	now := time.Date(2023, 2, 10, 13, 30, 0, 0, time.UTC)
+	start := now.Add(-10 * time.Minute)
+
+	client := newFakeReaderClient()
+	loaded, failed := model.NewTraceID(0, 1), model.NewTraceID(0, 2)
+	for _, tid := range []model.TraceID{loaded, failed} {
+		client.addSummary(t, StoredTraceSummary{TraceId: formatTraceId(tid), Service: "api",
+			ServiceAndTime: serviceBucket("api", start), StartTime: start.UnixNano(),
+			EndTime: start.Add(time.Second).UnixNano(), SpanCount: 1})
+		client.addSpan(t, makeTestSpan(tid, 1, "api", "GET /", start, time.Second))
+	}
+	client.failures = map[string]error{formatTraceId(failed): errors.New("throttled")}
+	reader := newFakeReader(client, now, ReaderOptions{})
+
+	// The traces that failed to load are skipped
+	query := &spanstore.TraceQueryParameters{ServiceName: "api", NumTraces: 10,
+		StartTimeMin: now.Add(-time.Hour), StartTimeMax: now}
+	traces, err := reader.FindTraces(ctx, query)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(traces))
+	assert.Equal(t, loaded, traces[0].Spans[0].TraceID)
+
+	// Nothing was loaded
+	client.failures[formatTraceId(loaded)] = errors.New("throttled")
+	_, err = reader.FindTraces(ctx, query)
+	assert.EqualError(t, err, "failed to query the trace spans: throttled")
+}
+
+func newFakeReader(client *fakeReaderClient, now time.Time, opts ReaderOptions) *DdbReader {
+	reader := NewDdbReader(client, "-test", opts)
+	reader.timer = func() time.Time { return now }
+	return reader
+}
+
+func TestFindTracesWithFake(t *testing.T) {
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	now := time.Date(2023, 2, 10, 13, 30, 0, 0, time.UTC)
+	start := now.Add(-10 * time.Minute)
+
+	client := newFakeReaderClient()
+	fast, slow := model.NewTraceID(0, 1), model.NewTraceID(0, 2)
+	// The index has the most recent traces first
+	for _, rec := range []StoredTraceSummary{
+		{TraceId: formatTraceId(fast), Service: "api", StartTime: start.Add(time.Minute).UnixNano(),
+			EndTime: start.Add(time.Minute + time.Second).UnixNano()},
+		{TraceId: formatTraceId(slow), Service: "api", StartTime: start.UnixNano(),
+			EndTime: start.Add(5 * time.Second).UnixNano()},
+	} {
+		rec.ServiceAndTime = serviceBucket(rec.Service, time.Unix(0, rec.StartTime))
+		client.addSummary(t, rec)
+	}
+	client.addSpan(t, makeTestSpan(fast, 1, "api", "GET /", start.Add(time.Minute), time.Second))
+	client.addSpan(t, makeTestSpan(slow, 2, "api", "POST /", start, 5*time.Second))
+
+	reader := newFakeReader(client, now, ReaderOptions{})
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  "api",
+		StartTimeMin: now.Add(-time.Hour),
+		StartTimeMax: now,
+	}
+
+	// Without the duration filters the summaries are not read
+	ids, err := reader.FindTraceIDs(ctx, query)
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{fast, slow}, ids)
+	assert.Empty(t, client.queriesOf(TraceTableName, ""))
+
+	query.DurationMin = 2 * time.Second
+	traces, err := reader.FindTraces(ctx, query)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(traces))
+	assert.Equal(t, slow, traces[0].Spans[0].TraceID)
+	assert.Equal(t, 2, len(client.queriesOf(TraceTableName, "")))
+
+	// The operation search walks the spans
+	ids, err = reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+		ServiceName:   "api",
+		OperationName: "GET /",
+		StartTimeMin:  now.Add(-time.Hour),
+		StartTimeMax:  now,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []model.TraceID{fast}, ids)
+	// One query per bucket
+	assert.Equal(t, 2, len(client.queriesOf(SpanTableName, byOperationIndex)))
+}
+
+func TestFindTracesBudget(t *testing.T) {
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	now := time.Date(2023, 2, 10, 13, 30, 0, 0, time.UTC)
+
+	client := newFakeReaderClient()
+	client.pageSize, client.pageCapacity = 1, 1
+	var tids []model.TraceID
+	for i := 0; i < 3; i++ {
+		tid := model.NewTraceID(0, uint64(i+1))
+		tids = append(tids, tid)
+		start := now.Add(-time.Duration(i+1) * time.Minute)
+		client.addSummary(t, StoredTraceSummary{TraceId: formatTraceId(tid), Service: "api",
+			ServiceAndTime: serviceBucket("api", start), StartTime: start.UnixNano(),
+			EndTime: start.Add(time.Second).UnixNano()})
+		client.addSpan(t, makeTestSpan(tid, 1, "api", "GET /", start, time.Second))
+	}
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  "api",
+		StartTimeMin: now.Add(-time.Hour),
+		StartTimeMax: now,
+	}
+
+	// The activity and the first two pages use up the search's share of the budget,
+	// the rest is enough to load the traces
+	reader := newFakeReader(client, now, ReaderOptions{ReadCapacityBudget: 6})
+	traces, err := reader.FindTraces(ctx, query)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(traces))
+	assert.Equal(t, tids[0], traces[0].Spans[0].TraceID)
+	assert.Contains(t, traces[0].Spans[0].Warnings[0], "the results are incomplete")
+	assert.Empty(t, traces[1].Spans[0].Warnings)
+
+	ids, err := reader.FindTraceIDs(ctx, query)
+	assert.ErrorIs(t, err, ErrSearchBudgetExceeded)
+	assert.Equal(t, tids[:2], ids)
+
+	// No budget is left for loading the traces
+	reader = newFakeReader(client, now, ReaderOptions{ReadCapacityBudget: 2})
+	_, err = reader.FindTraces(ctx, query)
+	assert.ErrorIs(t, err, ErrSearchBudgetExceeded)
+
+	// The search that is not stopped has no warnings
+	reader = newFakeReader(client, now, ReaderOptions{ReadCapacityBudget: 100})
+	traces, err = reader.FindTraces(ctx, query)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(traces))
+	assert.Empty(t, traces[0].Spans[0].Warnings)
+}
+
+func TestExpiredItemsFilter(t *testing.T) {
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	now := time.Date(2023, 2, 10, 13, 30, 0, 0, time.UTC)
+
+	client := newFakeReaderClient()
+	for _, d := range []StoredDependency{
+		{TimeBucket: "2023-02-09", Dependency: "api#db", Parent: "api", Child: "db", CallCount: 3},
+		{TimeBucket: "2023-02-10", Dependency: "api#db", Parent: "api", Child: "db", CallCount: 2},
+		{TimeBucket: "2023-02-10", Dependency: "api#cache", Parent: "api", Child: "cache", CallCount: 1},
+	} {
+		item, err := attributevalue.MarshalMap(&d)
+		require.NoError(t, err)
+		client.add(DependencyTableName, "", d.TimeBucket, item)
+	}
+	tid := model.NewTraceID(0, 1)
+	client.addSummary(t, StoredTraceSummary{TraceId: formatTraceId(tid), Service: "api",
+		ServiceAndTime: serviceBucket("api", now), StartTime: now.UnixNano(),
+		EndTime: now.Add(time.Second).UnixNano()})
+	client.addSpan(t, makeTestSpan(tid, 1, "api", "GET /", now, time.Second))
+
+	reader := newFakeReader(client, now, ReaderOptions{})
+	deps, err := reader.GetDependencies(ctx, now, 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []model.DependencyLink{
+		{Parent: "api", Child: "db", CallCount: 5},
+		{Parent: "api", Child: "cache", CallCount: 1},
+	}, deps)
+
+	_, err = reader.FindTraces(ctx, &spanstore.TraceQueryParameters{ServiceName: "api",
+		DurationMin: time.Millisecond, Tags: map[string]string{"http.method": "GET"}})
+	require.NoError(t, err)
+	_, err = reader.GetOperations(ctx, spanstore.OperationQueryParameters{ServiceName: "api"})
+	require.NoError(t, err)
+
+	// All the reads skip the items past their TTL
+	assert.NotEmpty(t, client.queriesOf(SpanTableName, byTraceIdIndex))
+	assert.NotEmpty(t, client.queriesOf(TraceTableName, ""))
+	for _, q := range client.queries {
+		assert.Contains(t, aws.ToString(q.FilterExpression), "(attribute_not_exists(#ttl) OR #ttl > :now)",
+			aws.ToString(q.TableName))
+		assert.Equal(t, "ttl", q.ExpressionAttributeNames["#ttl"])
+		assert.Equal(t, &types.AttributeValueMemberN{Value: "1676035800"}, q.ExpressionAttributeValues[":now"])
+	}
+}
+
+func TestCachedTraceGetsNewSpans(t *testing.T) {
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	now := time.Date(2023, 2, 10, 13, 30, 0, 0, time.UTC)
+	tid := model.NewTraceID(0, 1)
+
+	client := newFakeReaderClient()
+	client.addSpan(t, makeTestSpan(tid, 1, "api", "GET /", now.Add(-time.Hour), time.Second))
+	cache := NewTraceCache(1<<20, time.Minute, time.Minute, nil)
+	cache.timer = func() time.Time { return now }
+	recent := NewRecentSpanCache(time.Minute)
+	reader := newFakeReader(client, now, ReaderOptions{TraceCache: cache, RecentSpans: recent})
+
+	trace, err := reader.GetTrace(ctx, tid)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(trace.Spans))
+
+	// A late span of the settled trace is written by this process, but it's not
+	// indexed yet
+	late, err := ToDdbModel(makeTestSpan(tid, 2, "api", "GET /", now.Add(-time.Hour), time.Second), nil)
+	require.NoError(t, err)
+	recent.add(late)
+	trace, err = reader.GetTrace(ctx, tid)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(trace.Spans))
+}
+
+func TestLegacyTraceIds(t *testing.T) {
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	now := time.Date(2023, 2, 10, 13, 30, 0, 0, time.UTC)
+	tid := model.NewTraceID(0, 0x1234)
+
+	client := newFakeReaderClient()
+	client.addSpan(t, makeTestSpan(tid, 1, "api", "get", now, time.Second))
+	legacy, err := ToDdbModel(makeTestSpan(tid, 2, "api", "get", now, time.Second), nil)
+	require.NoError(t, err)
+	legacy.TraceId = formatLegacyTraceId(tid)
+	item, err := attributevalue.MarshalMap(legacy)
+	require.NoError(t, err)
+	client.add(SpanTableName, byTraceIdIndex, legacy.TraceId, item)
+
+	// Only the canonical ID is queried by default
+	trace, err := newFakeReader(client, now, ReaderOptions{}).GetTrace(ctx, tid)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(trace.Spans))
+	assert.Equal(t, 1, len(client.queriesOf(SpanTableName, byTraceIdIndex)))
+
+	reader := newFakeReader(client, now, ReaderOptions{LegacyTraceIds: true})
+	trace, err = reader.GetTrace(ctx, tid)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(trace.Spans))
+	for _, s := range trace.Spans {
+		assert.Equal(t, tid, s.TraceID)
+	}
+
+	// "1234" is also the legacy ID of 0x1234, so it's not looked up for 0x1/0x234
+	client.queries = nil
+	_, err = reader.GetTrace(ctx, model.NewTraceID(1, 0x234))
+	assert.Equal(t, spanstore.ErrTraceNotFound, err)
+	assert.Equal(t, 1, len(client.queriesOf(SpanTableName, byTraceIdIndex)))
+}
+
+func TestSummaryUpdate(t *testing.T) {
+	tid := model.NewTraceID(0, 1)
+	span := makeTestSpan(tid, 1, "api", "GET /", time.Now(), time.Second, model.Bool("error", true))
+	stored, err := ToDdbModel(span, nil)
+	require.NoError(t, err)
+
+	update, names, values := summaryUpdate(span, stored, "100", true)
+	assert.Equal(t, "SET #bucket = if_not_exists(#bucket, :bucket), #start = if_not_exists(#start, :start), "+
+		"#end = if_not_exists(#end, :end), #ttl = :ttl, #root = :root, #err = :err ADD #count :one, #ops :ops", update)
+	assert.Equal(t, "span_count", names["#count"])
+
+	// The span that was saved before is not counted again
+	update, names, values = summaryUpdate(span, stored, "100", false)
+	assert.NotContains(t, update, "#count")
+	assert.NotContains(t, names, "#count")
+	assert.NotContains(t, values, ":one")
+}
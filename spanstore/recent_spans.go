@@ -0,0 +1,72 @@
+package spanstore
+
+import (
+	"github.com/jellydator/ttlcache/v3"
+	"sync"
+	"time"
+)
+
+const recentSpanCacheCapacity = 10000
+const maxRecentSpansPerTrace = 1000
+
+// RecentSpanCache keeps the spans written within the last few seconds, the reader
+// merges them with the spans from the "by-trace-id" index, which lags behind the
+// writes. The cache is bounded by the number of traces and by the number of spans
+// of each trace, the least recently written traces are evicted first.
+type RecentSpanCache struct {
+	window time.Duration
+
+	mtx    sync.Mutex
+	traces *ttlcache.Cache[string, []StoredSpan]
+}
+
+func NewRecentSpanCache(window time.Duration) *RecentSpanCache {
+	return &RecentSpanCache{
+		window: window,
+		traces: ttlcache.New[string, []StoredSpan](
+			ttlcache.WithCapacity[string, []StoredSpan](recentSpanCacheCapacity)),
+	}
+}
+
+func (c *RecentSpanCache) Start() {
+	go c.traces.Start()
+}
+
+func (c *RecentSpanCache) Stop() {
+	c.traces.Stop()
+}
+
+// add remembers the written span, the nil cache ignores it
+func (c *RecentSpanCache) add(stored *StoredSpan) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var spans []StoredSpan
+	if item := c.traces.Get(stored.TraceId); item != nil {
+		spans = item.Value()
+	}
+	if len(spans) >= maxRecentSpansPerTrace {
+		return
+	}
+	// Copy the slice, the readers might hold the previous one
+	spans = append(append(make([]StoredSpan, 0, len(spans)+1), spans...), *stored)
+	c.traces.Set(stored.TraceId, spans, c.window)
+}
+
+// get returns the recently written spans of the trace
+func (c *RecentSpanCache) get(traceId string) []StoredSpan {
+	if c == nil {
+		return nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	item := c.traces.Get(traceId, ttlcache.WithDisableTouchOnHit[string, []StoredSpan]())
+	if item == nil {
+		return nil
+	}
+	return item.Value()
+}
@@ -0,0 +1,41 @@
+package spanstore
+
+import (
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestRecentSpanCache(t *testing.T) {
+	var nilCache *RecentSpanCache
+	nilCache.add(&StoredSpan{TraceId: "1"})
+	assert.Nil(t, nilCache.get("1"))
+
+	cache := NewRecentSpanCache(50 * time.Millisecond)
+	tid := model.NewTraceID(0, 1)
+	start := time.Now()
+	for i := 1; i <= 2; i++ {
+		stored, err := ToDdbModel(makeTestSpan(tid, model.SpanID(i), "svc", "op", start, time.Second), nil)
+		require.NoError(t, err)
+		cache.add(stored)
+	}
+
+	spans := cache.get(formatTraceId(tid))
+	require.Equal(t, 2, len(spans))
+	trace, err := assembleTrace(append(spans, spans[0]))
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(trace.Spans))
+	assert.Equal(t, "host1", trace.Spans[0].Process.Tags[0].VStr)
+
+	// The number of spans per trace is bounded
+	for i := 0; i < maxRecentSpansPerTrace; i++ {
+		cache.add(&StoredSpan{TraceId: "big"})
+	}
+	cache.add(&StoredSpan{TraceId: "big"})
+	assert.Equal(t, maxRecentSpansPerTrace, len(cache.get("big")))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, cache.get(formatTraceId(tid)))
+}
@@ -0,0 +1,332 @@
+package spanstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jaegertracing/jaeger/model"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const RedactedWarning = "redacted"
+
+const redactionMask = "****"
+
+// hashedValue matches the values replaced by RedactionHash
+var hashedValue = regexp.MustCompile(`^sha256:[0-9a-f]{16}$`)
+
+type RedactionAction string
+
+const (
+	// RedactionHash replaces the data with its salted hash, so that it can still be
+	// searched for and correlated
+	RedactionHash RedactionAction = "hash"
+	// RedactionMask replaces the data with asterisks
+	RedactionMask RedactionAction = "mask"
+	// RedactionDrop removes the whole tag or log field
+	RedactionDrop RedactionAction = "drop"
+)
+
+type RedactionCheck string
+
+// RedactionCheckPaymentCard accepts the digit sequences that pass the Luhn check
+// and start with the prefix of a major card network (2-6), so that the timestamps
+// and the IDs of the same length are left alone
+const RedactionCheckPaymentCard RedactionCheck = "payment-card"
+
+// RedactionRule selects the sensitive data by the tag key and/or by the value.
+// If only the key pattern is set, the whole value is redacted. If the value regex is
+// set, then only the matching parts of the string values are redacted. The integer
+// values are matched in their decimal form, they become strings when redacted.
+type RedactionRule struct {
+	Name string `json:"name"`
+	// Case-insensitive glob pattern of the tag keys (see globMatch), matches all the
+	// keys if empty
+	KeyPattern string `json:"key_pattern,omitempty"`
+	// Regex of the sensitive values, the whole value is sensitive if it's empty
+	ValueRegex string `json:"value_regex,omitempty"`
+	// Validates the matches of the value regex, the ones that fail it are kept
+	Check  RedactionCheck  `json:"check,omitempty"`
+	Action RedactionAction `json:"action"`
+}
+
+type RedactionConfig struct {
+	// Add the DefaultRedactionRules to the rules
+	UseDefaultRules bool            `json:"use_default_rules,omitempty"`
+	Rules           []RedactionRule `json:"rules,omitempty"`
+	// The salt for the hashing action
+	HashSalt string `json:"hash_salt,omitempty"`
+}
+
+// DefaultRedactionRules cover the emails, the payment card numbers and the auth headers
+var DefaultRedactionRules = []RedactionRule{
+	{
+		Name:       "email",
+		ValueRegex: `[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}`,
+		Action:     RedactionMask,
+	},
+	{
+		Name:       "card-number",
+		ValueRegex: `\b(?:\d[ \-]?){12,18}\d\b`,
+		Check:      RedactionCheckPaymentCard,
+		Action:     RedactionMask,
+	},
+	{
+		Name:       "authorization-header",
+		KeyPattern: "*authorization*",
+		Action:     RedactionDrop,
+	},
+	{
+		Name:       "cookie-header",
+		KeyPattern: "*cookie*",
+		Action:     RedactionDrop,
+	},
+}
+
+func LoadRedactionConfig(fileName string) (*RedactionConfig, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &RedactionConfig{}
+	err = json.Unmarshal(data, res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the redaction config: %w", err)
+	}
+	return res, nil
+}
+
+type redactionRule struct {
+	RedactionRule
+	keyPattern string
+	valueRegex *regexp.Regexp
+}
+
+// Redactor scrubs the sensitive data from the span tags, the process tags and
+// the log fields
+type Redactor struct {
+	rules []redactionRule
+	salt  string
+}
+
+func NewRedactor(config *RedactionConfig) (*Redactor, error) {
+	res := &Redactor{salt: config.HashSalt}
+
+	rules := config.Rules
+	if config.UseDefaultRules {
+		rules = append(append([]RedactionRule{}, DefaultRedactionRules...), rules...)
+	}
+
+	for _, r := range rules {
+		switch r.Action {
+		case RedactionHash, RedactionMask, RedactionDrop:
+		default:
+			return nil, fmt.Errorf("unknown redaction action %q in the rule %s", r.Action, r.Name)
+		}
+		if r.KeyPattern == "" && r.ValueRegex == "" {
+			return nil, fmt.Errorf("the redaction rule %s matches everything", r.Name)
+		}
+		switch r.Check {
+		case "":
+		case RedactionCheckPaymentCard:
+			if r.ValueRegex == "" {
+				return nil, fmt.Errorf("the redaction rule %s has a check without a value regex", r.Name)
+			}
+		default:
+			return nil, fmt.Errorf("unknown redaction check %q in the rule %s", r.Check, r.Name)
+		}
+
+		compiled := redactionRule{RedactionRule: r, keyPattern: strings.ToLower(r.KeyPattern)}
+		if _, err := path.Match(compiled.keyPattern, ""); err != nil {
+			return nil, fmt.Errorf("bad key pattern in the rule %s: %w", r.Name, err)
+		}
+		if r.ValueRegex != "" {
+			re, err := regexp.Compile(r.ValueRegex)
+			if err != nil {
+				return nil, fmt.Errorf("bad value regex in the rule %s: %w", r.Name, err)
+			}
+			compiled.valueRegex = re
+		}
+		res.rules = append(res.rules, compiled)
+	}
+
+	return res, nil
+}
+
+// Redact scrubs the span in-place and marks it with the "redacted" warning if
+// anything has been changed. The tag slices are replaced rather than modified, so
+// they can be shared with other spans. Redacting the span again changes nothing:
+// the whole values that are already masked or hashed are left alone.
+func (r *Redactor) Redact(span *model.Span) {
+	changed := false
+
+	if tags, ok := r.redactTags(span.Tags); ok {
+		span.Tags = tags
+		changed = true
+	}
+
+	if span.Process != nil {
+		if tags, ok := r.redactTags(span.Process.Tags); ok {
+			span.Process = &model.Process{ServiceName: span.Process.ServiceName, Tags: tags}
+			changed = true
+		}
+	}
+
+	var logs []model.Log
+	for i, l := range span.Logs {
+		fields, ok := r.redactTags(l.Fields)
+		if !ok {
+			continue
+		}
+		if logs == nil {
+			logs = append([]model.Log{}, span.Logs...)
+		}
+		logs[i].Fields = fields
+	}
+	if logs != nil {
+		span.Logs = logs
+		changed = true
+	}
+
+	if changed && !hasWarning(span, RedactedWarning) {
+		span.Warnings = append(span.Warnings, RedactedWarning)
+	}
+}
+
+func hasWarning(span *model.Span, warning string) bool {
+	for _, w := range span.Warnings {
+		if w == warning {
+			return true
+		}
+	}
+	return false
+}
+
+// isRedacted checks if the whole value has been replaced by a redaction
+func isRedacted(tag model.KeyValue) bool {
+	return tag.VType == model.ValueType_STRING &&
+		(tag.VStr == redactionMask || hashedValue.MatchString(tag.VStr))
+}
+
+// redactTags returns the scrubbed copy of the tags and true, or false if nothing
+// needs to be scrubbed
+func (r *Redactor) redactTags(tags []model.KeyValue) ([]model.KeyValue, bool) {
+	var res []model.KeyValue
+	changed := false
+
+	for _, t := range tags {
+		redacted, keep, ok := r.redactTag(t)
+		if ok {
+			changed = true
+		}
+		if keep {
+			res = append(res, redacted)
+		}
+	}
+
+	if !changed {
+		return nil, false
+	}
+	return res, true
+}
+
+// redactTag applies the rules to the tag, it returns the new tag, whether the tag
+// should be kept, and whether anything has been changed
+func (r *Redactor) redactTag(tag model.KeyValue) (model.KeyValue, bool, bool) {
+	changed := false
+	key := strings.ToLower(tag.Key)
+
+	for _, rule := range r.rules {
+		if rule.keyPattern != "" && !globMatch(rule.keyPattern, key) {
+			continue
+		}
+		if isRedacted(tag) && rule.Action != RedactionDrop {
+			continue
+		}
+
+		if rule.valueRegex == nil {
+			// The whole value is sensitive
+			if rule.Action == RedactionDrop {
+				return tag, false, true
+			}
+			tag = model.String(tag.Key, r.redactValue(rule.Action, flattenValue(tag)))
+			changed = true
+			continue
+		}
+
+		// Only the string and the integer values can be matched by regexes
+		var value string
+		switch tag.VType {
+		case model.ValueType_STRING:
+			value = tag.VStr
+		case model.ValueType_INT64:
+			value = strconv.FormatInt(tag.VInt64, 10)
+		default:
+			continue
+		}
+		matched := false
+		redacted := rule.valueRegex.ReplaceAllStringFunc(value, func(s string) string {
+			if !rule.accepts(s) {
+				return s
+			}
+			matched = true
+			return r.redactValue(rule.Action, s)
+		})
+		if !matched {
+			continue
+		}
+		if rule.Action == RedactionDrop {
+			return tag, false, true
+		}
+		tag = model.String(tag.Key, redacted)
+		changed = true
+	}
+
+	return tag, true, changed
+}
+
+// accepts checks the match of the value regex
+func (r *redactionRule) accepts(match string) bool {
+	if r.Check != RedactionCheckPaymentCard {
+		return true
+	}
+	var digits []int
+	for _, c := range match {
+		if c >= '0' && c <= '9' {
+			digits = append(digits, int(c-'0'))
+		}
+	}
+	if len(digits) == 0 || digits[0] < 2 || digits[0] > 6 {
+		return false
+	}
+	return luhnValid(digits)
+}
+
+func luhnValid(digits []int) bool {
+	sum := 0
+	for i := range digits {
+		d := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+func (r *Redactor) redactValue(action RedactionAction, value string) string {
+	if action == RedactionHash {
+		sum := sha256.Sum256([]byte(r.salt + value))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	}
+	return redactionMask
+}
@@ -0,0 +1,71 @@
+package spanstore
+
+import (
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestRedaction(t *testing.T) {
+	redactor, err := NewRedactor(&RedactionConfig{
+		UseDefaultRules: true,
+		HashSalt:        "salt",
+		Rules: []RedactionRule{
+			{Name: "user-id", KeyPattern: "user.id", Action: RedactionHash},
+		},
+	})
+	require.NoError(t, err)
+
+	processTags := []model.KeyValue{model.String("hostname", "host1")}
+	span := makeTestSpan(model.NewTraceID(0, 1), 1, "svc", "op", time.Now(), time.Second,
+		model.String("message", "sent to john@example.com"),
+		model.String("HTTP.Request.Header.Authorization", "Bearer xyz"),
+		model.String("card", "paid with 4111 1111 1111 1111"),
+		model.Int64("user.id", 42),
+		// The digit sequences that are not card numbers are kept
+		model.String("timestamp", "at 1676035800123"),
+		model.String("order.id", "4111111111111112"),
+		model.Int64("payment.card", 4111111111111111),
+		model.Int64("elapsed", 1676035800123))
+	span.Process.Tags = processTags
+	span.Logs = []model.Log{{Fields: []model.KeyValue{model.String("event", "login by a@b.io")}}}
+
+	redactor.Redact(span)
+
+	assert.Equal(t, []model.KeyValue{
+		model.String("message", "sent to ****"),
+		model.String("card", "paid with ****"),
+		model.String("user.id", "sha256:ba5bf48c9d94fef6"),
+		model.String("timestamp", "at 1676035800123"),
+		model.String("order.id", "4111111111111112"),
+		model.String("payment.card", "****"),
+		model.Int64("elapsed", 1676035800123),
+	}, span.Tags)
+	assert.Equal(t, "login by ****", span.Logs[0].Fields[0].VStr)
+	assert.Equal(t, []string{RedactedWarning}, span.Warnings)
+	// The process was not touched
+	assert.Equal(t, processTags, span.Process.Tags)
+
+	// Redacting again (e.g. when the trace is archived) changes nothing
+	redactedTags := span.Tags
+	redactor.Redact(span)
+	assert.Equal(t, redactedTags, span.Tags)
+	assert.Equal(t, []string{RedactedWarning}, span.Warnings)
+
+	// Nothing to redact
+	clean := makeTestSpan(model.NewTraceID(0, 1), 2, "svc", "op", time.Now(), time.Second,
+		model.String("message", "hello"))
+	redactor.Redact(clean)
+	assert.Empty(t, clean.Warnings)
+
+	_, err = NewRedactor(&RedactionConfig{Rules: []RedactionRule{{Name: "all", Action: RedactionMask}}})
+	assert.Error(t, err)
+	_, err = NewRedactor(&RedactionConfig{Rules: []RedactionRule{
+		{Name: "bad", KeyPattern: "a", Action: "encrypt"}}})
+	assert.Error(t, err)
+	_, err = NewRedactor(&RedactionConfig{Rules: []RedactionRule{
+		{Name: "bad", ValueRegex: `\d+`, Check: "iban", Action: RedactionMask}}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,68 @@
+package spanstore
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SchemaOptions are the security and durability settings of all the tables
+type SchemaOptions struct {
+	// The ID or ARN of the customer-managed KMS key, the AWS owned key is used if
+	// it's empty. The aliases are not supported, DynamoDB reports the key's ARN.
+	KmsKeyId            string
+	PointInTimeRecovery bool
+	DeletionProtection  bool
+	Tags                map[string]string
+}
+
+// RegisterFlags adds the command line flags for the options
+func (o *SchemaOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.Var((*kmsKeyFlag)(&o.KmsKeyId), "kms-key-id",
+		"The customer-managed KMS key (ID or key ARN, not an alias) to encrypt the tables with")
+	fs.BoolVar(&o.PointInTimeRecovery, "point-in-time-recovery", false,
+		"Enable the point-in-time recovery of the tables")
+	fs.BoolVar(&o.DeletionProtection, "deletion-protection", false,
+		"Enable the deletion protection of the tables")
+	fs.Var((*tagsFlag)(&o.Tags), "table-tags", "The tags of the tables, as key=value[,key=value...]")
+}
+
+type kmsKeyFlag string
+
+func (k *kmsKeyFlag) String() string {
+	return string(*k)
+}
+
+func (k *kmsKeyFlag) Set(value string) error {
+	if strings.HasPrefix(value, "alias/") || strings.Contains(value, ":alias/") {
+		return fmt.Errorf("the KMS key must be given by its ID or ARN, not an alias: %s", value)
+	}
+	*k = kmsKeyFlag(value)
+	return nil
+}
+
+type tagsFlag map[string]string
+
+func (t *tagsFlag) String() string {
+	var res []string
+	for k, v := range *t {
+		res = append(res, k+"="+v)
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
+
+func (t *tagsFlag) Set(value string) error {
+	if *t == nil {
+		*t = map[string]string{}
+	}
+	for _, kv := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("the tag must be key=value: %s", kv)
+		}
+		(*t)[k] = v
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package spanstore
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSchemaOptions(t *testing.T) {
+	var opts SchemaOptions
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts.RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-kms-key-id", "1234abcd-12ab-34cd-56ef-1234567890ab", "-deletion-protection",
+		"-table-tags", "team=tracing,env=prod", "-table-tags", "cost-center="}))
+
+	assert.Equal(t, SchemaOptions{
+		KmsKeyId:           "1234abcd-12ab-34cd-56ef-1234567890ab",
+		DeletionProtection: true,
+		Tags:               map[string]string{"team": "tracing", "env": "prod", "cost-center": ""},
+	}, opts)
+	assert.Error(t, fs.Parse([]string{"-table-tags", "team"}))
+	assert.Error(t, fs.Parse([]string{"-kms-key-id", "alias/tracing"}))
+	assert.Error(t, fs.Parse([]string{"-kms-key-id", "arn:aws:kms:us-east-1:111122223333:alias/tracing"}))
+
+	tables := Tables(opts)
+	assert.Equal(t, len(ddbTables), len(tables))
+	for _, table := range tables {
+		assert.Equal(t, "1234abcd-12ab-34cd-56ef-1234567890ab", table.KmsKeyId)
+		assert.True(t, table.DeletionProtection)
+	}
+	// The defaults are not changed
+	assert.Empty(t, ddbTables[0].KmsKeyId)
+}
@@ -0,0 +1,189 @@
+package spanstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// The page token remembers at most this many traces to not return them again, the
+// traces past the limit might be returned twice
+const maxSpanningTraces = 1000
+
+// searchCursor is the state of the paged search, it's passed to the client as the
+// opaque page token
+type searchCursor struct {
+	// The fingerprint of the query, the token can't be used with another query
+	Query string `json:"q"`
+	// The time range, it's resolved on the first page so that the pages are stable
+	MinTime int64 `json:"min"`
+	MaxTime int64 `json:"max"`
+	// The buckets that are not searched yet (in Unix seconds), the first one is the
+	// current bucket
+	Buckets []int64 `json:"b"`
+	// The key of the last visited item of the current bucket
+	StartKey map[string]cursorKeyValue `json:"k,omitempty"`
+	// The traces returned from the current bucket
+	Seen []string `json:"s,omitempty"`
+	// The returned traces that can be found again in the other buckets
+	Spanning []spanningTrace `json:"sp,omitempty"`
+}
+
+type spanningTrace struct {
+	TraceId string `json:"t"`
+	// The earliest bucket the trace can be found in (in Unix seconds)
+	Bucket int64 `json:"b"`
+}
+
+type cursorKeyValue struct {
+	S string `json:"s,omitempty"`
+	N string `json:"n,omitempty"`
+}
+
+// encodeCursor makes the page token, it's signed with the key so that the clients
+// can't make the search skip the traces or read other partitions
+func encodeCursor(cursor *searchCursor, key []byte) (string, error) {
+	if cursor == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(cursorMac(encoded, key)), nil
+}
+
+func decodeCursor(token string, query *spanstore.TraceQueryParameters, key []byte) (*searchCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidPageToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, cursorMac(encoded, key)) {
+		return nil, ErrInvalidPageToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+	res := &searchCursor{}
+	err = json.Unmarshal(data, res)
+	if err != nil || res.Query != queryFingerprint(query) || len(res.Buckets) == 0 {
+		return nil, ErrInvalidPageToken
+	}
+	return res, nil
+}
+
+func cursorMac(encoded string, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(encoded))
+	return mac.Sum(nil)[:16]
+}
+
+// spanningTraces lists the traces that can still be found in the remaining buckets,
+// the ones whose earliest bucket has been passed are dropped. At most
+// maxSpanningTraces are kept, the ones that stay findable the longest.
+func spanningTraces(spanning map[model.TraceID]int64, buckets []int64) []spanningTrace {
+	if len(buckets) == 0 {
+		return nil
+	}
+	// The trace can only be found again in the buckets from its earliest one
+	latest := buckets[0]
+	for _, b := range buckets {
+		if b > latest {
+			latest = b
+		}
+	}
+	var res []spanningTrace
+	for tid, bucket := range spanning {
+		if bucket > latest {
+			continue
+		}
+		res = append(res, spanningTrace{TraceId: formatTraceId(tid), Bucket: bucket})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Bucket != res[j].Bucket {
+			return res[i].Bucket < res[j].Bucket
+		}
+		return res[i].TraceId < res[j].TraceId
+	})
+	if len(res) > maxSpanningTraces {
+		res = res[:maxSpanningTraces]
+	}
+	return res
+}
+
+// queryFingerprint identifies the search, the page size is not a part of it
+func queryFingerprint(query *spanstore.TraceQueryParameters) string {
+	var tagKeys []string
+	for k := range query.Tags {
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Strings(tagKeys)
+
+	hash := sha256.New()
+	_, _ = fmt.Fprintf(hash, "%q %q %d %d %d %d", query.ServiceName, query.OperationName,
+		unixNanoOrZero(query.StartTimeMin), unixNanoOrZero(query.StartTimeMax),
+		query.DurationMin, query.DurationMax)
+	for _, k := range tagKeys {
+		_, _ = fmt.Fprintf(hash, " %q=%q", k, query.Tags[k])
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+func unixNanoOrZero(tm time.Time) int64 {
+	if tm.IsZero() {
+		return 0
+	}
+	return tm.UnixNano()
+}
+
+func (c *searchCursor) currentBucket() time.Time {
+	return time.Unix(c.Buckets[0], 0).UTC()
+}
+
+func (c *searchCursor) startKey() map[string]types.AttributeValue {
+	if len(c.StartKey) == 0 {
+		return nil
+	}
+	res := map[string]types.AttributeValue{}
+	for k, v := range c.StartKey {
+		if v.N != "" {
+			res[k] = &types.AttributeValueMemberN{Value: v.N}
+		} else {
+			res[k] = &types.AttributeValueMemberS{Value: v.S}
+		}
+	}
+	return res
+}
+
+func (c *searchCursor) setStartKey(key map[string]types.AttributeValue) {
+	c.StartKey = nil
+	for k, v := range key {
+		if c.StartKey == nil {
+			c.StartKey = map[string]cursorKeyValue{}
+		}
+		switch av := v.(type) {
+		case *types.AttributeValueMemberS:
+			c.StartKey[k] = cursorKeyValue{S: av.Value}
+		case *types.AttributeValueMemberN:
+			c.StartKey[k] = cursorKeyValue{N: av.Value}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package spanstore
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchCursor(t *testing.T) {
+	query := &spanstore.TraceQueryParameters{
+		ServiceName:  "api",
+		Tags:         map[string]string{"http.status_code>": "500", "error": "true"},
+		StartTimeMin: time.Date(2023, 2, 10, 13, 0, 0, 0, time.UTC),
+		NumTraces:    10,
+	}
+	cursor := &searchCursor{
+		Query:    queryFingerprint(query),
+		MinTime:  1,
+		MaxTime:  2,
+		Buckets:  []int64{1676034000, 1676030400},
+		Seen:     []string{"00000000000000000000000000000001"},
+		Spanning: []spanningTrace{{TraceId: "00000000000000000000000000000002", Bucket: 1676030400}},
+	}
+	startKey := map[string]types.AttributeValue{
+		"trace_id":         &types.AttributeValueMemberS{Value: "00000000000000000000000000000001"},
+		"start_time_nanos": &types.AttributeValueMemberN{Value: "1676034000000000000"},
+	}
+	cursor.setStartKey(startKey)
+
+	key := []byte("secret")
+	token, err := encodeCursor(cursor, key)
+	require.NoError(t, err)
+
+	// The page size is not a part of the query
+	query.NumTraces = 20
+	decoded, err := decodeCursor(token, query, key)
+	require.NoError(t, err)
+	assert.Equal(t, cursor, decoded)
+	assert.Equal(t, startKey, decoded.startKey())
+	assert.Equal(t, time.Date(2023, 2, 10, 13, 0, 0, 0, time.UTC), decoded.currentBucket())
+
+	query.Tags["error"] = "false"
+	_, err = decodeCursor(token, query, key)
+	assert.ErrorIs(t, err, ErrInvalidPageToken)
+	query.Tags["error"] = "true"
+	_, err = decodeCursor("!"+token, query, key)
+	assert.ErrorIs(t, err, ErrInvalidPageToken)
+
+	// The tokens that were changed or signed with another key are rejected
+	_, err = decodeCursor(token, query, []byte("other"))
+	assert.ErrorIs(t, err, ErrInvalidPageToken)
+	cursor.Buckets = cursor.Buckets[1:]
+	forged, err := encodeCursor(cursor, []byte("other"))
+	require.NoError(t, err)
+	_, err = decodeCursor(strings.Split(forged, ".")[0]+token[strings.Index(token, "."):], query, key)
+	assert.ErrorIs(t, err, ErrInvalidPageToken)
+	_, err = decodeCursor(strings.Split(token, ".")[0], query, key)
+	assert.ErrorIs(t, err, ErrInvalidPageToken)
+
+	// The last page has no token
+	token, err = encodeCursor(nil, key)
+	require.NoError(t, err)
+	assert.Empty(t, token)
+	decoded, err = decodeCursor("", query, key)
+	require.NoError(t, err)
+	assert.Nil(t, decoded)
+}
+
+func TestSpanningTraces(t *testing.T) {
+	spanning := map[model.TraceID]int64{
+		model.NewTraceID(0, 1): 1676030400,
+		model.NewTraceID(0, 2): 1676034000,
+		model.NewTraceID(0, 3): 1676026800,
+	}
+
+	// The trace that starts after the remaining buckets can't be found anymore
+	assert.Equal(t, []spanningTrace{
+		{TraceId: formatTraceId(model.NewTraceID(0, 3)), Bucket: 1676026800},
+		{TraceId: formatTraceId(model.NewTraceID(0, 1)), Bucket: 1676030400},
+	}, spanningTraces(spanning, []int64{1676030400, 1676026800}))
+	// The buckets are not necessarily in the time order
+	assert.Equal(t, []spanningTrace{
+		{TraceId: formatTraceId(model.NewTraceID(0, 3)), Bucket: 1676026800},
+		{TraceId: formatTraceId(model.NewTraceID(0, 1)), Bucket: 1676030400},
+	}, spanningTraces(spanning, []int64{1676026800, 1676030400}))
+	assert.Empty(t, spanningTraces(spanning, nil))
+
+	// The number of the traces is limited
+	for i := 0; i < maxSpanningTraces+10; i++ {
+		spanning[model.NewTraceID(1, uint64(i))] = 1676023200
+	}
+	res := spanningTraces(spanning, []int64{1676034000})
+	assert.Equal(t, maxSpanningTraces, len(res))
+	assert.Equal(t, int64(1676023200), res[len(res)-1].Bucket)
+}
@@ -0,0 +1,274 @@
+package spanstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	. "github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/metrics"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"go.uber.org/zap"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// FilterRule selects the spans to drop or to downsample. All the set conditions
+// must match for the rule to apply.
+type FilterRule struct {
+	Name string `json:"name"`
+	// Glob pattern of the service names
+	Service string `json:"service,omitempty"`
+	// Regex of the operation names
+	OperationRegex string `json:"operation_regex,omitempty"`
+	// The tags that must be present on the span or on its process (e.g. "hostname"),
+	// with their flattened values
+	Tags map[string]string `json:"tags,omitempty"`
+	// Only the spans that are shorter than this duration (e.g. "50ms") match
+	MaxDuration string `json:"max_duration,omitempty"`
+	// The fraction of the matching traces to keep, zero drops all the matching spans.
+	// The decision is made by hashing the trace ID, so it's consistent for all the
+	// spans of a trace.
+	KeepRatio float64 `json:"keep_ratio,omitempty"`
+}
+
+// FilterConfig is the list of the filter rules, the first matching rule wins
+type FilterConfig struct {
+	Rules []FilterRule `json:"rules,omitempty"`
+	// The salt for the trace ID hashing
+	HashSalt string `json:"hash_salt,omitempty"`
+}
+
+func LoadFilterConfig(fileName string) (*FilterConfig, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &FilterConfig{}
+	err = json.Unmarshal(data, res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the span filter config: %w", err)
+	}
+	return res, nil
+}
+
+type filterRuleMetrics struct {
+	Matched metrics.Counter `metric:"span_filter_matched"`
+	Dropped metrics.Counter `metric:"span_filter_dropped"`
+}
+
+type filterRule struct {
+	FilterRule
+	operation   *regexp.Regexp
+	maxDuration time.Duration
+	sampler     *spanstore.Sampler
+	metrics     filterRuleMetrics
+}
+
+func compileFilterRules(config *FilterConfig, factory metrics.Factory) ([]*filterRule, error) {
+	var res []*filterRule
+	for _, r := range config.Rules {
+		if r.KeepRatio < 0 || r.KeepRatio > 1 {
+			return nil, fmt.Errorf("the keep ratio of the rule %s must be within [0, 1]", r.Name)
+		}
+
+		rule := &filterRule{FilterRule: r}
+		if _, err := path.Match(r.Service, ""); err != nil {
+			return nil, fmt.Errorf("bad service pattern in the rule %s: %w", r.Name, err)
+		}
+		if r.OperationRegex != "" {
+			re, err := regexp.Compile(r.OperationRegex)
+			if err != nil {
+				return nil, fmt.Errorf("bad operation regex in the rule %s: %w", r.Name, err)
+			}
+			rule.operation = re
+		}
+		if r.MaxDuration != "" {
+			dur, err := time.ParseDuration(r.MaxDuration)
+			if err != nil {
+				return nil, fmt.Errorf("bad max duration in the rule %s: %w", r.Name, err)
+			}
+			rule.maxDuration = dur
+		}
+		if r.KeepRatio > 0 {
+			rule.sampler = spanstore.NewSampler(r.KeepRatio, config.HashSalt)
+		}
+		metrics.MustInit(&rule.metrics, factory, map[string]string{"rule": r.Name})
+
+		res = append(res, rule)
+	}
+	return res, nil
+}
+
+func (r *filterRule) matches(span *model.Span) bool {
+	if r.Service != "" {
+		if ok, _ := path.Match(r.Service, span.Process.ServiceName); !ok {
+			return false
+		}
+	}
+	if r.operation != nil && !r.operation.MatchString(span.OperationName) {
+		return false
+	}
+	if r.maxDuration != 0 && span.Duration >= r.maxDuration {
+		return false
+	}
+	if len(r.Tags) != 0 {
+		found := map[string]bool{}
+		r.matchTags(span.Tags, found)
+		if span.Process != nil {
+			r.matchTags(span.Process.Tags, found)
+		}
+		if len(found) < len(r.Tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchTags records the keys of the rule's tags that the tags match
+func (r *filterRule) matchTags(tags []model.KeyValue, found map[string]bool) {
+	for _, t := range tags {
+		if v, ok := r.Tags[t.Key]; ok && v == flattenValue(t) {
+			found[t.Key] = true
+		}
+	}
+}
+
+// SpanFilter drops or downsamples the spans according to the rules, it can reload
+// the rules when their file changes
+type SpanFilter struct {
+	fileName string
+	factory  metrics.Factory
+
+	mtx     sync.RWMutex
+	rules   []*filterRule
+	modTime time.Time
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// NewSpanFilter creates the filter with the rules from the file
+func NewSpanFilter(fileName string, factory metrics.Factory) (*SpanFilter, error) {
+	res := &SpanFilter{
+		fileName: fileName,
+		factory:  factory,
+		stop:     make(chan struct{}),
+	}
+	_, err := res.reload()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// reload re-reads the rules if the file has changed since the last load
+func (f *SpanFilter) reload() (bool, error) {
+	info, err := os.Stat(f.fileName)
+	if err != nil {
+		return false, err
+	}
+
+	f.mtx.RLock()
+	unchanged := info.ModTime().Equal(f.modTime)
+	f.mtx.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	config, err := LoadFilterConfig(f.fileName)
+	if err != nil {
+		return false, err
+	}
+	rules, err := compileFilterRules(config, f.factory)
+	if err != nil {
+		return false, err
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.rules = rules
+	f.modTime = info.ModTime()
+
+	return true, nil
+}
+
+// Start watches the rules file for changes. Bad rules are reported and ignored,
+// the filter keeps using the previous ones.
+func (f *SpanFilter) Start(ctx context.Context, interval time.Duration) {
+	f.done.Add(1)
+	go func() {
+		defer f.done.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-f.stop:
+				return
+			case <-ticker.C:
+			}
+
+			reloaded, err := f.reload()
+			if err != nil {
+				L(ctx).Error("Failed to reload the span filter rules", zap.Error(err),
+					zap.String("file-name", f.fileName))
+			} else if reloaded {
+				L(ctx).Info("Reloaded the span filter rules", zap.String("file-name", f.fileName))
+			}
+		}
+	}()
+}
+
+func (f *SpanFilter) Stop() {
+	close(f.stop)
+	f.done.Wait()
+}
+
+// Keep decides whether the span should be persisted
+func (f *SpanFilter) Keep(span *model.Span) bool {
+	f.mtx.RLock()
+	rules := f.rules
+	f.mtx.RUnlock()
+
+	for _, r := range rules {
+		if !r.matches(span) {
+			continue
+		}
+		r.metrics.Matched.Inc(1)
+
+		if r.sampler != nil && r.sampler.ShouldSample(span) {
+			return true
+		}
+		r.metrics.Dropped.Inc(1)
+		return false
+	}
+
+	return true
+}
+
+// FilteringWriter passes only the spans accepted by the filter to the next writer
+type FilteringWriter struct {
+	filter *SpanFilter
+	next   spanstore.Writer
+}
+
+var _ spanstore.Writer = &FilteringWriter{}
+
+func NewFilteringWriter(filter *SpanFilter, next spanstore.Writer) *FilteringWriter {
+	return &FilteringWriter{
+		filter: filter,
+		next:   next,
+	}
+}
+
+func (w *FilteringWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	if !w.filter.Keep(span) {
+		return nil
+	}
+	return w.next.WriteSpan(ctx, span)
+}
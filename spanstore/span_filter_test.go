@@ -0,0 +1,81 @@
+package spanstore
+
+import (
+	"expvar"
+	"github.com/SimplestCloud/jaeger-ddb-spanstore/utils"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpanFilter(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(fileName, []byte(`{"rules": [
+		{"name": "health", "operation_regex": "^GET /health", "max_duration": "50ms"},
+		{"name": "probes", "service": "k8s-*", "tags": {"probe": "true"}, "keep_ratio": 0.5},
+		{"name": "canary", "tags": {"hostname": "canary1", "debug": "true"}}
+	]}`), 0600))
+
+	filter, err := NewSpanFilter(fileName, utils.NewExpvarFactory("test_span_filter"))
+	require.NoError(t, err)
+
+	now := time.Now()
+	assert.False(t, filter.Keep(makeTestSpan(model.NewTraceID(0, 1), 1, "api", "GET /health",
+		now, time.Millisecond)))
+	// Slow health checks are kept
+	assert.True(t, filter.Keep(makeTestSpan(model.NewTraceID(0, 1), 1, "api", "GET /health",
+		now, time.Second)))
+	assert.True(t, filter.Keep(makeTestSpan(model.NewTraceID(0, 1), 1, "api", "GET /users",
+		now, time.Millisecond)))
+
+	// The process tags are matched too, all the rule's tags must be present
+	canary := makeTestSpan(model.NewTraceID(0, 1), 1, "api", "GET /users", now, time.Millisecond,
+		model.Bool("debug", true))
+	canary.Process.Tags = []model.KeyValue{model.String("hostname", "canary1")}
+	assert.False(t, filter.Keep(canary))
+	canary.Tags = []model.KeyValue{model.Bool("debug", true), model.Bool("debug", true)}
+	canary.Process.Tags = []model.KeyValue{model.String("hostname", "host1")}
+	assert.True(t, filter.Keep(canary))
+
+	// Downsampling is consistent for the spans of a trace
+	kept := 0
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		tid := model.NewTraceID(rnd.Uint64(), rnd.Uint64())
+		first := filter.Keep(makeTestSpan(tid, 1, "k8s-probe", "check",
+			now, time.Second, model.String("probe", "true")))
+		second := filter.Keep(makeTestSpan(tid, 2, "k8s-probe", "check",
+			now, time.Second, model.String("probe", "true")))
+		assert.Equal(t, first, second)
+		if first {
+			kept++
+		}
+	}
+	assert.InDelta(t, 500, kept, 100)
+
+	assert.Equal(t, "1", expvar.Get("test_span_filter.span_filter_matched|rule=health").String())
+	assert.Equal(t, "1", expvar.Get("test_span_filter.span_filter_dropped|rule=health").String())
+	assert.Equal(t, "2000", expvar.Get("test_span_filter.span_filter_matched|rule=probes").String())
+
+	// Reload the rules
+	require.NoError(t, os.WriteFile(fileName, []byte(`{"rules": [{"name": "all", "service": "*"}]}`), 0600))
+	require.NoError(t, os.Chtimes(fileName, now.Add(time.Minute), now.Add(time.Minute)))
+	reloaded, err := filter.reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.False(t, filter.Keep(makeTestSpan(model.NewTraceID(0, 1), 1, "api", "GET /users",
+		now, time.Millisecond)))
+
+	// Bad rules are not loaded
+	require.NoError(t, os.WriteFile(fileName, []byte(`{"rules": [{"name": "bad", "keep_ratio": 2}]}`), 0600))
+	require.NoError(t, os.Chtimes(fileName, now.Add(2*time.Minute), now.Add(2*time.Minute)))
+	_, err = filter.reload()
+	assert.Error(t, err)
+	assert.False(t, filter.Keep(makeTestSpan(model.NewTraceID(0, 1), 1, "api", "GET /users",
+		now, time.Millisecond)))
+}
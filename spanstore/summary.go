@@ -0,0 +1,223 @@
+package spanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jaegertracing/jaeger/model"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StoredTraceSummary is the per-service part of the trace summary. Each service
+// participating in a trace gets its own record (keyed by the trace ID and the service
+// name), so that traces can be found through the "by-service-time" index for any
+// of their services. The trace-level summary is assembled by merging all the
+// records of the trace, the set of the records is the trace's service set.
+type StoredTraceSummary struct {
+	TraceId string `dynamodbav:"trace_id,omitempty"`
+	Service string `dynamodbav:"service,omitempty"`
+	// The bucket of the earliest span of this service within the trace
+	ServiceAndTime string `dynamodbav:"service_and_time,omitempty"`
+	// Set only on the record of the service that owns the root span
+	RootOperation string   `dynamodbav:"root_operation,omitempty"`
+	Operations    []string `dynamodbav:"operations,omitempty,stringset"`
+	StartTime     int64    `dynamodbav:"start_time_nanos,omitempty"`
+	EndTime       int64    `dynamodbav:"end_time_nanos,omitempty"`
+	SpanCount     int64    `dynamodbav:"span_count,omitempty"`
+	HasError      bool     `dynamodbav:"has_error,omitempty"`
+}
+
+// TraceSummary is the trace-level summary, merged from the per-service records
+type TraceSummary struct {
+	TraceId       string
+	RootService   string
+	RootOperation string
+	StartTime     int64
+	EndTime       int64
+	SpanCount     int64
+	HasError      bool
+	// Service name -> operations of the service seen in the trace
+	Services map[string][]string
+}
+
+func (t *TraceSummary) Duration() time.Duration {
+	return time.Duration(t.EndTime - t.StartTime)
+}
+
+// ServiceNames returns the sorted list of the trace's services
+func (t *TraceSummary) ServiceNames() []string {
+	var res []string
+	for s := range t.Services {
+		res = append(res, s)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// mergeSummaries assembles the trace-level summary from the per-service records
+func mergeSummaries(traceId string, records []StoredTraceSummary) *TraceSummary {
+	res := &TraceSummary{
+		TraceId:  traceId,
+		Services: map[string][]string{},
+	}
+	for _, r := range records {
+		if res.StartTime == 0 || (r.StartTime != 0 && r.StartTime < res.StartTime) {
+			res.StartTime = r.StartTime
+		}
+		if r.EndTime > res.EndTime {
+			res.EndTime = r.EndTime
+		}
+		if r.RootOperation != "" {
+			res.RootService = r.Service
+			res.RootOperation = r.RootOperation
+		}
+		res.SpanCount += r.SpanCount
+		res.HasError = res.HasError || r.HasError
+		res.Services[r.Service] = r.Operations
+	}
+	return res
+}
+
+// summaryUpdate builds the update of the summary record with the span. Everything
+// but the span count can be applied repeatedly, so the count is only incremented
+// for the new spans.
+func summaryUpdate(span *model.Span, stored *StoredSpan, ttl string,
+	newSpan bool) (string, map[string]string, map[string]types.AttributeValue) {
+
+	names := map[string]string{
+		"#bucket": "service_and_time",
+		"#start":  "start_time_nanos",
+		"#end":    "end_time_nanos",
+		"#ops":    "operations",
+		"#ttl":    "ttl",
+	}
+	values := map[string]types.AttributeValue{
+		":bucket": &types.AttributeValueMemberS{Value: stored.ServiceAndTime},
+		":start":  &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stored.StartTime)},
+		":end":    &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", stored.StartTime+int64(stored.Duration))},
+		":ops":    &types.AttributeValueMemberSS{Value: []string{span.OperationName}},
+		":ttl":    &types.AttributeValueMemberN{Value: ttl},
+	}
+	sets := []string{
+		"#bucket = if_not_exists(#bucket, :bucket)",
+		"#start = if_not_exists(#start, :start)",
+		"#end = if_not_exists(#end, :end)",
+		"#ttl = :ttl",
+	}
+	if isRootSpan(span) {
+		names["#root"] = "root_operation"
+		values[":root"] = &types.AttributeValueMemberS{Value: span.OperationName}
+		sets = append(sets, "#root = :root")
+	}
+	if isErrorSpan(span) {
+		names["#err"] = "has_error"
+		values[":err"] = &types.AttributeValueMemberBOOL{Value: true}
+		sets = append(sets, "#err = :err")
+	}
+
+	adds := []string{"#ops :ops"}
+	if newSpan {
+		names["#count"] = "span_count"
+		values[":one"] = &types.AttributeValueMemberN{Value: "1"}
+		adds = append([]string{"#count :one"}, adds...)
+	}
+	return "SET " + strings.Join(sets, ", ") + " ADD " + strings.Join(adds, ", "), names, values
+}
+
+// updateTraceSummary folds the span into the summary record of its service. The
+// counters and sets are updated atomically, while the trace's time boundaries are
+// maintained with conditional updates that only ever extend them. The span is
+// only counted if it's new, i.e. it's not a retried write. The span that was
+// stored by a failed write is not counted on retry.
+func (d *DdbWriter) updateTraceSummary(ctx context.Context, span *model.Span,
+	stored *StoredSpan, ttl string, newSpan bool) error {
+
+	tableName := aws.String(TraceTableName + d.suffix)
+	key := map[string]types.AttributeValue{
+		"trace_id": &types.AttributeValueMemberS{Value: stored.TraceId},
+		"service":  &types.AttributeValueMemberS{Value: span.Process.ServiceName},
+	}
+
+	start := stored.StartTime
+	end := stored.StartTime + int64(stored.Duration)
+	update, names, values := summaryUpdate(span, stored, ttl, newSpan)
+	bucket := values[":bucket"]
+
+	res, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 tableName,
+		Key:                       key,
+		UpdateExpression:          aws.String(update),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+		ReturnConsumedCapacity:    types.ReturnConsumedCapacityTotal,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update the trace summary: %w", err)
+	}
+	meterFrom(ctx).addWrite(res.ConsumedCapacity)
+
+	var current StoredTraceSummary
+	err = attributevalue.UnmarshalMap(res.Attributes, &current)
+	if err != nil {
+		return err
+	}
+
+	// The span extends the trace into the past, move the start and the bucket
+	if current.StartTime > start {
+		err = d.updateSummaryBoundary(ctx, tableName, key,
+			"SET #start = :start, #bucket = :bucket", "#start > :start",
+			map[string]string{"#start": "start_time_nanos", "#bucket": "service_and_time"},
+			map[string]types.AttributeValue{":start": values[":start"], ":bucket": bucket})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The span extends the trace into the future
+	if current.EndTime < end {
+		err = d.updateSummaryBoundary(ctx, tableName, key,
+			"SET #end = :end", "#end < :end",
+			map[string]string{"#end": "end_time_nanos"},
+			map[string]types.AttributeValue{":end": values[":end"]})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *DdbWriter) updateSummaryBoundary(ctx context.Context, tableName *string,
+	key map[string]types.AttributeValue, update, condition string,
+	names map[string]string, values map[string]types.AttributeValue) error {
+
+	res, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 tableName,
+		Key:                       key,
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnConsumedCapacity:    types.ReturnConsumedCapacityTotal,
+	})
+	if err == nil {
+		meterFrom(ctx).addWrite(res.ConsumedCapacity)
+	}
+
+	// A concurrent writer has already moved the boundary even further
+	var condFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &condFailed) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update the trace summary boundary: %w", err)
+	}
+	return nil
+}
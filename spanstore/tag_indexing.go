@@ -0,0 +1,160 @@
+package spanstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/metrics"
+	"os"
+	"path"
+	"strings"
+)
+
+// TagIndexingRules select the tags that are copied into the searchable FlattenedTags.
+// The patterns are globs, where "*" and "?" match "/" as well (see globMatch).
+type TagIndexingRules struct {
+	// Glob patterns of the tags to index, all the tags are indexed if it's empty
+	Allow []string `json:"allow,omitempty"`
+	// Glob patterns of the tags that are never indexed, they win over Allow
+	Deny []string `json:"deny,omitempty"`
+	// The maximum length of the flattened tag value, longer values are not
+	// indexed. Zero means no limit.
+	MaxValueLength int `json:"max_value_length,omitempty"`
+}
+
+// TagIndexingConfig is the global tag indexing rules with the per-service overrides.
+// A service override replaces the global Allow list and MaxValueLength if they are
+// set, and its Deny list is added to the global one.
+type TagIndexingConfig struct {
+	TagIndexingRules
+	Services map[string]TagIndexingRules `json:"services,omitempty"`
+}
+
+func LoadTagIndexingConfig(fileName string) (*TagIndexingConfig, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &TagIndexingConfig{}
+	err = json.Unmarshal(data, res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the tag indexing config: %w", err)
+	}
+	return res, nil
+}
+
+type tagIndexingMetrics struct {
+	Denied  metrics.Counter `metric:"tags_dropped_from_index" tags:"reason=denied"`
+	TooLong metrics.Counter `metric:"tags_dropped_from_index" tags:"reason=too_long"`
+}
+
+// TagIndexer applies the TagIndexingConfig to the span tags. The nil TagIndexer
+// indexes all the tags.
+type TagIndexer struct {
+	defaults TagIndexingRules
+	services map[string]TagIndexingRules
+
+	metrics tagIndexingMetrics
+}
+
+func NewTagIndexer(config *TagIndexingConfig, factory metrics.Factory) (*TagIndexer, error) {
+	res := &TagIndexer{
+		defaults: config.TagIndexingRules,
+		services: map[string]TagIndexingRules{},
+	}
+	metrics.MustInit(&res.metrics, factory, nil)
+
+	err := validatePatterns(config.TagIndexingRules)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pre-merge the overrides with the defaults
+	for service, rules := range config.Services {
+		err = validatePatterns(rules)
+		if err != nil {
+			return nil, fmt.Errorf("bad rules for the service %s: %w", service, err)
+		}
+
+		merged := config.TagIndexingRules
+		if len(rules.Allow) != 0 {
+			merged.Allow = rules.Allow
+		}
+		merged.Deny = append(append([]string{}, config.Deny...), rules.Deny...)
+		if rules.MaxValueLength != 0 {
+			merged.MaxValueLength = rules.MaxValueLength
+		}
+		res.services[service] = merged
+	}
+
+	return res, nil
+}
+
+func validatePatterns(rules TagIndexingRules) error {
+	for _, p := range append(append([]string{}, rules.Allow...), rules.Deny...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("bad tag pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if globMatch(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch is path.Match where "*" and "?" match "/" as well, the tag keys are not
+// paths. The "/" is swapped for a character the keys don't have.
+func globMatch(pattern, key string) bool {
+	ok, _ := path.Match(strings.ReplaceAll(pattern, "/", "\x00"), strings.ReplaceAll(key, "/", "\x00"))
+	return ok
+}
+
+func (t *TagIndexer) rulesFor(service string) *TagIndexingRules {
+	if rules, ok := t.services[service]; ok {
+		return &rules
+	}
+	return &t.defaults
+}
+
+// flattenTags copies the indexable tags into the map of their string values, and
+// the numeric ones into the map of their numbers
+func (t *TagIndexer) flattenTags(service string, tags []model.KeyValue, res map[string]string,
+	numeric map[string]attributevalue.Number) {
+
+	if t == nil {
+		for _, tag := range tags {
+			res[tag.Key] = flattenValue(tag)
+			if num, ok := numericValue(tag); ok {
+				numeric[tag.Key] = num
+			}
+		}
+		return
+	}
+
+	rules := t.rulesFor(service)
+	for _, tag := range tags {
+		if matchesAny(rules.Deny, tag.Key) ||
+			(len(rules.Allow) != 0 && !matchesAny(rules.Allow, tag.Key)) {
+			t.metrics.Denied.Inc(1)
+			continue
+		}
+
+		value := flattenValue(tag)
+		if rules.MaxValueLength != 0 && len(value) > rules.MaxValueLength {
+			t.metrics.TooLong.Inc(1)
+			continue
+		}
+		res[tag.Key] = value
+		if num, ok := numericValue(tag); ok {
+			numeric[tag.Key] = num
+		}
+	}
+}
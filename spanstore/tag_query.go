@@ -0,0 +1,69 @@
+package spanstore
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// tagPredicate is the numeric comparison of the tag value, like "http.status_code>=500"
+type tagPredicate struct {
+	Key string
+	// The DynamoDB comparison operator
+	Op    string
+	Value string
+}
+
+// The comparison operators, the longer ones go first
+var tagOperators = []struct {
+	query string
+	ddb   string
+}{
+	{">=", ">="},
+	{"<=", "<="},
+	{"!=", "<>"},
+	{">", ">"},
+	{"<", "<"},
+}
+
+// parseTagPredicate detects the numeric comparison in the query tag. The query
+// tags are parsed as "key=value" pairs, so "http.status_code>=500" arrives as the
+// "http.status_code>" key with the "500" value, and "db.rows>1000" arrives as the
+// key with an empty (or "true") value. Everything else is an exact match.
+func parseTagPredicate(key, value string) (*tagPredicate, bool) {
+	// The "=" was taken as the separator, the operator is the rest of it
+	if len(key) > 1 && strings.ContainsAny(key[len(key)-1:], "<>!") {
+		if op, ok := ddbOperator(key[len(key)-1:] + "="); ok && isNumber(value) {
+			return &tagPredicate{Key: key[:len(key)-1], Op: op, Value: value}, true
+		}
+	}
+
+	if value != "" && value != "true" {
+		return nil, false
+	}
+	for _, o := range tagOperators {
+		idx := strings.Index(key, o.query)
+		if idx <= 0 {
+			continue
+		}
+		if num := key[idx+len(o.query):]; isNumber(num) {
+			return &tagPredicate{Key: key[:idx], Op: o.ddb, Value: num}, true
+		}
+		return nil, false
+	}
+	return nil, false
+}
+
+func ddbOperator(op string) (string, bool) {
+	for _, o := range tagOperators {
+		if o.query == op {
+			return o.ddb, true
+		}
+	}
+	return "", false
+}
+
+func isNumber(s string) bool {
+	v, err := strconv.ParseFloat(s, 64)
+	return err == nil && !math.IsNaN(v) && !math.IsInf(v, 0)
+}
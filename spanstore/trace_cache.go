@@ -0,0 +1,185 @@
+package spanstore
+
+import (
+	"container/list"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/metrics"
+	"sync"
+	"time"
+)
+
+// The approximate memory overhead of a cache entry, it bounds the number of the
+// negative entries
+const traceCacheEntryOverhead = 128
+
+type traceCacheMetrics struct {
+	Hits         metrics.Counter `metric:"trace_cache_requests" tags:"result=hit"`
+	NegativeHits metrics.Counter `metric:"trace_cache_requests" tags:"result=negative_hit"`
+	Misses       metrics.Counter `metric:"trace_cache_requests" tags:"result=miss"`
+	Bytes        metrics.Gauge   `metric:"trace_cache_bytes"`
+	Traces       metrics.Gauge   `metric:"trace_cache_traces"`
+}
+
+type traceCacheEntry struct {
+	traceId model.TraceID
+	// The nil trace is the negative entry
+	trace *model.Trace
+	size  int64
+	// Only the negative entries expire
+	expires time.Time
+}
+
+// TraceCache keeps the results of GetTrace for the traces that are not expected to
+// change anymore, i.e. their newest span is older than the settle time. The traces
+// that were not found are remembered for a short time. The writer drops the traces
+// it writes the spans of, but the spans written by other processes (e.g. a late
+// export of an old trace) are only seen once the trace is evicted. The cache is bounded by the
+// approximate size of the traces in bytes, the least recently used traces are
+// evicted first.
+type TraceCache struct {
+	maxBytes    int64
+	settleTime  time.Duration
+	negativeTtl time.Duration
+	timer       func() time.Time
+
+	mtx     sync.Mutex
+	entries map[model.TraceID]*list.Element
+	lru     *list.List
+	bytes   int64
+
+	metrics traceCacheMetrics
+}
+
+func NewTraceCache(maxBytes int64, settleTime, negativeTtl time.Duration, factory metrics.Factory) *TraceCache {
+	res := &TraceCache{
+		maxBytes:    maxBytes,
+		settleTime:  settleTime,
+		negativeTtl: negativeTtl,
+		timer:       time.Now,
+		entries:     map[model.TraceID]*list.Element{},
+		lru:         list.New(),
+	}
+	if factory == nil {
+		factory = metrics.NullFactory
+	}
+	metrics.MustInit(&res.metrics, factory, nil)
+	return res
+}
+
+// get looks up the trace, it returns false on a cache miss, and the nil trace for
+// the trace that is known to be missing. The nil cache always misses.
+func (c *TraceCache) get(traceId model.TraceID) (*model.Trace, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.entries[traceId]
+	if !ok {
+		c.metrics.Misses.Inc(1)
+		return nil, false
+	}
+	entry := elem.Value.(*traceCacheEntry)
+	if entry.trace == nil {
+		if c.timer().After(entry.expires) {
+			c.remove(elem)
+			c.metrics.Misses.Inc(1)
+			return nil, false
+		}
+		c.metrics.NegativeHits.Inc(1)
+		c.lru.MoveToFront(elem)
+		return nil, true
+	}
+
+	c.metrics.Hits.Inc(1)
+	c.lru.MoveToFront(elem)
+
+	// The callers may add the warnings, but they don't change the spans
+	res := *entry.trace
+	res.Spans = append([]*model.Span{}, entry.trace.Spans...)
+	res.Warnings = append([]string{}, entry.trace.Warnings...)
+	return &res, true
+}
+
+// put remembers the trace if it has settled
+func (c *TraceCache) put(traceId model.TraceID, trace *model.Trace) {
+	if c == nil {
+		return
+	}
+
+	var newest time.Time
+	for _, s := range trace.Spans {
+		if end := s.StartTime.Add(s.Duration); end.After(newest) {
+			newest = end
+		}
+	}
+	if c.timer().Sub(newest) < c.settleTime {
+		return
+	}
+
+	// The caller keeps the trace, so we cache a copy
+	cached := *trace
+	cached.Spans = append([]*model.Span{}, trace.Spans...)
+	cached.Warnings = append([]string{}, trace.Warnings...)
+	c.store(&traceCacheEntry{
+		traceId: traceId,
+		trace:   &cached,
+		size:    int64(trace.Size()) + traceCacheEntryOverhead,
+	})
+}
+
+// invalidate drops the trace, e.g. when it gets a new span
+func (c *TraceCache) invalidate(traceId model.TraceID) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if elem, ok := c.entries[traceId]; ok {
+		c.remove(elem)
+		c.metrics.Bytes.Update(c.bytes)
+		c.metrics.Traces.Update(int64(len(c.entries)))
+	}
+}
+
+// putMissing remembers that the trace was not found
+func (c *TraceCache) putMissing(traceId model.TraceID) {
+	if c == nil || c.negativeTtl == 0 {
+		return
+	}
+	c.store(&traceCacheEntry{
+		traceId: traceId,
+		size:    traceCacheEntryOverhead,
+		expires: c.timer().Add(c.negativeTtl),
+	})
+}
+
+func (c *TraceCache) store(entry *traceCacheEntry) {
+	if entry.size > c.maxBytes {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if elem, ok := c.entries[entry.traceId]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.traceId] = c.lru.PushFront(entry)
+	c.bytes += entry.size
+
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+
+	c.metrics.Bytes.Update(c.bytes)
+	c.metrics.Traces.Update(int64(len(c.entries)))
+}
+
+func (c *TraceCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*traceCacheEntry)
+	delete(c.entries, entry.traceId)
+	c.bytes -= entry.size
+}
@@ -0,0 +1,79 @@
+package spanstore
+
+import (
+	"expvar"
+	"github.com/SimplestCloud/jaeger-ddb-spanstore/utils"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTraceCache(t *testing.T) {
+	now := time.Date(2023, 2, 10, 13, 0, 0, 0, time.UTC)
+	makeTrace := func(tid model.TraceID, start time.Time) *model.Trace {
+		return &model.Trace{Spans: []*model.Span{
+			makeTestSpan(tid, 1, "svc", "op", start, time.Second),
+			makeTestSpan(tid, 2, "svc", "op", start.Add(time.Second), time.Second),
+		}}
+	}
+	size := int64(makeTrace(model.NewTraceID(0, 1), now).Size()) + traceCacheEntryOverhead
+
+	cache := NewTraceCache(2*size+traceCacheEntryOverhead-1, time.Minute, time.Minute,
+		utils.NewExpvarFactory("test_trace_cache"))
+	cache.timer = func() time.Time { return now }
+
+	// The trace that is still being written is not cached
+	first, second, third := model.NewTraceID(0, 1), model.NewTraceID(0, 2), model.NewTraceID(0, 3)
+	cache.put(first, makeTrace(first, now.Add(-time.Minute)))
+	_, ok := cache.get(first)
+	assert.False(t, ok)
+
+	cache.put(first, makeTrace(first, now.Add(-time.Hour)))
+	trace, ok := cache.get(first)
+	require.True(t, ok)
+	assert.Equal(t, 2, len(trace.Spans))
+
+	// The callers can't change the cached trace
+	trace.Warnings = append(trace.Warnings, "warning")
+	trace, _ = cache.get(first)
+	assert.Empty(t, trace.Warnings)
+
+	cache.putMissing(second)
+	trace, ok = cache.get(second)
+	assert.True(t, ok)
+	assert.Nil(t, trace)
+
+	// The second trace is the least recently used one, it's evicted
+	_, _ = cache.get(first)
+	cache.put(third, makeTrace(third, now.Add(-time.Hour)))
+	_, ok = cache.get(second)
+	assert.False(t, ok)
+	_, ok = cache.get(third)
+	assert.True(t, ok)
+	assert.Equal(t, 2*size, cache.bytes)
+
+	// The negative entries expire
+	cache.putMissing(second)
+	now = now.Add(2 * time.Minute)
+	_, ok = cache.get(second)
+	assert.False(t, ok)
+
+	assert.Equal(t, "4", expvar.Get("test_trace_cache.trace_cache_requests|result=hit").String())
+	assert.Equal(t, "1", expvar.Get("test_trace_cache.trace_cache_requests|result=negative_hit").String())
+	assert.Equal(t, "3", expvar.Get("test_trace_cache.trace_cache_requests|result=miss").String())
+
+	// The traces that get new spans are dropped
+	cache.invalidate(third)
+	_, ok = cache.get(third)
+	assert.False(t, ok)
+	assert.Empty(t, cache.entries)
+	assert.Equal(t, int64(0), cache.bytes)
+
+	var nilCache *TraceCache
+	nilCache.invalidate(first)
+	nilCache.put(first, makeTrace(first, now.Add(-time.Hour)))
+	_, ok = nilCache.get(first)
+	assert.False(t, ok)
+}
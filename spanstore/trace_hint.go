@@ -0,0 +1,159 @@
+package spanstore
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jaegertracing/jaeger/model"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The hinted load gives up and uses the "by-trace-id" index if it'd have to query
+// more buckets than this
+const maxHintedBuckets = 48
+
+// TraceHint tells where the trace's spans are, e.g. from a log line or an exemplar
+// that referenced the trace
+type TraceHint struct {
+	// A service that participated in the trace
+	ServiceName string
+	// The range of the start times of the service's spans
+	StartTimeMin time.Time
+	StartTimeMax time.Time
+}
+
+// GetTraceWithHint loads the trace from the base table with the consistent reads,
+// instead of the "by-trace-id" index that lags behind the writes. The buckets of
+// the trace's services are taken from its summary, plus the hinted ones as the
+// summary might not have caught up with the hinted service yet. The index is still
+// used if the trace's buckets can't be figured out, or nothing is found in them
+// (e.g. the spans were written with the legacy trace IDs). The trace is not cached,
+// as the spans outside the known buckets are missed.
+func (r *DdbReader) GetTraceWithHint(ctx context.Context, traceID model.TraceID,
+	hint TraceHint) (*model.Trace, error) {
+
+	if hint.StartTimeMin.After(hint.StartTimeMax) {
+		return nil, ErrStartTimeMinGreaterThanMax
+	}
+
+	ctx, done := r.capacity.start(ctx, "get_trace_with_hint", 0)
+	defer done()
+	return r.getTrace(ctx, traceID, func(ctx context.Context, traceID model.TraceID) ([]StoredSpan, error) {
+		return r.loadHintedTrace(ctx, traceID, hint)
+	}, false)
+}
+
+func (r *DdbReader) loadHintedTrace(ctx context.Context, traceID model.TraceID,
+	hint TraceHint) ([]StoredSpan, error) {
+
+	traceId := formatTraceId(traceID)
+	records, err := r.loadSummaryRecords(ctx, traceId, true)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets, ok := hintedBuckets(records, hint)
+	if !ok {
+		return r.loadIndexedTrace(ctx, traceID)
+	}
+
+	var res []StoredSpan
+	for _, bucket := range buckets {
+		spans, err := r.loadBucketTraceSpans(ctx, bucket, traceId)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, spans...)
+	}
+	if len(res) == 0 {
+		return r.loadIndexedTrace(ctx, traceID)
+	}
+
+	// The process record is stored in the bucket of the span that saved it first,
+	// which can be outside the loaded buckets. The index has all of them.
+	if hasUnresolvedProcesses(res) {
+		indexed, err := r.loadIndexedTrace(ctx, traceID)
+		if err != nil {
+			return nil, err
+		}
+		for i := range indexed {
+			if isProcessRecord(&indexed[i]) {
+				res = append(res, indexed[i])
+			}
+		}
+	}
+	return res, nil
+}
+
+// hasUnresolvedProcesses checks if some spans refer to the process records that
+// are not among the loaded ones
+func hasUnresolvedProcesses(stored []StoredSpan) bool {
+	processes := map[string]bool{}
+	for i := range stored {
+		if isProcessRecord(&stored[i]) {
+			processes[strings.TrimPrefix(stored[i].SpanId, processRecordPrefix)] = true
+		}
+	}
+	for i := range stored {
+		if stored[i].ProcessHash != "" && !processes[stored[i].ProcessHash] {
+			return true
+		}
+	}
+	return false
+}
+
+// hintedBuckets lists the "service_and_time" buckets that have the trace's spans.
+// It returns false if they are not known, or there are too many of them.
+func hintedBuckets(records []StoredTraceSummary, hint TraceHint) ([]string, bool) {
+	buckets := map[string]bool{}
+	for _, rec := range records {
+		if rec.StartTime == 0 || rec.EndTime < rec.StartTime {
+			return nil, false
+		}
+		// The spans start before the end of the service's part of the trace
+		for _, b := range timeBuckets(time.Unix(0, rec.StartTime), time.Unix(0, rec.EndTime)) {
+			buckets[serviceBucket(rec.Service, b)] = true
+		}
+	}
+
+	// The summary is updated after the span is written, its record of the hinted
+	// service can be missing or not cover the hinted span yet
+	if hint.ServiceName != "" && !hint.StartTimeMin.IsZero() {
+		for _, b := range timeBuckets(hint.StartTimeMin, hint.StartTimeMax) {
+			buckets[serviceBucket(hint.ServiceName, b)] = true
+		}
+	}
+
+	if len(buckets) == 0 || len(buckets) > maxHintedBuckets {
+		return nil, false
+	}
+	var res []string
+	for b := range buckets {
+		res = append(res, b)
+	}
+	sort.Strings(res)
+	return res, true
+}
+
+// loadBucketTraceSpans reads the trace's spans and process records in the bucket
+func (r *DdbReader) loadBucketTraceSpans(ctx context.Context, bucket, traceId string) ([]StoredSpan, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(SpanTableName + r.suffix),
+		KeyConditionExpression: aws.String("#bucket = :bucket AND begins_with(#seg, :prefix)"),
+		ConsistentRead:         aws.Bool(true),
+		ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+		ExpressionAttributeNames: map[string]string{
+			"#bucket": "service_and_time",
+			"#seg":    "segment_id",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":bucket": &types.AttributeValueMemberS{Value: bucket},
+			":prefix": &types.AttributeValueMemberS{Value: traceId + "-"},
+		},
+	}
+	input.FilterExpression = aws.String(r.notExpired(input.ExpressionAttributeNames, input.ExpressionAttributeValues))
+	return r.querySpans(ctx, input)
+}
@@ -0,0 +1,124 @@
+package spanstore
+
+import (
+	"context"
+	"github.com/Cyberax/argus-vision/visibility/logging"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestHintedBuckets(t *testing.T) {
+	start := time.Date(2023, 2, 10, 13, 50, 0, 0, time.UTC)
+	hint := TraceHint{
+		ServiceName:  "api",
+		StartTimeMin: start.Add(-time.Minute),
+		StartTimeMax: start.Add(time.Minute),
+	}
+
+	// The hinted service has no summary record yet
+	records := []StoredTraceSummary{{
+		Service:   "db",
+		StartTime: start.UnixNano(),
+		EndTime:   start.Add(20 * time.Minute).UnixNano(),
+	}}
+	buckets, ok := hintedBuckets(records, hint)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"api-2023-02-10-13", "db-2023-02-10-13", "db-2023-02-10-14"}, buckets)
+
+	// The summary record doesn't cover the hinted span yet, both are queried
+	records = append(records, StoredTraceSummary{
+		Service:   "api",
+		StartTime: start.Add(time.Hour).UnixNano(),
+		EndTime:   start.Add(time.Hour).UnixNano(),
+	})
+	buckets, ok = hintedBuckets(records, hint)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"api-2023-02-10-13", "api-2023-02-10-14", "db-2023-02-10-13",
+		"db-2023-02-10-14"}, buckets)
+
+	// Nothing is known
+	_, ok = hintedBuckets(nil, TraceHint{})
+	assert.False(t, ok)
+
+	// Too long
+	_, ok = hintedBuckets(nil, TraceHint{
+		ServiceName:  "api",
+		StartTimeMin: start.Add(-7 * 24 * time.Hour),
+		StartTimeMax: start,
+	})
+	assert.False(t, ok)
+}
+
+func TestGetTraceWithHintNoSummary(t *testing.T) {
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	now := time.Date(2023, 2, 10, 13, 30, 0, 0, time.UTC)
+	start := now.Add(-2 * time.Hour)
+	tid := model.NewTraceID(0, 1)
+
+	// The span is in the base table, but neither in the summary nor in the indexes
+	stored, err := ToDdbModel(makeTestSpan(tid, 1, "api", "GET /", start, time.Second), nil)
+	require.NoError(t, err)
+	item, err := attributevalue.MarshalMap(stored)
+	require.NoError(t, err)
+	client := newFakeReaderClient()
+	client.add(SpanTableName, "", stored.ServiceAndTime, item)
+
+	cache := NewTraceCache(1<<20, time.Minute, time.Minute, nil)
+	cache.timer = func() time.Time { return now }
+	reader := newFakeReader(client, now, ReaderOptions{TraceCache: cache})
+	trace, err := reader.GetTraceWithHint(ctx, tid, TraceHint{
+		ServiceName:  "api",
+		StartTimeMin: start.Add(-time.Minute),
+		StartTimeMax: start.Add(time.Minute),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(trace.Spans))
+	assert.Empty(t, client.queriesOf(SpanTableName, byTraceIdIndex))
+
+	// The hinted load might have missed the spans, it's not cached
+	_, ok := cache.get(tid)
+	assert.False(t, ok)
+}
+
+func TestGetTraceWithHintProcessOutsideBuckets(t *testing.T) {
+	ctx := logging.ImbueContext(context.Background(), zap.NewNop())
+	now := time.Date(2023, 2, 10, 13, 30, 0, 0, time.UTC)
+	start := now.Add(-2 * time.Hour)
+	tid := model.NewTraceID(0, 1)
+	client := newFakeReaderClient()
+
+	// The process record was saved by an earlier span, in an earlier bucket
+	span := makeTestSpan(tid, 1, "api", "GET /", start, time.Second)
+	span.Process.Tags = []model.KeyValue{model.String("hostname", "api-1")}
+	stored, err := ToDdbModel(span, nil)
+	require.NoError(t, err)
+	hash, err := processHash(span.Process)
+	require.NoError(t, err)
+	record := detachProcess(stored, hash)
+	record.ServiceAndTime = serviceBucket("api", timeBuckets(start.Add(-time.Hour), start.Add(-time.Hour))[0])
+
+	spanItem, err := attributevalue.MarshalMap(stored)
+	require.NoError(t, err)
+	recordItem, err := attributevalue.MarshalMap(record)
+	require.NoError(t, err)
+	client.add(SpanTableName, "", stored.ServiceAndTime, spanItem)
+	client.add(SpanTableName, "", record.ServiceAndTime, recordItem)
+	client.add(SpanTableName, byTraceIdIndex, stored.TraceId, spanItem)
+	client.add(SpanTableName, byTraceIdIndex, stored.TraceId, recordItem)
+
+	reader := newFakeReader(client, now, ReaderOptions{})
+	trace, err := reader.GetTraceWithHint(ctx, tid, TraceHint{
+		ServiceName:  "api",
+		StartTimeMin: start.Add(-time.Minute),
+		StartTimeMax: start.Add(time.Minute),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(trace.Spans))
+	assert.Equal(t, span.Process.Tags, trace.Spans[0].Process.Tags)
+	assert.Equal(t, 1, len(client.queriesOf(SpanTableName, byTraceIdIndex)))
+}
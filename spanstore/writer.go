@@ -8,14 +8,41 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/pkg/metrics"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/jellydator/ttlcache/v3"
 	"time"
 )
 
+// WriterOptions are the optional stages of the write path
+type WriterOptions struct {
+	// Selects the searchable tags, all the tags are searchable if it's nil
+	TagIndexer *TagIndexer
+	// Scrubs the sensitive data before it's persisted, nothing is scrubbed if it's nil
+	Redactor *Redactor
+	// Store each distinct process once per trace instead of embedding it into spans
+	DedupProcesses bool
+	// Counts the spans in the hourly buckets for the searches, nothing is counted if it's nil
+	Activity *ActivityTracker
+	// Receives the consumed capacity metrics, they are discarded if it's nil
+	Metrics metrics.Factory
+	// Keeps the written spans for the reader until the indexes catch up, nothing is
+	// kept if it's nil
+	RecentSpans *RecentSpanCache
+	// The reader's cache, the traces that get new spans are dropped from it
+	TraceCache *TraceCache
+}
+
 type DdbWriter struct {
 	client *dynamodb.Client
 	suffix string
 	dep    *DependencyManager
+	opts   WriterOptions
+
+	// The process records that have been saved already, with their TTLs
+	processCache *ttlcache.Cache[string, int64]
+
+	capacity *capacityReporter
 
 	ttlSeconds int64
 	timer      func() time.Time
@@ -24,34 +51,61 @@ type DdbWriter struct {
 var _ spanstore.Writer = &DdbWriter{}
 
 func NewDdbWriter(client *dynamodb.Client, suffix string, ttlSeconds int64,
-	dep *DependencyManager) *DdbWriter {
+	dep *DependencyManager, opts WriterOptions) *DdbWriter {
 
 	return &DdbWriter{
 		client:     client,
 		suffix:     suffix,
 		ttlSeconds: ttlSeconds,
 		dep:        dep,
+		opts:       opts,
 		timer:      time.Now,
+		processCache: ttlcache.New[string, int64](
+			ttlcache.WithCapacity[string, int64](processCacheCapacity)),
+		capacity: newCapacityReporter(opts.Metrics),
 	}
 }
 
 func (d *DdbWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	ctx, done := d.capacity.start(ctx, "write_span", 0)
+	defer done()
+
 	serviceName := span.Process.ServiceName
 	operationName := span.OperationName
 
-	ddbModel, err := ToDdbModel(span)
+	// Scrub the sensitive data before anything gets persisted
+	if d.opts.Redactor != nil {
+		d.opts.Redactor.Redact(span)
+	}
+
+	ddbModel, err := ToDdbModel(span, d.opts.TagIndexer)
 	if err != nil {
 		return fmt.Errorf("failed to convert to DDB model: %w", err)
 	}
 
+	// Set the record TTL
+	expiry := time.Now().Unix() + d.ttlSeconds
+	ttl := fmt.Sprintf("%d", expiry)
+
+	// The cached copy keeps the process, even if it's stored separately
+	cached := *ddbModel
+
+	if d.opts.DedupProcesses {
+		hash, err := processHash(span.Process)
+		if err != nil {
+			return fmt.Errorf("failed to hash the process: %w", err)
+		}
+		err = d.storeProcessRecord(ctx, detachProcess(ddbModel, hash), expiry)
+		if err != nil {
+			return err
+		}
+	}
+
 	ddbModelMap, err := attributevalue.MarshalMap(ddbModel)
 	if err != nil {
 		return err
 	}
-
-	// Set the record TTL
-	ddbModelMap["ttl"] = &types.AttributeValueMemberN{
-		Value: fmt.Sprintf("%d", time.Now().Unix()+d.ttlSeconds)}
+	ddbModelMap["ttl"] = &types.AttributeValueMemberN{Value: ttl}
 
 	// Add the dependency links
 	err = d.dep.RegisterCall(ctx, serviceName, operationName, ddbModel.TraceId, ddbModel.SpanId)
@@ -68,15 +122,28 @@ func (d *DdbWriter) WriteSpan(ctx context.Context, span *model.Span) error {
 		}
 	}
 
-	// Save the span
-	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
-		Item:      ddbModelMap,
-		TableName: aws.String(SpanTableName + d.suffix),
+	// Save the span, the old item tells if it's been saved before
+	res, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:                   ddbModelMap,
+		TableName:              aws.String(SpanTableName + d.suffix),
+		ReturnValues:           types.ReturnValueAllOld,
+		ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
 	})
 	// TODO: gracefully handle too large items
 	if err != nil {
 		return fmt.Errorf("failed to persist the span: %w", err)
 	}
+	meterFrom(ctx).addWrite(res.ConsumedCapacity)
+	d.opts.RecentSpans.add(&cached)
+	// The trace might have been cached as settled, or as missing
+	d.opts.TraceCache.invalidate(span.TraceID)
+
+	// Fold the span into the trace summary, it's used to search for traces
+	err = d.updateTraceSummary(ctx, span, ddbModel, ttl, len(res.Attributes) == 0)
+	if err != nil {
+		return err
+	}
+	d.opts.Activity.Record(serviceName, span.StartTime)
 
 	return nil
 }
@@ -0,0 +1,17 @@
+package utils
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// LoadAwsConfig loads the default AWS config, with the given shared config profile
+// if it's not empty
+func LoadAwsConfig(ctx context.Context, profile string) (aws.Config, error) {
+	var options []func(options *config.LoadOptions) error
+	if profile != "" {
+		options = append(options, config.WithSharedConfigProfile(profile))
+	}
+	return config.LoadDefaultConfig(ctx, options...)
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"expvar"
+	"github.com/jaegertracing/jaeger/pkg/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExpvarFactory is a metrics factory that publishes the metrics through expvar, they
+// can be seen at the "/debug/vars" endpoint of the default HTTP mux. Timers and
+// histograms are published as the number of observations and their sum.
+type ExpvarFactory struct {
+	prefix string
+	tags   map[string]string
+}
+
+var _ metrics.Factory = &ExpvarFactory{}
+
+// expvar panics when the same name is published twice, so we keep track of the
+// published variables ourselves.
+var expvarMtx sync.Mutex
+var expvarVars = map[string]publishedVar{}
+
+type publishedVar struct {
+	kind string
+	v    expvar.Var
+}
+
+func NewExpvarFactory(prefix string) *ExpvarFactory {
+	return &ExpvarFactory{prefix: prefix}
+}
+
+func (e *ExpvarFactory) metricName(name string, tags map[string]string) string {
+	var parts []string
+	if e.prefix != "" {
+		parts = append(parts, e.prefix)
+	}
+	parts = append(parts, name)
+	res := strings.Join(parts, ".")
+
+	allTags := map[string]string{}
+	for k, v := range e.tags {
+		allTags[k] = v
+	}
+	for k, v := range tags {
+		allTags[k] = v
+	}
+	var keys []string
+	for k := range allTags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		res += "|" + k + "=" + allTags[k]
+	}
+	return res
+}
+
+// publishVar returns the variable of the metric, the metrics of the same name and
+// tags share it. The metric of another kind (e.g. a gauge named as a counter) gets
+// its own variable, named "<name>#<kind>".
+func publishVar[T expvar.Var](name, kind string, create func() T) T {
+	expvarMtx.Lock()
+	defer expvarMtx.Unlock()
+
+	if p, ok := expvarVars[name]; ok && p.kind != kind {
+		name += "#" + kind
+	}
+	if p, ok := expvarVars[name]; ok {
+		if v, ok := p.v.(T); ok {
+			return v
+		}
+	}
+	v := create()
+	expvar.Publish(name, v)
+	expvarVars[name] = publishedVar{kind: kind, v: v}
+	return v
+}
+
+type expvarCounter struct {
+	v *expvar.Int
+}
+
+func (c *expvarCounter) Inc(delta int64) {
+	c.v.Add(delta)
+}
+
+type expvarGauge struct {
+	v *expvar.Int
+}
+
+func (g *expvarGauge) Update(value int64) {
+	g.v.Set(value)
+}
+
+type expvarObservations struct {
+	v *expvar.Map
+}
+
+func (o *expvarObservations) Record(value float64) {
+	o.v.Add("count", 1)
+	o.v.AddFloat("sum", value)
+}
+
+type expvarTimer struct {
+	expvarObservations
+}
+
+func (t *expvarTimer) Record(value time.Duration) {
+	t.expvarObservations.Record(value.Seconds())
+}
+
+func (e *ExpvarFactory) Counter(metric metrics.Options) metrics.Counter {
+	return &expvarCounter{v: publishVar(e.metricName(metric.Name, metric.Tags), "counter", func() *expvar.Int {
+		return new(expvar.Int)
+	})}
+}
+
+func (e *ExpvarFactory) Gauge(metric metrics.Options) metrics.Gauge {
+	return &expvarGauge{v: publishVar(e.metricName(metric.Name, metric.Tags), "gauge", func() *expvar.Int {
+		return new(expvar.Int)
+	})}
+}
+
+func (e *ExpvarFactory) Timer(metric metrics.TimerOptions) metrics.Timer {
+	return &expvarTimer{expvarObservations{v: publishVar(e.metricName(metric.Name, metric.Tags), "timer",
+		func() *expvar.Map { return new(expvar.Map).Init() })}}
+}
+
+func (e *ExpvarFactory) Histogram(metric metrics.HistogramOptions) metrics.Histogram {
+	return &expvarObservations{v: publishVar(e.metricName(metric.Name, metric.Tags), "histogram",
+		func() *expvar.Map { return new(expvar.Map).Init() })}
+}
+
+func (e *ExpvarFactory) Namespace(scope metrics.NSOptions) metrics.Factory {
+	res := &ExpvarFactory{
+		prefix: scope.Name,
+		tags:   map[string]string{},
+	}
+	if e.prefix != "" {
+		res.prefix = e.prefix + "." + scope.Name
+	}
+	for k, v := range e.tags {
+		res.tags[k] = v
+	}
+	for k, v := range scope.Tags {
+		res.tags[k] = v
+	}
+	return res
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"expvar"
+	"github.com/jaegertracing/jaeger/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestExpvarFactory(t *testing.T) {
+	factory := NewExpvarFactory("test_expvar").Namespace(metrics.NSOptions{
+		Name: "ns",
+		Tags: map[string]string{"b": "2"},
+	})
+	tags := map[string]string{"a": "1"}
+
+	factory.Counter(metrics.Options{Name: "requests", Tags: tags}).Inc(2)
+	factory.Counter(metrics.Options{Name: "requests", Tags: tags}).Inc(3)
+	assert.Equal(t, "5", expvar.Get("test_expvar.ns.requests|a=1|b=2").String())
+
+	// The metrics of different kinds don't share the variable
+	factory.Gauge(metrics.Options{Name: "requests", Tags: tags}).Update(42)
+	factory.Histogram(metrics.HistogramOptions{Name: "requests", Tags: tags}).Record(1.5)
+	assert.Equal(t, "5", expvar.Get("test_expvar.ns.requests|a=1|b=2").String())
+	assert.Equal(t, "42", expvar.Get("test_expvar.ns.requests|a=1|b=2#gauge").String())
+	assert.Equal(t, `{"count": 1, "sum": 1.5}`, expvar.Get("test_expvar.ns.requests|a=1|b=2#histogram").String())
+}